@@ -0,0 +1,322 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"simpleChat/client/chat"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPrefix 命令前缀，!help
+const DefaultPrefix = "!"
+
+// CommandFunc 处理一条命令，返回的错误会回复到房间里
+type CommandFunc func(ctx *Context) error
+
+// Context 一次命令调用
+type Context struct {
+	context.Context
+	Room    *Room
+	Msg     *chat.BaseMsg
+	Command string
+	Args    []string
+}
+
+// Reply 在命令所在的房间回复
+func (ctx *Context) Reply(format string, args ...interface{}) error {
+	return ctx.Room.Say(fmt.Sprintf(format, args...))
+}
+
+// Schedule 定时在房间里发一条消息
+type Schedule struct {
+	Every time.Duration
+	Text  string
+}
+
+// RoomConfig 单个房间的配置
+type RoomConfig struct {
+	// Name 在这个房间里登录的名字，默认bot名加房间号，比如helper-3。
+	// 服务器上一个用户同一时间只能在一个房间，所以每个房间要用不同的名字
+	Name string
+	// Commands 房间里可用的命令，空表示全部
+	Commands []string
+	// Settings 给命令用的键值配置
+	Settings map[string]string
+	// Schedules 定时消息
+	Schedules []Schedule
+}
+
+type command struct {
+	name string
+	help string
+	fn   CommandFunc
+}
+
+type task struct {
+	every time.Duration
+	fn    func(r *Room)
+}
+
+// Bot 基于客户端SDK的机器人，每个房间一个连接
+type Bot struct {
+	Name   string
+	Prefix string
+
+	commands map[string]*command
+	tasks    []*task
+	configs  map[int]*RoomConfig
+
+	lock  sync.Mutex
+	rooms map[int]*Room
+}
+
+// Room 机器人所在的一个房间
+type Room struct {
+	ID     int
+	Name   string
+	Config *RoomConfig
+
+	bot    *Bot
+	client *chat.Client
+}
+
+func New(name string) *Bot {
+	b := &Bot{
+		Name:     name,
+		Prefix:   DefaultPrefix,
+		commands: make(map[string]*command),
+		configs:  make(map[int]*RoomConfig),
+		rooms:    make(map[int]*Room),
+	}
+	b.Command("help", "list commands", b.helpCommand)
+	return b
+}
+
+// Command 注册命令，同名的覆盖
+func (b *Bot) Command(name string, help string, fn CommandFunc) {
+	b.commands[strings.ToLower(name)] = &command{
+		name: strings.ToLower(name),
+		help: help,
+		fn:   fn,
+	}
+}
+
+// Every 每隔一段时间在每个房间里执行一次
+func (b *Bot) Every(every time.Duration, fn func(r *Room)) {
+	b.tasks = append(b.tasks, &task{every: every, fn: fn})
+}
+
+// Join 配置要进的房间，config可以为nil
+func (b *Bot) Join(roomID int, config *RoomConfig) {
+	if config == nil {
+		config = &RoomConfig{}
+	}
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("%s-%d", b.Name, roomID)
+	}
+	b.configs[roomID] = config
+}
+
+// Room 已经进入的房间
+func (b *Bot) Room(roomID int) *Room {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rooms[roomID]
+}
+
+// Start 连上服务器并进入配置的房间，ctx结束后断开
+func (b *Bot) Start(ctx context.Context, addr string) error {
+	roomIDs := make([]int, 0, len(b.configs))
+	for roomID := range b.configs {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Ints(roomIDs)
+
+	for _, roomID := range roomIDs {
+		room, err := b.joinRoom(ctx, addr, roomID, b.configs[roomID])
+		if err != nil {
+			b.closeRooms()
+			return err
+		}
+		b.lock.Lock()
+		b.rooms[roomID] = room
+		b.lock.Unlock()
+	}
+
+	for _, room := range b.roomList() {
+		for _, schedule := range room.Config.Schedules {
+			text := schedule.Text
+			go b.runEvery(ctx, schedule.Every, room, func(r *Room) {
+				if err := r.Say(text); err != nil {
+					log.Printf("bot %s schedule err %s", r.Name, err.Error())
+				}
+			})
+		}
+		for _, t := range b.tasks {
+			go b.runEvery(ctx, t.every, room, t.fn)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		b.closeRooms()
+	}()
+	return nil
+}
+
+func (b *Bot) joinRoom(ctx context.Context, addr string, roomID int, config *RoomConfig) (*Room, error) {
+	room := &Room{
+		ID:     roomID,
+		Name:   config.Name,
+		Config: config,
+		bot:    b,
+	}
+	client, err := chat.Dial(ctx, addr, &chat.Options{Handler: chat.HandlerFunc(room.handleMsg)})
+	if err != nil {
+		return nil, err
+	}
+	room.client = client
+
+	if err := client.Login(ctx, config.Name); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("bot login %s: %w", config.Name, err)
+	}
+	if err := client.Join(ctx, roomID); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("bot %s join room %d: %w", config.Name, roomID, err)
+	}
+	return room, nil
+}
+
+func (b *Bot) roomList() []*Room {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	roomList := make([]*Room, 0, len(b.rooms))
+	for _, room := range b.rooms {
+		roomList = append(roomList, room)
+	}
+	sort.Slice(roomList, func(i, j int) bool {
+		return roomList[i].ID < roomList[j].ID
+	})
+	return roomList
+}
+
+func (b *Bot) closeRooms() {
+	for _, room := range b.roomList() {
+		room.client.Close()
+	}
+}
+
+func (b *Bot) runEvery(ctx context.Context, every time.Duration, room *Room, fn func(r *Room)) {
+	if every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn(room)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isBot 消息是不是机器人自己发的，不响应自己
+func (b *Bot) isBot(userName string) bool {
+	for _, config := range b.configs {
+		if strings.EqualFold(config.Name, userName) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMsg 在SDK的回调协程里执行，同一个房间的命令按顺序处理
+func (r *Room) handleMsg(c *chat.Client, msg *chat.BaseMsg) {
+	if msg.Type != chat.MsgTypeChat || msg.RoomID != r.ID || r.bot.isBot(msg.UserName) {
+		return
+	}
+	if !strings.HasPrefix(msg.Content, r.bot.Prefix) {
+		return
+	}
+
+	msgArr := strings.Fields(strings.TrimPrefix(msg.Content, r.bot.Prefix))
+	if len(msgArr) == 0 {
+		return
+	}
+	name := strings.ToLower(msgArr[0])
+	cmd := r.bot.commands[name]
+	if cmd == nil || !r.enabled(name) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chat.DefaultTimeout)
+	defer cancel()
+	commandCtx := &Context{
+		Context: ctx,
+		Room:    r,
+		Msg:     msg,
+		Command: name,
+		Args:    msgArr[1:],
+	}
+	if err := cmd.fn(commandCtx); err != nil {
+		if err := r.Say(fmt.Sprintf("%s%s: %s", r.bot.Prefix, name, err.Error())); err != nil {
+			log.Printf("bot %s reply err %s", r.Name, err.Error())
+		}
+	}
+}
+
+// enabled help总是可用
+func (r *Room) enabled(name string) bool {
+	if name == "help" || len(r.Config.Commands) == 0 {
+		return true
+	}
+	for _, enabled := range r.Config.Commands {
+		if strings.EqualFold(enabled, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Say 在房间里说一句话。换行会被服务器拆成多条，换成空格；
+// 以/开头会被当成命令，前面补一个空格
+func (r *Room) Say(text string) error {
+	text = strings.ReplaceAll(text, "\n", " ")
+	if strings.HasPrefix(text, "/") {
+		text = " " + text
+	}
+	return r.client.Send(text)
+}
+
+// Setting 房间配置里的值
+func (r *Room) Setting(key string) string {
+	return r.Config.Settings[key]
+}
+
+// Client 房间用的连接，可以调用Stats等方法
+func (r *Room) Client() *chat.Client {
+	return r.client
+}
+
+func (b *Bot) helpCommand(ctx *Context) error {
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		if ctx.Room.enabled(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s%s - %s", b.Prefix, name, b.commands[name].help))
+	}
+	return ctx.Room.Say(strings.Join(lines, "; "))
+}
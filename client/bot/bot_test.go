@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"context"
+	"simpleChat/client/chat"
+	"simpleChat/server/logic"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) *logic.Service {
+	config := logic.DefaultConfig()
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	config.BadWordsFile = ""
+
+	s := &logic.Service{Config: config, Clock: logic.NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func startHelper(t *testing.T, s *logic.Service) *Bot {
+	b := NewHelper("helper")
+	b.Join(1, &RoomConfig{
+		Settings:  map[string]string{SettingOnCall: "dana"},
+		Schedules: []Schedule{{Every: 20 * time.Millisecond, Text: "standup time"}},
+	})
+	b.Join(2, &RoomConfig{Commands: []string{"echo"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := b.Start(ctx, s.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func joinAs(t *testing.T, s *logic.Service, name string, roomID int) *chat.Client {
+	t.Helper()
+	ctx := context.Background()
+	c, err := chat.Dial(ctx, s.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(ctx, roomID); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// ask 发一条命令，返回机器人的下一句话，定时消息跳过
+func ask(t *testing.T, c *chat.Client, botName string, content string) string {
+	t.Helper()
+	if err := c.Send(content); err != nil {
+		t.Fatal(err)
+	}
+	baseMsg, err := c.Await(context.Background(), func(baseMsg *chat.BaseMsg) bool {
+		return baseMsg.Type == chat.MsgTypeChat && baseMsg.UserName == botName && baseMsg.Content != "standup time"
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", content, err)
+	}
+	return baseMsg.Content
+}
+
+func TestBot_commands(t *testing.T) {
+	s := startServer(t)
+	startHelper(t, s)
+	alice := joinAs(t, s, "alice", 1)
+
+	if got := ask(t, alice, "helper-1", "!oncall"); got != "on call: dana" {
+		t.Errorf("oncall = %q", got)
+	}
+	if got := ask(t, alice, "helper-1", "!ONCALL erin"); got != "on call is now erin" {
+		t.Errorf("set oncall = %q", got)
+	}
+	if got := ask(t, alice, "helper-1", "!oncall"); got != "on call: erin" {
+		t.Errorf("oncall after set = %q", got)
+	}
+	if got := ask(t, alice, "helper-1", "!seen alice"); got != "alice is active in room 1" {
+		t.Errorf("seen = %q", got)
+	}
+	if got := ask(t, alice, "helper-1", "!seen nobody"); got != "!seen: "+chat.UserNotFound {
+		t.Errorf("seen unknown = %q", got)
+	}
+	// 回复的内容不会被当成命令
+	if got := ask(t, alice, "helper-1", "!echo /logout"); got != " /logout" {
+		t.Errorf("echo command = %q", got)
+	}
+	help := ask(t, alice, "helper-1", "!help")
+	for _, name := range []string{"!echo", "!help", "!oncall", "!seen"} {
+		if !strings.Contains(help, name) {
+			t.Errorf("help %q missing %s", help, name)
+		}
+	}
+}
+
+func TestBot_roomConfig(t *testing.T) {
+	s := startServer(t)
+	startHelper(t, s)
+	bob := joinAs(t, s, "bob", 2)
+
+	// 房间2只开了echo，oncall和不认识的命令都不回复
+	if err := bob.Send("!oncall"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Send("!nope"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ask(t, bob, "helper-2", "!echo hi there"); got != "hi there" {
+		t.Errorf("first reply = %q, want echo", got)
+	}
+	if got := ask(t, bob, "helper-2", "!help"); got != "!echo - repeat the text; !help - list commands" {
+		t.Errorf("help = %q", got)
+	}
+}
+
+func TestBot_schedule(t *testing.T) {
+	s := startServer(t)
+	startHelper(t, s)
+	alice := joinAs(t, s, "alice", 1)
+
+	for i := 0; i < 2; i++ {
+		if _, err := alice.Await(context.Background(), func(baseMsg *chat.BaseMsg) bool {
+			return baseMsg.Type == chat.MsgTypeChat && baseMsg.UserName == "helper-1" && baseMsg.Content == "standup time"
+		}); err != nil {
+			t.Fatalf("schedule %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+)
+
+// 示例机器人用到的房间配置
+const (
+	SettingOnCall = "oncall"
+)
+
+// NewHelper 示例机器人：
+// !oncall 查看或设置房间的值班人，!seen name 查看用户在不在线，!echo 原样回复。
+// 站会提醒之类的定时消息放在房间配置的Schedules里
+func NewHelper(name string) *Bot {
+	b := New(name)
+	b.Command("oncall", "show or set who is on call", onCallCommand)
+	b.Command("seen", "show whether a user is online", seenCommand)
+	b.Command("echo", "repeat the text", echoCommand)
+	return b
+}
+
+// onCallCommand 设置只在当前房间生效
+func onCallCommand(ctx *Context) error {
+	if len(ctx.Args) > 0 {
+		if ctx.Room.Config.Settings == nil {
+			ctx.Room.Config.Settings = make(map[string]string)
+		}
+		ctx.Room.Config.Settings[SettingOnCall] = ctx.Args[0]
+		return ctx.Reply("on call is now %s", ctx.Args[0])
+	}
+
+	onCall := ctx.Room.Setting(SettingOnCall)
+	if onCall == "" {
+		return ctx.Reply("no one is on call")
+	}
+	return ctx.Reply("on call: %s", onCall)
+}
+
+func seenCommand(ctx *Context) error {
+	if len(ctx.Args) == 0 {
+		return errors.New("usage seen <name>")
+	}
+	stats, err := ctx.Room.Client().Stats(ctx, ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	return ctx.Reply("%s is %s", stats.Name, stats.Get("presence"))
+}
+
+func echoCommand(ctx *Context) error {
+	return ctx.Reply("%s", strings.Join(ctx.Args, " "))
+}
@@ -0,0 +1,83 @@
+package chat
+
+const (
+	_               = iota
+	MsgTypeChat     // 聊天消息
+	MsgTypeSystem   // 系统通知
+	MsgTypeAnnounce // 公告
+	MsgTypeJoin     // 有人加入房间
+	MsgTypeLeave    // 有人离开房间
+	MsgTypeHistory  // 历史消息
+	MsgTypeSearch   // 搜索结果
+	MsgTypeEdit     // 消息被编辑
+	MsgTypeDelete   // 消息被删除
+	MsgTypeReaction // 消息的表情回应有变化
+	MsgTypeDirect   // 私聊
+	MsgTypeMention  // 被@提醒
+	MsgTypeReceipt  // 私聊已读回执
+	MsgTypeTyping   // 正在输入
+	MsgTypePopular  // 房间高频词
+	MsgTypeStats    // 用户统计
+)
+
+// 服务器回复的通知
+const (
+	LoginSuccess    = "Notify:LoginSuccess"
+	NameRepeat      = "Notify:NameRepeat"
+	AlreadyLogin    = "Notify:AlreadyLogin"
+	LoginPending    = "Notify:LoginPending"
+	NameInvalid     = "Notify:NameInvalid"
+	JoinRoomSuccess = "Notify:JoinRoomSuccess"
+	RoomIDErr       = "Notify:RoomIDErr"
+	RoomBanned      = "Notify:RoomBanned"
+	NotRoomMember   = "Notify:NotRoomMember"
+	HistoryEmpty    = "Notify:HistoryEmpty"
+	HistoryArgErr   = "Notify:HistoryArgErr"
+	UserNotFound    = "Notify:UserNotFound"
+)
+
+// AnnotationLinks 服务器标注的消息里链接的域名，逗号分隔
+const AnnotationLinks = "links"
+
+// 命令
+const (
+	Name       = "/name"
+	ChangeRoom = "/room"
+	Logout     = "/logout"
+	History    = "/history"
+	Stats      = "/stats"
+	Popular    = "/popular"
+)
+
+type BaseMsg struct {
+	Type     int
+	MsgID    int64
+	MsgTime  int64
+	UserName string
+	RoomID   int
+	Content  string
+	EditTime int64
+	Deleted  bool
+
+	ParentID  int64
+	Reactions []*Reaction
+
+	ToUser string
+
+	ExpireTime int64
+
+	DisplayName string
+
+	Annotations map[string]string `json:",omitempty"`
+
+	Integration string `json:",omitempty"` // 集成通过HTTP接口发的消息
+}
+
+type Reaction struct {
+	Emoji string
+	Users []string
+}
+
+type PushMsg struct {
+	PushConnMsg []*BaseMsg
+}
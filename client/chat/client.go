@@ -0,0 +1,369 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeout = errors.New("chat: wait reply timeout")
+	ErrClosed  = errors.New("chat: connection closed")
+)
+
+// DefaultTimeout ctx没有deadline时等待回复的时间
+const DefaultTimeout = 3 * time.Second
+
+// DefaultEventBuffer 事件channel的默认长度
+const DefaultEventBuffer = 1024
+
+// NotifyError 服务器回复的失败通知，比如NotifyError(NameRepeat)
+type NotifyError string
+
+func (e NotifyError) Error() string {
+	return string(e)
+}
+
+// Handler 处理收到的消息。在单独的协程里按顺序调用，可以在里面调用Client的方法
+type Handler interface {
+	HandleMsg(c *Client, msg *BaseMsg)
+}
+
+// HandlerFunc 把普通函数当作Handler
+type HandlerFunc func(c *Client, msg *BaseMsg)
+
+func (f HandlerFunc) HandleMsg(c *Client, msg *BaseMsg) {
+	f(c, msg)
+}
+
+// Options Dial的可选项，传nil用默认值
+type Options struct {
+	// Timeout ctx没有deadline时等待回复的时间，默认DefaultTimeout
+	Timeout time.Duration
+	// Handler 设置后收到的消息交给Handler，Events返回nil
+	Handler Handler
+	// EventBuffer 事件channel的长度，默认DefaultEventBuffer。
+	// 写满后读连接会阻塞，Handler里不要长时间卡住
+	EventBuffer int
+}
+
+// Client 一个到聊天服务的连接。
+// Login、History等方法的回复由方法自己取走，其余消息按顺序放进Events或者交给Handler
+type Client struct {
+	conn net.Conn
+	opts Options
+
+	eventChan chan *BaseMsg
+
+	waitLock sync.Mutex
+	waiters  []*waiter
+	closed   bool
+
+	name string
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+// waiter 等一批回复，match看这一批的第一条
+type waiter struct {
+	match func(*BaseMsg) bool
+	reply chan []*BaseMsg
+}
+
+// Dial 连接聊天服务，ctx只控制建立连接
+func Dial(ctx context.Context, addr string, opts *Options) (*Client, error) {
+	c := &Client{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Timeout <= 0 {
+		c.opts.Timeout = DefaultTimeout
+	}
+	if c.opts.EventBuffer <= 0 {
+		c.opts.EventBuffer = DefaultEventBuffer
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.eventChan = make(chan *BaseMsg, c.opts.EventBuffer)
+
+	go c.connRead()
+	if c.opts.Handler != nil {
+		go c.dispatch()
+	}
+	return c, nil
+}
+
+// Events 收到的消息，连接断开后关闭。设置了Handler时返回nil
+func (c *Client) Events() <-chan *BaseMsg {
+	if c.opts.Handler != nil {
+		return nil
+	}
+	return c.eventChan
+}
+
+// Name 登录成功的名字
+func (c *Client) Name() string {
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+	return c.name
+}
+
+func (c *Client) connRead() {
+	defer c.shutdown()
+
+	// 服务器推送的是连续的JSON对象
+	decoder := json.NewDecoder(c.conn)
+	for {
+		pushMsg := &PushMsg{}
+		if err := decoder.Decode(pushMsg); err != nil {
+			return
+		}
+		if len(pushMsg.PushConnMsg) == 0 {
+			continue
+		}
+		if c.deliverReply(pushMsg.PushConnMsg) {
+			continue
+		}
+		for _, baseMsg := range pushMsg.PushConnMsg {
+			c.eventChan <- baseMsg
+		}
+	}
+}
+
+// deliverReply 交给第一个匹配的waiter，没有人等就返回false
+func (c *Client) deliverReply(batch []*BaseMsg) bool {
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+	for i, w := range c.waiters {
+		if !w.match(batch[0]) {
+			continue
+		}
+		c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+		w.reply <- batch
+		return true
+	}
+	return false
+}
+
+// shutdown 连接断开，关闭事件channel，还在等的调用返回ErrClosed
+func (c *Client) shutdown() {
+	c.waitLock.Lock()
+	c.closed = true
+	for _, w := range c.waiters {
+		close(w.reply)
+	}
+	c.waiters = nil
+	c.waitLock.Unlock()
+
+	close(c.eventChan)
+}
+
+func (c *Client) dispatch() {
+	for baseMsg := range c.eventChan {
+		c.opts.Handler.HandleMsg(c, baseMsg)
+	}
+}
+
+// SendRaw 原样发一行，命令或者聊天内容
+func (c *Client) SendRaw(content string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write([]byte(content + "\n"))
+	return err
+}
+
+// Send 在当前房间发一条聊天消息
+func (c *Client) Send(content string) error {
+	return c.SendRaw(content)
+}
+
+// Login 登录，失败返回NotifyError
+func (c *Client) Login(ctx context.Context, name string) error {
+	_, err := c.call(ctx, Name+" "+name, LoginSuccess, matchNotify(LoginSuccess, NameRepeat, AlreadyLogin, LoginPending, NameInvalid))
+	if err != nil {
+		return err
+	}
+	c.waitLock.Lock()
+	c.name = name
+	c.waitLock.Unlock()
+	return nil
+}
+
+// Join 进入房间，返回时已经在房间里
+func (c *Client) Join(ctx context.Context, roomID int) error {
+	_, err := c.call(ctx, fmt.Sprintf("%s %d", ChangeRoom, roomID), JoinRoomSuccess, matchNotify(JoinRoomSuccess, RoomIDErr, RoomBanned))
+	return err
+}
+
+// History 拉取房间里beforeID之前的limit条消息，beforeID为0从最新开始。没有消息返回空
+func (c *Client) History(ctx context.Context, roomID int, beforeID int64, limit int) ([]*BaseMsg, error) {
+	command := fmt.Sprintf("%s %d %d %d", History, roomID, beforeID, limit)
+	batch, err := c.call(ctx, command, "", func(baseMsg *BaseMsg) bool {
+		if baseMsg.Type == MsgTypeHistory {
+			return baseMsg.RoomID == roomID
+		}
+		return isNotify(baseMsg, HistoryEmpty, HistoryArgErr, RoomIDErr, RoomBanned, NotRoomMember)
+	})
+	if err == NotifyError(HistoryEmpty) {
+		return nil, nil
+	}
+	return batch, err
+}
+
+// Stats 查询用户的统计信息，用户不存在返回NotifyError(UserNotFound)
+func (c *Client) Stats(ctx context.Context, name string) (*UserStats, error) {
+	batch, err := c.call(ctx, Stats+" "+name, "", func(baseMsg *BaseMsg) bool {
+		if baseMsg.Type == MsgTypeStats {
+			return strings.EqualFold(baseMsg.UserName, name)
+		}
+		return isNotify(baseMsg, UserNotFound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseStats(batch[0]), nil
+}
+
+// Popular 房间最近10分钟出现最多的单词，没有消息时为空
+func (c *Client) Popular(ctx context.Context, roomID int) (string, error) {
+	batch, err := c.call(ctx, fmt.Sprintf("%s %d", Popular, roomID), "", func(baseMsg *BaseMsg) bool {
+		if baseMsg.Type == MsgTypePopular {
+			return baseMsg.RoomID == roomID
+		}
+		return isNotify(baseMsg, RoomIDErr)
+	})
+	if err != nil {
+		return "", err
+	}
+	return batch[0].Content, nil
+}
+
+// Logout 登出当前连接，连接本身不断开
+func (c *Client) Logout() error {
+	return c.SendRaw(Logout)
+}
+
+// call 先登记waiter再发命令，等到匹配的一批回复。
+// 回复是success以外的通知时返回NotifyError
+func (c *Client) call(ctx context.Context, command string, success string, match func(*BaseMsg) bool) ([]*BaseMsg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	w := &waiter{
+		match: match,
+		reply: make(chan []*BaseMsg, 1),
+	}
+	c.waitLock.Lock()
+	if c.closed {
+		c.waitLock.Unlock()
+		return nil, ErrClosed
+	}
+	c.waiters = append(c.waiters, w)
+	c.waitLock.Unlock()
+
+	if err := c.SendRaw(command); err != nil {
+		c.cancelWait(w)
+		return nil, err
+	}
+
+	select {
+	case batch, ok := <-w.reply:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if batch[0].Type == MsgTypeSystem && batch[0].Content != success {
+			return nil, NotifyError(batch[0].Content)
+		}
+		return batch, nil
+	case <-ctx.Done():
+		c.cancelWait(w)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) cancelWait(w *waiter) {
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func matchNotify(notifies ...string) func(*BaseMsg) bool {
+	return func(baseMsg *BaseMsg) bool {
+		return isNotify(baseMsg, notifies...)
+	}
+}
+
+func isNotify(baseMsg *BaseMsg, notifies ...string) bool {
+	if baseMsg.Type != MsgTypeSystem {
+		return false
+	}
+	for _, notify := range notifies {
+		if baseMsg.Content == notify {
+			return true
+		}
+	}
+	return false
+}
+
+// Await 从Events里等到第一条满足条件的消息，之前收到的消息都丢掉。设置了Handler时不能用
+func (c *Client) Await(ctx context.Context, match func(*BaseMsg) bool) (*BaseMsg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	for {
+		select {
+		case baseMsg, ok := <-c.eventChan:
+			if !ok {
+				return nil, ErrClosed
+			}
+			if match(baseMsg) {
+				return baseMsg, nil
+			}
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AwaitContent 等一条内容完全相同的消息
+func (c *Client) AwaitContent(ctx context.Context, content string) (*BaseMsg, error) {
+	return c.Await(ctx, func(baseMsg *BaseMsg) bool {
+		return baseMsg.Content == content
+	})
+}
+
+// Close 断开连接，Events随后关闭
+func (c *Client) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentServer 只接受连接，从不回复
+func silentServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClient_typedCalls(t *testing.T) {
+	s, _ := startServer(t)
+	ctx := context.Background()
+	alice := login(t, s, "alice")
+	join(t, alice, 4)
+
+	if msgs, err := alice.History(ctx, 4, 0, 10); err != nil || len(msgs) != 0 {
+		t.Errorf("empty history = %d msgs, err %v", len(msgs), err)
+	}
+	say(t, alice, "alice", "foo bar foo")
+	say(t, alice, "alice", "second")
+
+	msgs, err := alice.History(ctx, 4, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Content != "foo bar foo" || msgs[1].Content != "second" {
+		t.Errorf("history = %+v", msgs)
+	}
+	if _, err := alice.History(ctx, 4, -1, 10); err != NotifyError(HistoryArgErr) {
+		t.Errorf("bad history arg err = %v", err)
+	}
+
+	if word, err := alice.Popular(ctx, 4); err != nil || word != "foo" {
+		t.Errorf("popular = %q, err %v", word, err)
+	}
+	if _, err := alice.Popular(ctx, -1); err != NotifyError(RoomIDErr) {
+		t.Errorf("popular bad room err = %v", err)
+	}
+
+	stats, err := alice.Stats(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Name != "alice" || stats.Get("presence") != "active in room 4" || stats.Get("messages") != "room 4: 2, total 2" {
+		t.Errorf("stats = %+v", stats.Fields)
+	}
+	if _, err := alice.Stats(ctx, "nobody"); err != NotifyError(UserNotFound) {
+		t.Errorf("stats unknown user err = %v", err)
+	}
+}
+
+func TestClient_handler(t *testing.T) {
+	s, _ := startServer(t)
+	ctx := context.Background()
+
+	// Handler里调用Client的方法不会卡住读协程
+	popularChan := make(chan string, 1)
+	handler := HandlerFunc(func(c *Client, msg *BaseMsg) {
+		if msg.Type != MsgTypeChat || msg.UserName != "alice" {
+			return
+		}
+		word, err := c.Popular(ctx, msg.RoomID)
+		if err != nil {
+			t.Errorf("popular in handler err %v", err)
+		}
+		popularChan <- word
+	})
+	bob, err := Dial(ctx, s.Addr(), &Options{Handler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if bob.Events() != nil {
+		t.Errorf("events with handler should be nil")
+	}
+	if err := bob.Login(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Join(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := login(t, s, "alice")
+	join(t, alice, 8)
+	say(t, alice, "alice", "zz zz")
+
+	select {
+	case word := <-popularChan:
+		if word != "zz" {
+			t.Errorf("popular = %q, want zz", word)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("handler never got alice chat")
+	}
+}
+
+func TestClient_context(t *testing.T) {
+	addr := silentServer(t)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Dial(canceled, addr, nil); err == nil {
+		t.Errorf("dial with canceled ctx should fail")
+	}
+
+	c, err := Dial(context.Background(), addr, &Options{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(context.Background(), "alice"); err != ErrTimeout {
+		t.Errorf("login without reply err = %v, want %v", err, ErrTimeout)
+	}
+	if err := c.Login(canceled, "alice"); err != context.Canceled {
+		t.Errorf("login canceled err = %v, want %v", err, context.Canceled)
+	}
+
+	// 等回复时断开
+	errChan := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		_, err := c.Popular(ctx, 1)
+		errChan <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	if err := <-errChan; err != ErrClosed {
+		t.Errorf("popular after close err = %v, want %v", err, ErrClosed)
+	}
+	if _, ok := <-c.Events(); ok {
+		t.Errorf("events not closed")
+	}
+	if err := c.Join(context.Background(), 1); err != ErrClosed {
+		t.Errorf("join after close err = %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,256 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"simpleChat/server/logic"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer 在随机端口上起一个真实的服务，时间用假时钟
+func startServer(t *testing.T, badWords ...string) (*logic.Service, *logic.FakeClock) {
+	config := logic.DefaultConfig()
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	config.BadWordsFile = filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(config.BadWordsFile, []byte(strings.Join(badWords, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := logic.NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &logic.Service{Config: config, Clock: clock}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s, clock
+}
+
+func dial(t *testing.T, s *logic.Service) *Client {
+	t.Helper()
+	c, err := Dial(context.Background(), s.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func login(t *testing.T, s *logic.Service, name string) *Client {
+	t.Helper()
+	c := dial(t, s)
+	if err := c.Login(context.Background(), name); err != nil {
+		t.Fatalf("login %s err %v", name, err)
+	}
+	return c
+}
+
+func join(t *testing.T, c *Client, roomID int) {
+	t.Helper()
+	if err := c.Join(context.Background(), roomID); err != nil {
+		t.Fatalf("join room %d err %v", roomID, err)
+	}
+}
+
+func await(t *testing.T, c *Client, desc string, match func(*BaseMsg) bool) *BaseMsg {
+	t.Helper()
+	baseMsg, err := c.Await(context.Background(), match)
+	if err != nil {
+		t.Fatalf("wait %s err %v", desc, err)
+	}
+	return baseMsg
+}
+
+func isChat(userName string, content string) func(*BaseMsg) bool {
+	return func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeChat && baseMsg.UserName == userName && baseMsg.Content == content
+	}
+}
+
+func isHistory(userName string, content string) func(*BaseMsg) bool {
+	return func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory && baseMsg.UserName == userName && baseMsg.Content == content
+	}
+}
+
+// say 发一句话，等到自己的回显说明房间已经处理完
+func say(t *testing.T, c *Client, userName string, content string) {
+	t.Helper()
+	if err := c.Send(content); err != nil {
+		t.Fatal(err)
+	}
+	await(t, c, "echo "+content, isChat(userName, content))
+}
+
+func TestE2E_loginConflicts(t *testing.T) {
+	s, _ := startServer(t)
+	alice := login(t, s, "alice")
+
+	if err := alice.Login(context.Background(), "alice2"); err != NotifyError(AlreadyLogin) {
+		t.Errorf("second login on same conn err = %v, want %s", err, AlreadyLogin)
+	}
+	if err := dial(t, s).Login(context.Background(), "ALICE"); err != NotifyError(NameRepeat) {
+		t.Errorf("case-insensitive duplicate err = %v, want %s", err, NameRepeat)
+	}
+	if err := dial(t, s).Login(context.Background(), "bad!name"); err != NotifyError(NameInvalid) {
+		t.Errorf("invalid name err = %v, want %s", err, NameInvalid)
+	}
+
+	// 同名在另一个连接上登录是多端登录
+	if err := dial(t, s).Login(context.Background(), "alice"); err != nil {
+		t.Errorf("second device login err = %v", err)
+	}
+}
+
+func TestE2E_roomSwitch(t *testing.T) {
+	s, _ := startServer(t)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	carol := login(t, s, "carol")
+	join(t, alice, 1)
+	join(t, bob, 1)
+	join(t, carol, 2)
+
+	join(t, alice, 2)
+	await(t, bob, "alice leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "alice" && baseMsg.RoomID == 1
+	})
+	await(t, carol, "alice join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "alice" && baseMsg.RoomID == 2
+	})
+
+	say(t, alice, "alice", "hi two")
+	await(t, carol, "alice chat", isChat("alice", "hi two"))
+
+	// 旧房间的人收不到
+	if err := bob.Send("ping"); err != nil {
+		t.Fatal(err)
+	}
+	baseMsg := await(t, bob, "chat", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeChat
+	})
+	if baseMsg.UserName != "bob" || baseMsg.Content != "ping" {
+		t.Errorf("bob got %s:%s from room %d", baseMsg.UserName, baseMsg.Content, baseMsg.RoomID)
+	}
+
+	if err := alice.Join(context.Background(), logic.RoomNum); err != NotifyError(RoomIDErr) {
+		t.Errorf("join out of range err = %v, want %s", err, RoomIDErr)
+	}
+}
+
+func TestE2E_historyReplay(t *testing.T) {
+	s, _ := startServer(t)
+	alice := login(t, s, "alice")
+	join(t, alice, 3)
+	say(t, alice, "alice", "one")
+	say(t, alice, "alice", "two")
+
+	// 进房间后按历史消息推送最近的消息，Join返回前已经收到
+	bob := login(t, s, "bob")
+	join(t, bob, 3)
+	first := await(t, bob, "replay one", isHistory("alice", "one"))
+	second := await(t, bob, "replay two", isHistory("alice", "two"))
+	if first.MsgID >= second.MsgID {
+		t.Errorf("replay order %d >= %d", first.MsgID, second.MsgID)
+	}
+
+	history, err := bob.History(context.Background(), 3, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].MsgID != second.MsgID || history[0].Content != "two" {
+		t.Errorf("history = %v, want #%d two", history, second.MsgID)
+	}
+}
+
+func TestE2E_popular(t *testing.T) {
+	s, clock := startServer(t)
+	alice := login(t, s, "alice")
+	join(t, alice, 5)
+
+	say(t, alice, "alice", "aa aa aa")
+	if err := alice.SendRaw("/popular 5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AwaitContent(context.Background(), "aa"); err != nil {
+		t.Fatalf("popular aa err %v", err)
+	}
+
+	// 十分钟前的消息不算
+	clock.Advance((logic.PopularBeforeSecond + 1) * time.Second)
+	say(t, alice, "alice", "bb")
+	if err := alice.SendRaw("/popular 5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AwaitContent(context.Background(), "bb"); err != nil {
+		t.Fatalf("popular bb err %v", err)
+	}
+}
+
+func TestE2E_badWords(t *testing.T) {
+	s, _ := startServer(t, "damn", "heck")
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	join(t, alice, 6)
+	join(t, bob, 6)
+
+	if err := alice.Send("oh damn what the heck"); err != nil {
+		t.Fatal(err)
+	}
+	await(t, bob, "filtered chat", isChat("alice", "oh * what the *"))
+
+	if err := dial(t, s).Login(context.Background(), "damnit"); err != NotifyError(NameInvalid) {
+		t.Errorf("bad word name err = %v, want %s", err, NameInvalid)
+	}
+}
+
+func TestE2E_logout(t *testing.T) {
+	s, _ := startServer(t)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	join(t, alice, 7)
+	join(t, bob, 7)
+
+	if err := alice.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	await(t, bob, "alice leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "alice"
+	})
+
+	if err := bob.SendRaw("/stats alice"); err != nil {
+		t.Fatal(err)
+	}
+	stats := await(t, bob, "alice stats", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "stats alice")
+	})
+	if !strings.Contains(stats.Content, "presence: "+logic.PresenceOffline) {
+		t.Errorf("stats after logout:\n%s", stats.Content)
+	}
+
+	// 登出后同一个连接可以重新登录
+	if err := alice.Login(context.Background(), "alice"); err != nil {
+		t.Errorf("login again err = %v", err)
+	}
+
+	// 断开连接也算登出
+	bob.Close()
+	if _, err := bob.Await(context.Background(), func(*BaseMsg) bool { return false }); err != ErrClosed {
+		t.Errorf("await after close err = %v, want %v", err, ErrClosed)
+	}
+	for i := 0; i < 100; i++ {
+		if err := alice.SendRaw(fmt.Sprintf("/stats %s", "bob")); err != nil {
+			t.Fatal(err)
+		}
+		stats = await(t, alice, "bob stats", func(baseMsg *BaseMsg) bool {
+			return strings.HasPrefix(baseMsg.Content, "stats bob")
+		})
+		if strings.Contains(stats.Content, "presence: "+logic.PresenceOffline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("bob still online after disconnect")
+}
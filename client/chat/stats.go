@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"strings"
+)
+
+// UserStats /stats的结果，Fields按"key: value"一行一项拆开
+type UserStats struct {
+	Name    string
+	Fields  map[string]string
+	Content string
+}
+
+// Get 取一项，比如Get("presence")
+func (s *UserStats) Get(key string) string {
+	return s.Fields[key]
+}
+
+func parseStats(baseMsg *BaseMsg) *UserStats {
+	stats := &UserStats{
+		Name:    baseMsg.UserName,
+		Fields:  make(map[string]string),
+		Content: baseMsg.Content,
+	}
+	for _, line := range strings.Split(baseMsg.Content, "\n") {
+		index := strings.Index(line, ": ")
+		if index < 0 {
+			continue
+		}
+		stats.Fields[line[:index]] = line[index+2:]
+	}
+	return stats
+}
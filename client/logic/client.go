@@ -2,34 +2,26 @@ package logic
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"runtime"
+	"simpleChat/client/chat"
 	"strings"
-	"sync"
+	"time"
 )
 
 type Client struct {
-	conn net.Conn
-
-	writeChan chan []byte
-
-	wg        sync.WaitGroup
-	closeChan chan bool
+	conn *chat.Client
 }
 
 func NewClient() *Client {
-	return &Client{
-		closeChan: make(chan bool, 1),
-		writeChan: make(chan []byte, 1024),
-	}
+	return &Client{}
 }
 
 func (c *Client) CreateConn() {
-	conn, err := net.Dial("tcp", "127.0.0.1:5678")
+	conn, err := chat.Dial(context.Background(), "127.0.0.1:5678", nil)
 	if err != nil {
 		log.Fatalf("dial err %s", err.Error())
 		return
@@ -38,53 +30,91 @@ func (c *Client) CreateConn() {
 
 	// 读协程
 	go c.connRead()
-
-	// 写协程
-	go c.connWrite()
 }
 
 func (c *Client) connRead() {
-	buffer := make([]byte, 10240)
-	for {
-		n, err := c.conn.Read(buffer)
-		if err != nil {
-			log.Printf("conn read buffer err %s", err.Error())
-			continue
-		}
-		bytesMsg := buffer[:n]
+	for baseMsg := range c.conn.Events() {
+		fmt.Println(formatMsg(baseMsg))
+	}
+	log.Printf("conn closed")
+}
 
-		pushMsg := &PushMsg{}
-		err = json.Unmarshal(bytesMsg, pushMsg)
-		if err != nil {
-			log.Printf("unmarshal msg err %s", err.Error())
-			continue
-		}
+func formatMsg(baseMsg *chat.BaseMsg) string {
+	switch baseMsg.Type {
+	case chat.MsgTypeSystem:
+		return "[system] " + baseMsg.Content
+	case chat.MsgTypeAnnounce:
+		return "[announce] " + baseMsg.Content
+	case chat.MsgTypeJoin:
+		return fmt.Sprintf("[system] %s joined room %d", baseMsg.UserName, baseMsg.RoomID)
+	case chat.MsgTypeLeave:
+		return fmt.Sprintf("[system] %s left room %d", baseMsg.UserName, baseMsg.RoomID)
+	case chat.MsgTypeHistory, chat.MsgTypeSearch:
+		msgTime := time.Unix(baseMsg.MsgTime, 0).Format("01-02 15:04:05")
+		return fmt.Sprintf("[#%d %s] %s:%s", baseMsg.MsgID, msgTime, senderName(baseMsg), formatContent(baseMsg))
+	case chat.MsgTypeEdit:
+		return fmt.Sprintf("[edit #%d] %s:%s", baseMsg.MsgID, baseMsg.UserName, baseMsg.Content)
+	case chat.MsgTypeDelete:
+		return fmt.Sprintf("[delete #%d] %s", baseMsg.MsgID, baseMsg.UserName)
+	case chat.MsgTypeDirect:
+		return fmt.Sprintf("[dm #%d] %s -> %s:%s", baseMsg.MsgID, baseMsg.UserName, baseMsg.ToUser, baseMsg.Content)
+	case chat.MsgTypeMention:
+		return fmt.Sprintf("[mention #%d room %d] %s:%s", baseMsg.MsgID, baseMsg.RoomID, senderName(baseMsg), baseMsg.Content)
+	case chat.MsgTypeReceipt:
+		return fmt.Sprintf("[read #%d] %s", baseMsg.MsgID, baseMsg.UserName)
+	case chat.MsgTypeTyping:
+		return fmt.Sprintf("[typing] %s is typing...", senderName(baseMsg))
+	case chat.MsgTypePopular:
+		return fmt.Sprintf("[popular room %d] %s", baseMsg.RoomID, baseMsg.Content)
+	case chat.MsgTypeStats:
+		return "[stats] " + baseMsg.Content
+	case chat.MsgTypeReaction:
+		return fmt.Sprintf("[react #%d] %s %s%s", baseMsg.MsgID, baseMsg.UserName, baseMsg.Content, formatReactions(baseMsg))
+	}
 
-		for _, baseMsg := range pushMsg.PushConnMsg {
-			content := ""
-			if baseMsg.UserName != "" {
-				content += baseMsg.UserName + ":"
-			}
-			content += baseMsg.Content
+	content := ""
+	if baseMsg.UserName != "" {
+		content += senderName(baseMsg) + ":"
+	}
+	content += formatContent(baseMsg)
+	return content
+}
 
-			fmt.Println(content)
-		}
+// senderName 有昵称时显示昵称，集成发的消息加上标记
+func senderName(baseMsg *chat.BaseMsg) string {
+	name := baseMsg.UserName
+	if baseMsg.DisplayName != "" {
+		name = baseMsg.DisplayName
+	}
+	if baseMsg.Integration != "" {
+		name += " [bot " + baseMsg.Integration + "]"
 	}
+	return name
 }
 
-func (c *Client) connWrite() {
-	for {
-		select {
-		case msg := <-c.writeChan:
-			_, err := c.conn.Write(msg)
-			if err != nil {
-				log.Printf("write msg %s err %s", msg, err.Error())
-				continue
-			}
-		case <-c.closeChan:
-			return
-		}
+func formatContent(baseMsg *chat.BaseMsg) string {
+	if baseMsg.Deleted {
+		return "(deleted)"
+	}
+	content := baseMsg.Content
+	if baseMsg.ParentID > 0 {
+		content = fmt.Sprintf("(reply #%d) %s", baseMsg.ParentID, content)
+	}
+	if baseMsg.EditTime > 0 {
+		content += " (edited)"
 	}
+	if links := baseMsg.Annotations[chat.AnnotationLinks]; links != "" {
+		content += " [links " + links + "]"
+	}
+	return content + formatReactions(baseMsg)
+}
+
+func formatReactions(baseMsg *chat.BaseMsg) string {
+	content := ""
+	for _, reaction := range baseMsg.Reactions {
+		content += fmt.Sprintf(" [%s %d]", reaction.Emoji, len(reaction.Users))
+	}
+	return content
 }
 
 func (c *Client) ReadStdin() {
@@ -93,6 +123,17 @@ func (c *Client) ReadStdin() {
 	fmt.Println("2.use \"/room num\" to choose room, room num 0 - 9")
 	fmt.Println("3.use \"/stats name\" to show user info")
 	fmt.Println("4.use \"/popular roomNum\" to get most popular word in 10 min, room num 0 - 9")
+	fmt.Println("5.use \"/who [roomNum]\" to list room members, default your room")
+	fmt.Println("6.use \"/rooms\" to list rooms with member counts")
+	fmt.Println("7.use \"/history roomNum [beforeID] [limit]\" to page through room history")
+	fmt.Println("8.use \"/search roomNum query\" to search your room, supports \"phrase\" from:name since: until:")
+	fmt.Println("9.use \"/edit msgID text\" or \"/delete msgID\" to change your message")
+	fmt.Println("10.use \"/reply msgID text\" to reply, \"/react msgID emoji\" or \"/unreact msgID emoji\" to react")
+	fmt.Println("11.use \"/msg name text\" to send a direct message, kept for offline users")
+	fmt.Println("12.use \"@name\" in a message to mention someone, \"/mentions\" to list recent mentions")
+	fmt.Println("13.use \"/ack msgID\" to mark messages read up to msgID, /rooms shows unread counts")
+	fmt.Println("14.use \"/nick name\" to change display name, \"/profile status|tz [value]\" to set status or timezone")
+	fmt.Println("15.use \"/help [command]\" to list all commands, \"/logout\" to log out")
 
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -103,7 +144,9 @@ func (c *Client) ReadStdin() {
 		} else if sysType == "linux" {
 			s = strings.TrimRight(s, "\n")
 		}
-		// 发给conn，写给服务器
-		c.writeChan <- []byte(s)
+		// 写给服务器
+		if err := c.conn.SendRaw(s); err != nil {
+			log.Printf("write msg %s err %s", s, err.Error())
+		}
 	}
 }
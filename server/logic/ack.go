@@ -0,0 +1,118 @@
+package logic
+
+import (
+	"sort"
+)
+
+type DirectItem struct {
+	Msg      *BaseMsg
+	ReadTime int64 // 为0未读
+}
+
+func (um *UserManage) ackLogic(msg *UserAckMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
+		return
+	}
+	user := um.users[userName]
+	if user == nil {
+		return
+	}
+
+	// 私聊消息直接在这里处理，其余交给房间
+	directItem := user.findDirect(msg.MsgID)
+	if directItem == nil {
+		um.s.msgRoomShard(msg.MsgID).roomAckChan <- &RoomAckMsg{
+			UserName: userName,
+			MsgID:    msg.MsgID,
+		}
+		return
+	}
+	if directItem.ReadTime > 0 {
+		return
+	}
+	directItem.ReadTime = um.s.now()
+
+	// 通知发送人已读，发送人在别的分片就转过去
+	if !um.s.Config.DirectReadReceipt {
+		return
+	}
+	receipt := &BaseMsg{
+		Type:     MsgTypeReceipt,
+		MsgID:    directItem.Msg.MsgID,
+		MsgTime:  directItem.ReadTime,
+		UserName: userName,
+		ToUser:   directItem.Msg.UserName,
+	}
+	if shard := um.s.userShard(receipt.ToUser); shard != um {
+		shard.userReceiptChan <- receipt
+		return
+	}
+	um.receiptLogic(receipt)
+}
+
+// receiptLogic 已读回执推给在线的发送人
+func (um *UserManage) receiptLogic(receipt *BaseMsg) {
+	sender := um.users[receipt.ToUser]
+	if sender == nil || sender.Status != StatusOnline {
+		return
+	}
+	um.pushToUser(sender, receipt)
+}
+
+// addDirect 只保留最近DirectMaxNum条
+func (u *User) addDirect(directMsg *BaseMsg) {
+	u.Directs = append(u.Directs, &DirectItem{Msg: directMsg})
+	if len(u.Directs) > DirectMaxNum {
+		u.Directs = append([]*DirectItem(nil), u.Directs[len(u.Directs)-DirectMaxNum:]...)
+	}
+}
+
+func (u *User) findDirect(msgID int64) *DirectItem {
+	for _, directItem := range u.Directs {
+		if directItem.Msg.MsgID == msgID {
+			return directItem
+		}
+	}
+	return nil
+}
+
+func (rm *RoomManage) roomAckLogic(msg *RoomAckMsg) {
+	room, cMsg := rm.findRoomMsg(msg.MsgID)
+	if cMsg == nil {
+		return
+	}
+
+	// 已读游标只往前走
+	if room.ReadCursors[msg.UserName] < cMsg.MsgID {
+		room.ReadCursors[msg.UserName] = cMsg.MsgID
+	}
+}
+
+// initReadCursor 第一次进房间时之前的消息都算已读
+func (r *Room) initReadCursor(userName string) {
+	if _, ok := r.ReadCursors[userName]; ok {
+		return
+	}
+	var lastMsgID int64
+	if len(r.ChatMsg) > 0 {
+		lastMsgID = r.ChatMsg[len(r.ChatMsg)-1].MsgID
+	}
+	r.ReadCursors[userName] = lastMsgID
+}
+
+// unreadCount 已读游标之后别人发的、没被删除的消息数
+func (r *Room) unreadCount(userName string) int {
+	cursor := r.ReadCursors[userName]
+	i := sort.Search(len(r.ChatMsg), func(i int) bool {
+		return r.ChatMsg[i].MsgID > cursor
+	})
+
+	count := 0
+	for _, cMsg := range r.ChatMsg[i:] {
+		if !cMsg.Deleted && cMsg.UserName != userName {
+			count++
+		}
+	}
+	return count
+}
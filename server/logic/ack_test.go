@@ -0,0 +1,36 @@
+package logic
+
+import "testing"
+
+func TestRoom_unreadCount(t *testing.T) {
+	room := &Room{ReadCursors: make(map[string]int64)}
+	room.initReadCursor("alice")
+	for i, name := range []string{"bob", "alice", "bob", "bob"} {
+		room.ChatMsg = append(room.ChatMsg, &ChatMsg{MsgID: int64(i + 1), UserName: name})
+	}
+	room.ChatMsg[3].Deleted = true
+
+	// 后进来的人之前的消息都算已读
+	room.initReadCursor("carol")
+	tests := []struct {
+		name     string
+		userName string
+		cursor   int64
+		want     int
+	}{
+		{"all_unread_skip_own_and_deleted", "alice", 0, 2},
+		{"after_cursor", "alice", 1, 1},
+		{"all_read", "alice", 4, 0},
+		{"late_joiner", "carol", -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cursor >= 0 {
+				room.ReadCursors[tt.userName] = tt.cursor
+			}
+			if got := room.unreadCount(tt.userName); got != tt.want {
+				t.Errorf("unreadCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
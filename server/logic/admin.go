@@ -0,0 +1,607 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errReplyTimeout = errors.New("manager reply timeout")
+
+type AdminManage struct {
+	s *Service
+
+	server   *http.Server
+	listener net.Listener
+
+	wg sync.WaitGroup
+}
+
+type adminBroadcastReq struct {
+	Content string `json:"content"`
+	Rooms   []int  `json:"rooms"` // 为空则全服广播
+}
+
+type adminNameReq struct {
+	Name string `json:"name"`
+}
+
+type adminErrResp struct {
+	Error string `json:"error"`
+}
+
+type adminWebhooksResp struct {
+	Dropped int64 `json:"dropped"` // 事件通道满了丢掉的事件数
+}
+
+type adminMemberResp struct {
+	ConnID   int    `json:"connID"`
+	UserName string `json:"userName"`
+}
+
+func (am *AdminManage) Start(s *Service) {
+	am.s = s
+
+	// 没有配置地址或token时不开启管理接口
+	if s.Config.AdminAddr == "" || (s.Config.AdminToken == "" && len(s.Config.IntegrationTokens) == 0) {
+		log.Printf("admin api disabled")
+		return
+	}
+
+	listener, err := net.Listen("tcp", s.Config.AdminAddr)
+	if err != nil {
+		log.Printf("admin listen err %s", err.Error())
+		return
+	}
+	am.listener = listener
+
+	mux := http.NewServeMux()
+	// 只配置了集成token时只开放发消息接口
+	if s.Config.AdminToken != "" {
+		mux.HandleFunc("/admin/conns", am.auth(am.connsHandler))
+		mux.HandleFunc("/admin/conns/", am.auth(am.connHandler))
+		mux.HandleFunc("/admin/users", am.auth(am.usersHandler))
+		mux.HandleFunc("/admin/rooms", am.auth(am.roomsHandler))
+		mux.HandleFunc("/admin/rooms/", am.auth(am.roomHandler))
+		mux.HandleFunc("/admin/broadcast", am.auth(am.broadcastHandler))
+		mux.HandleFunc("/admin/badwords/reload", am.auth(am.reloadBadWordsHandler))
+		mux.HandleFunc("/admin/webhooks", am.auth(am.webhooksHandler))
+	}
+	mux.HandleFunc("/api/messages", am.integrationAuth(am.postMessageHandler))
+	am.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: AdminReadHeaderTimeout,
+		ReadTimeout:       AdminReadTimeout,
+		WriteTimeout:      AdminWriteTimeout,
+		IdleTimeout:       AdminIdleTimeout,
+	}
+
+	am.wg.Add(1)
+	go func() {
+		defer am.wg.Done()
+		err := am.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("admin serve err %s", err.Error())
+		}
+	}()
+}
+
+func (am *AdminManage) Stop() {
+	if am.server == nil {
+		return
+	}
+	am.server.Close()
+	am.wg.Wait()
+}
+
+// Addr 管理接口实际监听的地址
+func (am *AdminManage) Addr() string {
+	if am.listener == nil {
+		return ""
+	}
+	return am.listener.Addr().String()
+}
+
+func (am *AdminManage) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(am.s.Config.AdminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, &adminErrResp{Error: "unauthorized"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// GET /admin/conns
+func (am *AdminManage) connsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	connInfos, err := am.queryConns()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	userInfos, err := am.queryUsers()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+
+	// 补上连接对应的用户名
+	connNames := onlineConnNames(userInfos)
+	for _, connInfo := range connInfos {
+		connInfo.UserName = connNames[connInfo.ConnID]
+	}
+	sort.Slice(connInfos, func(i, j int) bool {
+		return connInfos[i].ConnID < connInfos[j].ConnID
+	})
+	writeJSON(w, http.StatusOK, connInfos)
+}
+
+// POST /admin/conns/{id}/kick
+func (am *AdminManage) connHandler(w http.ResponseWriter, r *http.Request) {
+	connID, action, ok := parseIDPath(r.URL.Path, "/admin/conns/")
+	if !ok || action != "kick" {
+		writeJSON(w, http.StatusNotFound, &adminErrResp{Error: "not found"})
+		return
+	}
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	userInfos, err := am.queryUsers()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	kicked, err := am.kickConn(connID)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	if !kicked {
+		writeJSON(w, http.StatusNotFound, &adminErrResp{Error: "conn not found"})
+		return
+	}
+
+	// 通知所在房间，多端登录时还有别的连接在房间里就不算踢出
+	for _, userInfo := range userInfos {
+		if userInfo.Status != StatusOnline || !containsConnID(userInfo.ConnIDs, connID) || userInfo.RoomID == 0 {
+			continue
+		}
+		if len(userInfo.ConnIDs) > 1 {
+			continue
+		}
+		err = am.broadcast(&BroadcastMsg{
+			RoomIDs: []int{userInfo.RoomID},
+			Type:    MsgTypeSystem,
+			Content: fmt.Sprintf(UserKicked, userInfo.Name),
+		})
+		if err != nil {
+			log.Printf("admin kick notice err %s", err.Error())
+		}
+		am.s.webhookManage.emit(&WebhookEvent{
+			Type:     WebhookEventModeration,
+			Action:   WebhookActionKick,
+			RoomID:   userInfo.RoomID,
+			Time:     am.s.now(),
+			UserName: userInfo.Name,
+		})
+	}
+	log.Printf("admin kick conn %d", connID)
+	writeJSON(w, http.StatusOK, map[string]int{"connID": connID})
+}
+
+// GET /admin/users
+func (am *AdminManage) usersHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	userInfos, err := am.queryUsers()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	sort.Slice(userInfos, func(i, j int) bool {
+		return userInfos[i].Name < userInfos[j].Name
+	})
+	writeJSON(w, http.StatusOK, userInfos)
+}
+
+// GET /admin/rooms
+func (am *AdminManage) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	roomInfos, err := am.queryRooms()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, roomInfos)
+}
+
+// GET /admin/webhooks
+func (am *AdminManage) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, &adminWebhooksResp{Dropped: am.s.webhookManage.Dropped()})
+}
+
+// GET /admin/rooms/{id}/members
+// GET /admin/rooms/{id}/history
+// GET /admin/rooms/{id}/search?q=xxx
+// POST /admin/rooms/{id}/ban
+// POST /admin/rooms/{id}/unban
+// POST /admin/rooms/{id}/op
+// POST /admin/rooms/{id}/deop
+func (am *AdminManage) roomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, action, ok := parseIDPath(r.URL.Path, "/admin/rooms/")
+	if !ok || roomID < 0 || roomID > RoomNum-1 {
+		writeJSON(w, http.StatusNotFound, &adminErrResp{Error: "room not found"})
+		return
+	}
+
+	switch action {
+	case "members":
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		am.roomMembers(w, roomID)
+	case "history":
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		chatMsg, err := am.queryHistory(roomID)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, chatMsg)
+	case "search":
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		am.roomSearch(w, r, roomID)
+	case "ban", "unban":
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		am.roomBan(w, r, roomID, action == "ban")
+	case "op", "deop":
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		am.roomOp(w, r, roomID, action == "op")
+	default:
+		writeJSON(w, http.StatusNotFound, &adminErrResp{Error: "not found"})
+	}
+}
+
+func (am *AdminManage) roomMembers(w http.ResponseWriter, roomID int) {
+	roomInfos, err := am.queryRooms()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	userInfos, err := am.queryUsers()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+
+	connNames := onlineConnNames(userInfos)
+	members := make([]*adminMemberResp, 0)
+	for _, roomInfo := range roomInfos {
+		if roomInfo.RoomID != roomID {
+			continue
+		}
+		for _, connID := range roomInfo.Members {
+			members = append(members, &adminMemberResp{
+				ConnID:   connID,
+				UserName: connNames[connID],
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (am *AdminManage) roomSearch(w http.ResponseWriter, r *http.Request, roomID int) {
+	query, err := ParseSearchQuery(r.URL.Query().Get("q"), am.s.now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: err.Error()})
+		return
+	}
+	chatMsg, err := am.searchRoom(roomID, query)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, chatMsg)
+}
+
+func (am *AdminManage) roomBan(w http.ResponseWriter, r *http.Request, roomID int, ban bool) {
+	req := &adminNameReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Name == "" {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: "name required"})
+		return
+	}
+
+	reply := make(chan bool, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+	select {
+	case am.s.userShard(req.Name).userBanChan <- &UserBanMsg{RoomID: roomID, Name: req.Name, Ban: ban, Reply: reply}:
+	case <-timer.C:
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: errReplyTimeout.Error()})
+		return
+	}
+	select {
+	case <-reply:
+	case <-timer.C:
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: errReplyTimeout.Error()})
+		return
+	}
+	log.Printf("admin room %d ban %s %v", roomID, req.Name, ban)
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (am *AdminManage) roomOp(w http.ResponseWriter, r *http.Request, roomID int, op bool) {
+	req := &adminNameReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Name == "" {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: "name required"})
+		return
+	}
+
+	reply := make(chan bool, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+	select {
+	case am.s.roomShard(roomID).roomOpChan <- &RoomOpMsg{RoomID: roomID, Name: req.Name, Op: op, Reply: reply}:
+	case <-timer.C:
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: errReplyTimeout.Error()})
+		return
+	}
+	select {
+	case <-reply:
+	case <-timer.C:
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: errReplyTimeout.Error()})
+		return
+	}
+	log.Printf("admin room %d op %s %v", roomID, req.Name, op)
+	writeJSON(w, http.StatusOK, req)
+}
+
+// POST /admin/broadcast
+func (am *AdminManage) broadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := &adminBroadcastReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Content == "" {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: "content required"})
+		return
+	}
+	for _, roomID := range req.Rooms {
+		if roomID < 0 || roomID > RoomNum-1 {
+			writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: "room not found"})
+			return
+		}
+	}
+
+	err := am.broadcast(&BroadcastMsg{
+		RoomIDs: req.Rooms,
+		Type:    MsgTypeAnnounce,
+		Content: req.Content,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	log.Printf("admin broadcast %s", req.Content)
+	writeJSON(w, http.StatusOK, req)
+}
+
+// POST /admin/badwords/reload
+func (am *AdminManage) reloadBadWordsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	badWords, err := readBadWords(am.s.Config.BadWordsFile)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &adminErrResp{Error: err.Error()})
+		return
+	}
+
+	// 每个用户分片各存一份
+	timeout := time.After(AdminReplyTimeout)
+	for _, userManage := range am.s.userShards {
+		select {
+		case userManage.userBadWordsChan <- badWords:
+		case <-timeout:
+			writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: errReplyTimeout.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"count": len(badWords)})
+}
+
+func (am *AdminManage) broadcast(msg *BroadcastMsg) error {
+	select {
+	case am.s.msgManage.broadcastChan <- msg:
+		return nil
+	case <-time.After(AdminReplyTimeout):
+		return errReplyTimeout
+	}
+}
+
+func (am *AdminManage) queryConns() ([]*ConnInfo, error) {
+	reply := make(chan []*ConnInfo, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.connManage.connQueryChan <- &ConnQueryMsg{Reply: reply}:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case connInfos := <-reply:
+		return connInfos, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
+
+func (am *AdminManage) queryUsers() ([]*UserInfo, error) {
+	reply := make(chan []*UserInfo, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.userShards[0].userQueryChan <- &UserQueryMsg{Reply: reply}:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case userInfos := <-reply:
+		return userInfos, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
+
+func (am *AdminManage) queryRooms() ([]*RoomInfo, error) {
+	reply := make(chan []*RoomInfo, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.roomShards[0].roomQueryChan <- &RoomQueryMsg{Reply: reply}:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case roomInfos := <-reply:
+		return roomInfos, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
+
+func (am *AdminManage) queryHistory(roomID int) ([]*ChatMsg, error) {
+	reply := make(chan []*ChatMsg, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.roomShard(roomID).roomHistoryChan <- &RoomHistoryMsg{RoomID: roomID, Reply: reply}:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case chatMsg := <-reply:
+		return chatMsg, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
+
+func (am *AdminManage) searchRoom(roomID int, query *SearchQuery) ([]*ChatMsg, error) {
+	reply := make(chan []*ChatMsg, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.roomShard(roomID).roomSearchChan <- &RoomSearchMsg{RoomID: roomID, Query: query, Reply: reply}:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case chatMsg := <-reply:
+		return chatMsg, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
+
+func (am *AdminManage) kickConn(connID int) (bool, error) {
+	reply := make(chan bool, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.connManage.connKickChan <- &ConnKickMsg{ConnID: connID, Reply: reply}:
+	case <-timer.C:
+		return false, errReplyTimeout
+	}
+	select {
+	case kicked := <-reply:
+		return kicked, nil
+	case <-timer.C:
+		return false, errReplyTimeout
+	}
+}
+
+func onlineConnNames(userInfos []*UserInfo) map[int]string {
+	connNames := make(map[int]string)
+	for _, userInfo := range userInfos {
+		if userInfo.Status != StatusOnline {
+			continue
+		}
+		for _, connID := range userInfo.ConnIDs {
+			connNames[connID] = userInfo.Name
+		}
+	}
+	return connNames
+}
+
+func containsConnID(connIDs []int, connID int) bool {
+	for _, id := range connIDs {
+		if id == connID {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIDPath 解析 prefix/{id}/{action} 格式的路径
+func parseIDPath(path string, prefix string) (int, string, bool) {
+	pathArr := strings.Split(strings.Trim(strings.TrimPrefix(path, prefix), "/"), "/")
+	if len(pathArr) != 2 {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(pathArr[0])
+	if err != nil {
+		return 0, "", false
+	}
+	return id, pathArr[1], true
+}
+
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, &adminErrResp{Error: "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin write resp err %s", err.Error())
+	}
+}
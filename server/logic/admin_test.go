@@ -0,0 +1,157 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startAdminService(t *testing.T) *Service {
+	s := &Service{Config: &Config{
+		ListenAddr: "127.0.0.1:0",
+		AdminAddr:  "127.0.0.1:0",
+		AdminToken: "secret",
+	}}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func adminDo(t *testing.T, s *Service, method string, path string, token string, v interface{}) int {
+	req, err := http.NewRequest(method, "http://"+s.AdminAddr()+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin_auth(t *testing.T) {
+	s := startAdminService(t)
+	if code := adminDo(t, s, http.MethodGet, "/admin/rooms", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong token code = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	roomInfos := make([]*RoomInfo, 0)
+	if code := adminDo(t, s, http.MethodGet, "/admin/rooms", "secret", &roomInfos); code != http.StatusOK {
+		t.Fatalf("rooms code = %d", code)
+	}
+	if len(roomInfos) != RoomNum {
+		t.Errorf("rooms = %d, want %d", len(roomInfos), RoomNum)
+	}
+}
+
+func TestAdmin_connsAndKick(t *testing.T) {
+	s := startAdminService(t)
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("/name alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待登录处理完成
+	var connInfos []*ConnInfo
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		adminDo(t, s, http.MethodGet, "/admin/conns", "secret", &connInfos)
+		if len(connInfos) == 1 && connInfos[0].UserName == "alice" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(connInfos) != 1 || connInfos[0].UserName != "alice" {
+		t.Fatalf("conns = %v, want alice", connInfos)
+	}
+
+	path := "/admin/conns/" + strconv.Itoa(connInfos[0].ConnID) + "/kick"
+	if code := adminDo(t, s, http.MethodPost, path, "secret", nil); code != http.StatusOK {
+		t.Fatalf("kick code = %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			break
+		}
+	}
+	if code := adminDo(t, s, http.MethodPost, "/admin/conns/999/kick", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("kick unknown code = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestHarness_adminKickMultiConn(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	alice2 := h.login("alice")
+	bob := h.login("bob")
+	alice.joinRoom(1)
+	alice2.expectContent(JoinRoomSuccess)
+	bob.joinRoom(1)
+
+	// aliceConns 等到alice剩下num个连接
+	aliceConns := func(num int) []int {
+		t.Helper()
+		deadline := time.Now().Add(testExpectTimeout)
+		for {
+			userInfos, err := h.s.adminManage.queryUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, userInfo := range userInfos {
+				if userInfo.Name == "alice" && len(userInfo.ConnIDs) == num {
+					return userInfo.ConnIDs
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("alice conns != %d", num)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	kick := func(connID int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin/conns/"+strconv.Itoa(connID)+"/kick", nil)
+		h.s.adminManage.connHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("kick %d code = %d", connID, w.Code)
+		}
+	}
+
+	// 踢掉一个连接，另一个还在房间里，不通知。
+	// 通知和公告走同一条路，收到后面的公告说明没有通知
+	connIDs := aliceConns(2)
+	kick(connIDs[0])
+	if err := h.s.adminManage.broadcast(&BroadcastMsg{RoomIDs: []int{1}, Type: MsgTypeAnnounce, Content: "after first kick"}); err != nil {
+		t.Fatal(err)
+	}
+	kicked := fmt.Sprintf(UserKicked, "alice")
+	bob.expect("announce", func(baseMsg *BaseMsg) bool {
+		if baseMsg.Content == kicked {
+			t.Errorf("%s with another conn still in the room", kicked)
+		}
+		return baseMsg.Type == MsgTypeAnnounce
+	})
+
+	// 最后一个连接被踢才通知
+	kick(aliceConns(1)[0])
+	bob.expectContent(kicked)
+}
@@ -0,0 +1,478 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backplane 多个节点之间的消息总线，房间消息、进出通知、私聊、在线状态、封禁和名字认领经过它同步。
+// 收到的消息包括自己发的，由调用方过滤
+type Backplane interface {
+	Publish(channel string, payload []byte) error
+	// Subscribe 返回的通道在cancel后或者连接断开时关闭，断开后BackplaneManage会重新订阅
+	Subscribe(channel string) (<-chan []byte, func(), error)
+}
+
+// 节点之间同步的事件
+const (
+	backplaneRoomMsg    = "room.msg"     // 房间聊天消息，对方也存进历史
+	backplaneRoomPush   = "room.push"    // 只推送不存的房间通知，进出房间、改昵称、正在输入等
+	backplaneRoomUpdate = "room.update"  // 房间消息编辑、删除或回应后的样子，对方覆盖历史里的再推送
+	backplaneDirect     = "direct"       // 私聊，对方在那个节点在线才投递
+	backplanePresence   = "presence"     // 用户在这个节点上线或下线
+	backplaneSync       = "sync"         // 节点启动，其他节点重发在线状态、名字和封禁
+	backplaneBan        = "room.ban"     // 房间封禁，每个节点都不让进、不让看、不让发
+	backplaneUnban      = "room.unban"   // 解封
+	backplaneNameClaim  = "name.claim"   // 登录名或昵称被占用，Owner是登录名
+	backplaneNameFree   = "name.release" // 换掉的昵称放出来
+)
+
+type backplaneEvent struct {
+	Node int
+	Kind string
+
+	Chat     *ChatMsg `json:",omitempty"`
+	Msg      *BaseMsg `json:",omitempty"`
+	Mentions []string `json:",omitempty"`
+
+	Name   string `json:",omitempty"`
+	Online bool   `json:",omitempty"`
+	RoomID int    `json:",omitempty"`
+	Owner  string `json:",omitempty"`
+}
+
+// BackplaneManage 把本节点的事件发到总线上，收到别的节点的事件交给房间和用户管理
+type BackplaneManage struct {
+	s *Service
+
+	backplane Backplane
+	lock      sync.Mutex // 重新订阅时换掉subChan和cancel
+	subChan   <-chan []byte
+	cancel    func()
+
+	publishChan chan *backplaneEvent
+
+	wg        sync.WaitGroup
+	closeChan chan bool
+}
+
+func (bm *BackplaneManage) init(s *Service) {
+	bm.s = s
+	bm.backplane = s.Backplane
+	bm.publishChan = make(chan *backplaneEvent, 1024)
+	bm.closeChan = make(chan bool, 1)
+}
+
+// Start 先订阅，收到的消息等listen之后再处理
+func (bm *BackplaneManage) Start(s *Service) {
+	bm.init(s)
+	if bm.backplane == nil {
+		return
+	}
+
+	subChan, cancel, err := bm.backplane.Subscribe(s.Config.BackplaneChannel)
+	if err != nil {
+		log.Printf("backplane subscribe err %s, run as single node", err.Error())
+		bm.backplane = nil
+		return
+	}
+	bm.subChan = subChan
+	bm.cancel = cancel
+
+	bm.wg.Add(1)
+	go bm.publishLogic()
+}
+
+// listen 其他管理器都启动后再开始处理收到的事件
+func (bm *BackplaneManage) listen() {
+	if bm.backplane == nil {
+		return
+	}
+	bm.wg.Add(1)
+	go bm.receiveLogic()
+
+	// 让其他节点把在线的用户再发一遍
+	bm.publish(&backplaneEvent{Kind: backplaneSync})
+}
+
+func (bm *BackplaneManage) Stop() {
+	close(bm.closeChan)
+	bm.lock.Lock()
+	if bm.cancel != nil {
+		bm.cancel()
+	}
+	bm.lock.Unlock()
+	bm.wg.Wait()
+}
+
+// publish 其他管理器调用，单节点时忽略
+func (bm *BackplaneManage) publish(event *backplaneEvent) {
+	if bm == nil || bm.backplane == nil {
+		return
+	}
+	event.Node = bm.s.Config.NodeID
+	select {
+	case bm.publishChan <- event:
+	case <-bm.closeChan:
+	}
+}
+
+// publishLogic 发送和接收分开，两个节点互相发满时不会卡住
+func (bm *BackplaneManage) publishLogic() {
+	defer bm.wg.Done()
+	for {
+		select {
+		case event := <-bm.publishChan:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("backplane marshal %s err %s", event.Kind, err.Error())
+				continue
+			}
+			if err := bm.backplane.Publish(bm.s.Config.BackplaneChannel, payload); err != nil {
+				log.Printf("backplane publish %s err %s", event.Kind, err.Error())
+			}
+		case <-bm.closeChan:
+			return
+		}
+	}
+}
+
+// validate 别的节点发来的事件先检查，分发时不用再判断空指针和房间ID
+func (event *backplaneEvent) validate() error {
+	switch event.Kind {
+	case backplaneRoomMsg:
+		if event.Chat == nil {
+			return errors.New("no chat")
+		}
+		if event.Chat.RoomID < 0 || event.Chat.RoomID > RoomNum-1 {
+			return fmt.Errorf("bad room %d", event.Chat.RoomID)
+		}
+		if event.Chat.MsgID <= 0 || event.Chat.MsgID%MsgIDRoomBase != int64(event.Chat.RoomID) {
+			return fmt.Errorf("bad msg id %d", event.Chat.MsgID)
+		}
+	case backplaneRoomPush:
+		if event.Msg == nil {
+			return errors.New("no msg")
+		}
+		if event.Msg.RoomID < 0 || event.Msg.RoomID > RoomNum-1 {
+			return fmt.Errorf("bad room %d", event.Msg.RoomID)
+		}
+	case backplaneRoomUpdate:
+		if event.Chat == nil || event.Msg == nil {
+			return errors.New("no chat or msg")
+		}
+		if event.Chat.RoomID < 0 || event.Chat.RoomID > RoomNum-1 || event.Msg.RoomID != event.Chat.RoomID {
+			return fmt.Errorf("bad room %d", event.Chat.RoomID)
+		}
+		if event.Chat.MsgID%MsgIDRoomBase != int64(event.Chat.RoomID) {
+			return fmt.Errorf("bad msg id %d", event.Chat.MsgID)
+		}
+	case backplaneDirect:
+		if event.Msg == nil {
+			return errors.New("no msg")
+		}
+		if event.Msg.ToUser == "" {
+			return errors.New("no receiver")
+		}
+	case backplanePresence:
+		if event.Name == "" {
+			return errors.New("no name")
+		}
+	case backplaneBan, backplaneUnban:
+		if event.Name == "" {
+			return errors.New("no name")
+		}
+		if event.RoomID < 0 || event.RoomID > RoomNum-1 {
+			return fmt.Errorf("bad room %d", event.RoomID)
+		}
+	case backplaneNameClaim, backplaneNameFree:
+		if event.Name == "" || event.Owner == "" {
+			return errors.New("no name or owner")
+		}
+	case backplaneSync:
+	default:
+		return errors.New("unknown kind")
+	}
+	return nil
+}
+
+// resubscribe 订阅断开后退避重试，订阅上以后让其他节点重发在线状态，断开期间漏掉的上下线补回来。
+// 停止时返回nil
+func (bm *BackplaneManage) resubscribe() <-chan []byte {
+	delay := bm.s.Config.BackplaneRetryBase
+	for {
+		select {
+		case <-bm.closeChan:
+			return nil
+		default:
+		}
+		if delay <= 0 {
+			delay = BackplaneRetryMin
+		}
+		select {
+		case <-time.After(delay):
+		case <-bm.closeChan:
+			return nil
+		}
+
+		subChan, cancel, err := bm.backplane.Subscribe(bm.s.Config.BackplaneChannel)
+		if err != nil {
+			log.Printf("backplane resubscribe err %s", err.Error())
+			delay *= 2
+			if delay > bm.s.Config.BackplaneRetryMax {
+				delay = bm.s.Config.BackplaneRetryMax
+			}
+			continue
+		}
+
+		// Stop已经取消过旧的订阅，新的自己取消
+		bm.lock.Lock()
+		select {
+		case <-bm.closeChan:
+			bm.lock.Unlock()
+			cancel()
+			return nil
+		default:
+		}
+		bm.subChan = subChan
+		bm.cancel = cancel
+		bm.lock.Unlock()
+
+		log.Printf("backplane resubscribed")
+		bm.publish(&backplaneEvent{Kind: backplaneSync})
+		return subChan
+	}
+}
+
+func (bm *BackplaneManage) receiveLogic() {
+	defer bm.wg.Done()
+	subChan := bm.subChan
+	for {
+		payload, ok := <-subChan
+		if !ok {
+			if subChan = bm.resubscribe(); subChan == nil {
+				return
+			}
+			continue
+		}
+
+		event := &backplaneEvent{}
+		if err := json.Unmarshal(payload, event); err != nil {
+			log.Printf("backplane unmarshal err %s", err.Error())
+			continue
+		}
+		if event.Node == bm.s.Config.NodeID {
+			continue
+		}
+		if err := event.validate(); err != nil {
+			log.Printf("backplane drop %s event from node %d: %s", event.Kind, event.Node, err.Error())
+			continue
+		}
+
+		switch event.Kind {
+		case backplaneRoomMsg:
+			bm.s.roomShard(event.Chat.RoomID).roomRemoteChan <- event
+		case backplaneRoomPush:
+			bm.s.roomShard(event.Msg.RoomID).roomRemoteChan <- event
+		case backplaneRoomUpdate:
+			bm.s.roomShard(event.Chat.RoomID).roomRemoteChan <- event
+		case backplaneDirect:
+			bm.s.userShard(event.Msg.ToUser).userRemoteChan <- event
+		case backplanePresence, backplaneBan, backplaneUnban:
+			bm.s.userShard(event.Name).userRemoteChan <- event
+		case backplaneNameClaim, backplaneNameFree:
+			bm.s.userShard(event.Owner).userRemoteChan <- event
+		case backplaneSync:
+			// 每个分片重发自己的在线用户
+			for _, userManage := range bm.s.userShards {
+				userManage.userRemoteChan <- event
+			}
+		}
+	}
+}
+
+// roomRemoteLogic 其他节点的房间消息，存下来推给本节点的成员，不再转发
+func (rm *RoomManage) roomRemoteLogic(event *backplaneEvent) {
+	switch event.Kind {
+	case backplaneRoomMsg:
+		chatMsg := event.Chat
+		room := rm.Rooms[chatMsg.RoomID]
+		if room == nil || room.findMsg(chatMsg.MsgID) != nil {
+			return
+		}
+		rm.s.observeMsgID(chatMsg.MsgID)
+		room.insertMsg(chatMsg)
+		room.indexMsg(chatMsg)
+		rm.pushToRoom(room, 0, chatMsg.toBaseMsg(MsgTypeChat))
+
+		rm.s.roomStored(&UserRoomStoredMsg{
+			RoomID:   room.RoomID,
+			Msg:      chatMsg.toBaseMsg(MsgTypeChat),
+			Mentions: event.Mentions,
+			Remote:   true,
+		})
+	case backplaneRoomPush:
+		room := rm.Rooms[event.Msg.RoomID]
+		if room == nil {
+			return
+		}
+		rm.pushToRoom(room, 0, event.Msg)
+	case backplaneRoomUpdate:
+		room := rm.Rooms[event.Chat.RoomID]
+		if room == nil {
+			return
+		}
+		cMsg := room.findMsg(event.Chat.MsgID)
+		if cMsg == nil {
+			return
+		}
+		room.updateMsg(cMsg, event.Chat)
+		rm.pushToRoom(room, 0, event.Msg)
+	}
+}
+
+// userRemoteLogic 其他节点的私聊、在线状态、封禁和名字认领
+func (um *UserManage) userRemoteLogic(event *backplaneEvent) {
+	switch event.Kind {
+	case backplaneDirect:
+		um.s.observeMsgID(event.Msg.MsgID)
+		user := um.users[event.Msg.ToUser]
+		if user == nil || user.Status != StatusOnline {
+			return
+		}
+		user.addDirect(event.Msg)
+		um.pushToUser(user, event.Msg)
+	case backplanePresence:
+		if event.Online {
+			if um.remoteNodes[event.Name] == nil {
+				um.remoteNodes[event.Name] = make(map[int]bool)
+			}
+			um.remoteNodes[event.Name][event.Node] = true
+			return
+		}
+		delete(um.remoteNodes[event.Name], event.Node)
+		if len(um.remoteNodes[event.Name]) == 0 {
+			delete(um.remoteNodes, event.Name)
+		}
+	case backplaneBan:
+		um.applyBan(event.RoomID, event.Name, true)
+	case backplaneUnban:
+		um.applyBan(event.RoomID, event.Name, false)
+	case backplaneNameClaim:
+		// 两个节点同时认领了同一个名字时两边各归各的，只记日志
+		if !um.s.userNames.claim(event.Name, event.Owner) {
+			log.Printf("backplane name %s claimed by %s on node %d conflicts", event.Name, event.Owner, event.Node)
+		}
+	case backplaneNameFree:
+		um.s.userNames.release(event.Name, event.Owner)
+	case backplaneSync:
+		// 对方可能是重启的，之前记的状态作废
+		for name, nodes := range um.remoteNodes {
+			delete(nodes, event.Node)
+			if len(nodes) == 0 {
+				delete(um.remoteNodes, name)
+			}
+		}
+		for _, user := range um.users {
+			if user.Status == StatusOnline {
+				um.publishPresence(user.Name, true)
+			}
+			um.publishName(user.Name, user.Name, true)
+			if user.DisplayName != "" {
+				um.publishName(user.DisplayName, user.Name, true)
+			}
+		}
+		for roomID, names := range um.roomBans {
+			for name := range names {
+				um.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneBan, RoomID: roomID, Name: name})
+			}
+		}
+	}
+}
+
+// publishName 登录名和昵称别的节点也不能再用
+func (um *UserManage) publishName(name string, owner string, claim bool) {
+	kind := backplaneNameClaim
+	if !claim {
+		kind = backplaneNameFree
+	}
+	um.s.backplaneManage.publish(&backplaneEvent{Kind: kind, Name: name, Owner: owner})
+}
+
+func (um *UserManage) publishPresence(name string, online bool) {
+	um.s.backplaneManage.publish(&backplaneEvent{Kind: backplanePresence, Name: name, Online: online})
+}
+
+// remoteOnline 用户在其他节点在线
+func (um *UserManage) remoteOnline(name string) bool {
+	return len(um.remoteNodes[name]) > 0
+}
+
+// observeMsgID 收到别的节点的消息后把序号追上，之后本节点的ID都比它大
+func (s *Service) observeMsgID(msgID int64) {
+	seq := msgID / MsgIDRoomBase / BackplaneMaxNode
+	for {
+		last := atomic.LoadInt64(&s.lastMsgID)
+		if last >= seq || atomic.CompareAndSwapInt64(&s.lastMsgID, last, seq) {
+			return
+		}
+	}
+}
+
+// MemoryBackplane 进程内的总线，同一个进程里跑多个节点时用
+type MemoryBackplane struct {
+	lock        sync.RWMutex
+	subscribers map[string]map[*memorySubscriber]bool
+}
+
+type memorySubscriber struct {
+	msgChan  chan []byte
+	doneChan chan bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subscribers: make(map[string]map[*memorySubscriber]bool)}
+}
+
+func (mb *MemoryBackplane) Publish(channel string, payload []byte) error {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	for sub := range mb.subscribers[channel] {
+		select {
+		case sub.msgChan <- payload:
+		case <-sub.doneChan:
+		}
+	}
+	return nil
+}
+
+func (mb *MemoryBackplane) Subscribe(channel string) (<-chan []byte, func(), error) {
+	sub := &memorySubscriber{
+		msgChan:  make(chan []byte, 1024),
+		doneChan: make(chan bool),
+	}
+	mb.lock.Lock()
+	if mb.subscribers[channel] == nil {
+		mb.subscribers[channel] = make(map[*memorySubscriber]bool)
+	}
+	mb.subscribers[channel][sub] = true
+	mb.lock.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			// 先让卡在发送上的Publish返回，再拿写锁
+			close(sub.doneChan)
+			mb.lock.Lock()
+			delete(mb.subscribers[channel], sub)
+			mb.lock.Unlock()
+			close(sub.msgChan)
+		})
+	}
+	return sub.msgChan, cancel, nil
+}
@@ -0,0 +1,224 @@
+package logic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBackplane 用Redis的PUBLISH/SUBSCRIBE做总线，只用到RESP协议里最基本的部分。
+// 发布共用一个连接，每个订阅单独一个连接
+type RedisBackplane struct {
+	addr string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func DialRedisBackplane(addr string) (*RedisBackplane, error) {
+	rb := &RedisBackplane{addr: addr}
+	if err := rb.connect(); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+func (rb *RedisBackplane) connect() error {
+	conn, err := net.DialTimeout("tcp", rb.addr, RedisDialTimeout)
+	if err != nil {
+		return err
+	}
+	rb.conn = conn
+	rb.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// Publish 连接断了重连一次
+func (rb *RedisBackplane) Publish(channel string, payload []byte) error {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	err := rb.publish(channel, payload)
+	if err == nil {
+		return nil
+	}
+	var redisErr redisError
+	if errors.As(err, &redisErr) {
+		return err
+	}
+	if rb.conn != nil {
+		rb.conn.Close()
+	}
+	if err := rb.connect(); err != nil {
+		rb.conn = nil
+		return err
+	}
+	return rb.publish(channel, payload)
+}
+
+func (rb *RedisBackplane) publish(channel string, payload []byte) error {
+	if rb.conn == nil {
+		return errors.New("redis not connected")
+	}
+	rb.conn.SetDeadline(time.Now().Add(RedisReplyTimeout))
+	if err := writeRESP(rb.conn, []byte("PUBLISH"), []byte(channel), payload); err != nil {
+		return err
+	}
+	_, err := readRESP(rb.reader)
+	return err
+}
+
+func (rb *RedisBackplane) Subscribe(channel string) (<-chan []byte, func(), error) {
+	conn, err := net.DialTimeout("tcp", rb.addr, RedisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(RedisReplyTimeout))
+	if err := writeRESP(conn, []byte("SUBSCRIBE"), []byte(channel)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if _, err := readRESP(reader); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	msgChan := make(chan []byte, 1024)
+	doneChan := make(chan bool)
+	go func() {
+		defer close(msgChan)
+		for {
+			reply, err := readRESP(reader)
+			if err != nil {
+				select {
+				case <-doneChan:
+				default:
+					log.Printf("redis subscribe %s err %s", channel, err.Error())
+				}
+				return
+			}
+			// 推送格式为 ["message", channel, payload]
+			items, ok := reply.([]interface{})
+			if !ok || len(items) != 3 {
+				continue
+			}
+			if kind, _ := items[0].([]byte); string(kind) != "message" {
+				continue
+			}
+			payload, ok := items[2].([]byte)
+			if !ok {
+				continue
+			}
+			select {
+			case msgChan <- payload:
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(doneChan)
+			conn.Close()
+		})
+	}
+	return msgChan, cancel, nil
+}
+
+func (rb *RedisBackplane) Close() error {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	if rb.conn == nil {
+		return nil
+	}
+	err := rb.conn.Close()
+	rb.conn = nil
+	return err
+}
+
+// redisError 服务端回复的-ERR，不是连接问题，不用重连
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// writeRESP 写一条命令，参数都按bulk string发
+func writeRESP(w io.Writer, args ...[]byte) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRESP 读一个回复：简单字符串是string，整数是int64，bulk string是[]byte，数组是[]interface{}
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis bad line %q", line)
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			item, err := readRESP(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis unknown reply %q", line)
+}
@@ -0,0 +1,363 @@
+package logic
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newNodeHarness 同一个进程里的一个节点，通过backplane和其他节点同步
+func newNodeHarness(t *testing.T, backplane Backplane, nodeID int) *testHarness {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	config.NodeID = nodeID
+
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &Service{Config: config, Clock: clock, Backplane: backplane}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return &testHarness{t: t, s: s, clock: clock}
+}
+
+// sendDirect 对方的在线状态是异步同步过来的，没收到前重试
+func sendDirect(t *testing.T, c *testClient, toUser string, content string) *BaseMsg {
+	t.Helper()
+	deadline := time.Now().Add(testExpectTimeout)
+	for time.Now().Before(deadline) {
+		c.send(Direct + " " + toUser + " " + content)
+		reply := c.expect("direct reply", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeDirect || baseMsg.Content == UserNotFound
+		})
+		if reply.Type == MsgTypeDirect {
+			return reply
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never saw %s online", c.name, toUser)
+	return nil
+}
+
+// waitNameTaken 名字认领是异步同步过来的，等到节点上的状态变成taken
+func waitNameTaken(t *testing.T, h *testHarness, name string, taken bool) {
+	t.Helper()
+	deadline := time.Now().Add(testExpectTimeout)
+	for h.s.userNames.taken(name) != taken {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d name %s taken should be %v", h.s.Config.NodeID, name, taken)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// joinRoomEventually 解封是异步同步过来的，还被封禁时重试
+func joinRoomEventually(t *testing.T, c *testClient, roomID int) {
+	t.Helper()
+	deadline := time.Now().Add(testExpectTimeout)
+	for time.Now().Before(deadline) {
+		c.send(fmt.Sprintf("%s %d", ChangeRoom, roomID))
+		reply := c.expect("join reply", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Content == JoinRoomSuccess || baseMsg.Content == RoomBanned
+		})
+		if reply.Content == JoinRoomSuccess {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never joined room %d", c.name, roomID)
+}
+
+func testTwoNodes(t *testing.T, newBackplane func() Backplane) {
+	nodeA := newNodeHarness(t, newBackplane(), 1)
+	alice := nodeA.login("alice")
+	alice.joinRoom(2)
+
+	// B后启动，通过sync拿到alice在线
+	nodeB := newNodeHarness(t, newBackplane(), 2)
+	bob := nodeB.login("bob")
+	bob.joinRoom(2)
+	alice.expect("bob join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "bob"
+	})
+
+	// 房间消息两边都推送、都存
+	first := alice.say("hello from a")
+	bob.expectChat("alice", "hello from a")
+	second := bob.say("hello from b")
+	alice.expectChat("bob", "hello from b")
+	if first.MsgID == second.MsgID || second.MsgID < first.MsgID {
+		t.Errorf("msg ids %d %d should be unique and ordered", first.MsgID, second.MsgID)
+	}
+	for _, c := range []*testClient{alice, bob} {
+		c.send(History + " 2")
+		history := c.expect("history", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeHistory
+		})
+		if history.MsgID != first.MsgID {
+			t.Errorf("%s first history msg = %+v", c.name, history)
+		}
+		c.expect("history", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeHistory && baseMsg.MsgID == second.MsgID
+		})
+	}
+
+	// 私聊按在线状态路由到对方节点
+	sendDirect(t, bob, "alice", "psst")
+	dm := alice.expect("direct", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDirect
+	})
+	if dm.UserName != "bob" || dm.Content != "psst" {
+		t.Errorf("direct = %+v", dm)
+	}
+	sendDirect(t, alice, "bob", "back")
+	bob.expect("direct", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDirect && baseMsg.UserName == "alice" && baseMsg.Content == "back"
+	})
+
+	// 编辑、回应、删除改的是两边存的历史
+	alice.send(fmt.Sprintf("%s %d hello again", Edit, first.MsgID))
+	bob.expect("edit", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeEdit && baseMsg.MsgID == first.MsgID && baseMsg.Content == "hello again"
+	})
+	bob.send(fmt.Sprintf("%s %d +1", React, first.MsgID))
+	alice.expect("reaction", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeReaction && baseMsg.UserName == "bob" && baseMsg.Content == "+1"
+	})
+	alice.send(fmt.Sprintf("%s %d", Delete, second.MsgID))
+	alice.expectContent(NoPermission)
+	bob.send(fmt.Sprintf("%s %d", Delete, second.MsgID))
+	alice.expect("delete", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDelete && baseMsg.MsgID == second.MsgID
+	})
+	bob.send(History + " 2")
+	history := bob.expect("history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory
+	})
+	if history.Content != "hello again" || len(history.Reactions) != 1 || history.Reactions[0].Emoji != "+1" {
+		t.Errorf("bob history after edit = %+v", history)
+	}
+	alice.send(History + " 2")
+	alice.expect("history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory
+	})
+	alice.expect("deleted history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory && baseMsg.MsgID == second.MsgID && baseMsg.Deleted
+	})
+
+	// 登录名在别的节点也占着，不区分大小写
+	waitNameTaken(t, nodeB, "alice", true)
+	other := nodeB.dial()
+	other.send(Name + " ALICE")
+	other.expectContent(NameRepeat)
+
+	// 改昵称和正在输入也推给对方节点，昵称别的节点也不能用
+	alice.send(Nick + " Alicia")
+	bob.expectContent(fmt.Sprintf(UserRename, "alice", "Alicia"))
+	waitNameTaken(t, nodeB, "alicia", true)
+	bob.send(Nick + " alicia")
+	bob.expectContent(NameRepeat)
+	bob.send(Typing)
+	alice.expect("typing", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeTyping && baseMsg.UserName == "bob"
+	})
+
+	// 离开也同步
+	bob.joinRoom(3)
+	alice.expect("bob leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "bob"
+	})
+
+	// 在A节点封禁，B节点上的bob被踢出房间，也进不去；解封后又能进
+	bob.joinRoom(2)
+	alice.expect("bob join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "bob"
+	})
+	banRemote := func(ban bool) {
+		reply := make(chan bool, 1)
+		nodeA.s.userShard("bob").userBanChan <- &UserBanMsg{RoomID: 2, Name: "bob", Ban: ban, Reply: reply}
+		<-reply
+	}
+	banRemote(true)
+	bob.expectContent(RoomBanned)
+	bob.send(fmt.Sprintf("%s %d", ChangeRoom, 2))
+	bob.expectContent(RoomBanned)
+	bob.send(History + " 2")
+	bob.expectContent(RoomBanned)
+	banRemote(false)
+	joinRoomEventually(t, bob, 2)
+
+	// 换掉的昵称两边都放出来
+	alice.send(Nick + " Ali")
+	bob.expectContent(fmt.Sprintf(UserRename, "Alicia", "Ali"))
+	waitNameTaken(t, nodeB, "alicia", false)
+	bob.send(Nick + " Alicia")
+	bob.expectContent(NickSuccess)
+}
+
+func TestBackplaneEvent_validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *backplaneEvent
+		valid bool
+	}{
+		{"room_msg", &backplaneEvent{Kind: backplaneRoomMsg, Chat: &ChatMsg{MsgID: 5*MsgIDRoomBase + 2, RoomID: 2}}, true},
+		{"room_msg_no_chat", &backplaneEvent{Kind: backplaneRoomMsg}, false},
+		{"room_msg_bad_room", &backplaneEvent{Kind: backplaneRoomMsg, Chat: &ChatMsg{MsgID: 5*MsgIDRoomBase + 2, RoomID: RoomNum}}, false},
+		{"room_msg_id_other_room", &backplaneEvent{Kind: backplaneRoomMsg, Chat: &ChatMsg{MsgID: 5*MsgIDRoomBase + 3, RoomID: 2}}, false},
+		{"room_push", &backplaneEvent{Kind: backplaneRoomPush, Msg: &BaseMsg{RoomID: 0}}, true},
+		{"room_push_no_msg", &backplaneEvent{Kind: backplaneRoomPush}, false},
+		{"room_push_negative_room", &backplaneEvent{Kind: backplaneRoomPush, Msg: &BaseMsg{RoomID: -1}}, false},
+		{"direct", &backplaneEvent{Kind: backplaneDirect, Msg: &BaseMsg{ToUser: "bob"}}, true},
+		{"direct_no_msg", &backplaneEvent{Kind: backplaneDirect}, false},
+		{"direct_no_receiver", &backplaneEvent{Kind: backplaneDirect, Msg: &BaseMsg{}}, false},
+		{"presence", &backplaneEvent{Kind: backplanePresence, Name: "alice"}, true},
+		{"presence_no_name", &backplaneEvent{Kind: backplanePresence}, false},
+		{"ban", &backplaneEvent{Kind: backplaneBan, RoomID: 2, Name: "bob"}, true},
+		{"unban_no_name", &backplaneEvent{Kind: backplaneUnban, RoomID: 2}, false},
+		{"ban_bad_room", &backplaneEvent{Kind: backplaneBan, RoomID: RoomNum, Name: "bob"}, false},
+		{"name_claim", &backplaneEvent{Kind: backplaneNameClaim, Name: "Alicia", Owner: "alice"}, true},
+		{"name_release_no_owner", &backplaneEvent{Kind: backplaneNameFree, Name: "Alicia"}, false},
+		{"sync", &backplaneEvent{Kind: backplaneSync}, true},
+		{"unknown", &backplaneEvent{Kind: "room.nuke"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.event.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestBackplane_memoryNodes(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	testTwoNodes(t, func() Backplane { return backplane })
+}
+
+func TestBackplane_redisNodes(t *testing.T) {
+	fr := startFakeRedis(t)
+	testTwoNodes(t, func() Backplane {
+		return dialFakeRedis(t, fr)
+	})
+}
+
+func TestBackplane_redisResubscribe(t *testing.T) {
+	fr := startFakeRedis(t)
+	nodeA := newNodeHarness(t, dialFakeRedis(t, fr), 1)
+	nodeB := newNodeHarness(t, dialFakeRedis(t, fr), 2)
+	alice := nodeA.login("alice")
+	alice.joinRoom(2)
+	bob := nodeB.login("bob")
+	bob.joinRoom(2)
+	alice.expect("bob join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "bob"
+	})
+
+	// Redis断开订阅连接，断开期间carol在A上线，B收不到
+	fr.dropSubscribers()
+	carol := nodeA.login("carol")
+
+	// B重新订阅后发sync，A重发在线状态，B能私聊到carol
+	sendDirect(t, bob, "carol", "you there?")
+	carol.expect("direct", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDirect && baseMsg.UserName == "bob"
+	})
+	alice.say("still here")
+	bob.expectChat("alice", "still here")
+}
+
+func dialFakeRedis(t *testing.T, fr *fakeRedis) Backplane {
+	backplane, err := DialRedisBackplane(fr.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backplane.Close() })
+	return backplane
+}
+
+// fakeRedis 只实现PUBLISH和SUBSCRIBE，在本地回环上跑
+type fakeRedis struct {
+	addr        string
+	lock        sync.Mutex
+	conns       []net.Conn
+	subscribers map[string][]net.Conn
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &fakeRedis{addr: listener.Addr().String(), subscribers: make(map[string][]net.Conn)}
+	t.Cleanup(func() {
+		listener.Close()
+		fr.lock.Lock()
+		defer fr.lock.Unlock()
+		for _, conn := range fr.conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fr.lock.Lock()
+			fr.conns = append(fr.conns, conn)
+			fr.lock.Unlock()
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+// dropSubscribers 断开所有订阅连接，模拟Redis重启
+func (fr *fakeRedis) dropSubscribers() {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	for channel, subscribers := range fr.subscribers {
+		for _, conn := range subscribers {
+			conn.Close()
+		}
+		delete(fr.subscribers, channel)
+	}
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		command, _ := args[0].([]byte)
+		switch strings.ToUpper(string(command)) {
+		case "SUBSCRIBE":
+			channel := args[1].([]byte)
+			fr.lock.Lock()
+			fr.subscribers[string(channel)] = append(fr.subscribers[string(channel)], conn)
+			conn.Write([]byte(fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)))
+			fr.lock.Unlock()
+		case "PUBLISH":
+			channel, payload := args[1].([]byte), args[2].([]byte)
+			fr.lock.Lock()
+			subscribers := fr.subscribers[string(channel)]
+			for _, sub := range subscribers {
+				writeRESP(sub, []byte("message"), channel, payload)
+			}
+			fr.lock.Unlock()
+			conn.Write([]byte(fmt.Sprintf(":%d\r\n", len(subscribers))))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
@@ -1,13 +1,34 @@
 package logic
 
+import "time"
+
 type ConnMsg struct {
 	ConnID  int
 	Content string
 }
 
 type BaseMsg struct {
+	Type     int
+	MsgID    int64
+	MsgTime  int64
 	UserName string
+	RoomID   int
 	Content  string
+	EditTime int64 // 最后编辑时间，为0没编辑过
+	Deleted  bool
+
+	ParentID  int64       // 回复的消息ID
+	Reactions []*Reaction // 表情回应
+
+	ToUser string // 私聊的接收人
+
+	ExpireTime int64 // 输入提示的过期时间
+
+	DisplayName string // 发送人的昵称
+
+	Annotations map[string]string `json:",omitempty"` // 中间件加的标注
+
+	Integration string `json:",omitempty"` // 通过HTTP接口发的消息，为集成的名字
 }
 
 type PushMsg struct {
@@ -27,12 +48,20 @@ type ConnChanMsg struct {
 type UserStatsMsg struct {
 	ConnID int
 	Name   string
+	Loc    *time.Location // 查询人的时区，查询人所在的分片填上
 }
 
 type UserLogoutMsg struct {
 	ConnID int
 }
 
+// ConnLoginMsg 通知消息管理连接登录或登出，UserName为空是登出
+type ConnLoginMsg struct {
+	ConnID   int
+	UserName string
+	Err      string // 登录失败时回复的内容
+}
+
 type UserNameMsg struct {
 	ConnID int
 	Name   string
@@ -44,29 +73,248 @@ type UserRoomMsg struct {
 }
 
 type UserSendMsg struct {
-	ConnID  int
-	Content string
+	ConnID   int
+	Content  string
+	ParentID int64
 }
 
 type RoomChangeMsg struct {
-	OldRoomID int
-	NewRoomID int
-	ConnID    int
+	OldRoomID   int
+	NewRoomID   int
+	ConnID      int
+	UserName    string
+	DisplayName string
+	Seq         int64 // 连接最近一次换房间的序号，转发晚到的旧加入直接丢掉
 }
 
 type RoomReceiveMsg struct {
+	ConnID      int
+	UserName    string
+	DisplayName string
+	RoomID      int
+	Content     string
+	ParentID    int64
+	Mentions    []string
+	Annotations map[string]string
+	Integration string
+
+	Reply chan *PostResult // HTTP接口发的消息，保存后回复
+}
+
+// UserPostMsg 集成通过HTTP接口往房间发消息，不需要连接
+type UserPostMsg struct {
+	RoomID      int
+	UserName    string
+	Integration string
+	Content     string
+	Reply       chan *PostResult
+}
+
+type PostResult struct {
+	Msg *BaseMsg
+	Err string // 被拒绝时的Notify内容
+}
+
+type RoomLogoutMsg struct {
 	ConnID   int
+	RoomID   int
 	UserName string
+}
+
+type RoomWhoMsg struct {
+	ConnID int
+	RoomID int // 小于0表示查询自己所在的房间
+}
+
+type RoomListMsg struct {
+	ConnID   int
+	UserName string   // 不为空则带上未读数
+	Rooms    []string // 每个分片填上自己的房间
+}
+
+type RoomHistoryPageMsg struct {
+	ConnID   int
 	RoomID   int
-	Content  string
+	BeforeID int64 // 为0则从最新一条开始
+	Limit    int
 }
 
-type RoomLogoutMsg struct {
+type UserSearchMsg struct {
 	ConnID int
 	RoomID int
+	Query  *SearchQuery
+}
+
+type UserBanMsg struct {
+	RoomID int
+	Name   string
+	Ban    bool // false为解封
+	Reply  chan bool
+}
+
+type RoomSearchMsg struct {
+	ConnID int
+	RoomID int
+	Query  *SearchQuery
+	Reply  chan []*ChatMsg // 不为空则直接回复，不推送给连接
+}
+
+type UserEditMsg struct {
+	ConnID  int
+	MsgID   int64
+	Content string
+	Delete  bool
+}
+
+type RoomEditMsg struct {
+	ConnID      int
+	UserName    string
+	MsgID       int64
+	Content     string
+	Delete      bool
+	Annotations map[string]string // 编辑后的内容经过中间件加的标注
+}
+
+type UserReactMsg struct {
+	ConnID int
+	MsgID  int64
+	Emoji  string
+	Remove bool
+}
+
+type RoomReactMsg struct {
+	ConnID   int
+	UserName string
+	MsgID    int64
+	Emoji    string
+	Remove   bool
+}
+
+type UserDirectMsg struct {
+	ConnID  int
+	ToUser  string
+	Content string
+
+	FromUser    string // 发送人所在的分片填上，再转给收件人的分片
+	FromConnIDs []int  // 发送人的连接，也同步一份
+}
+
+type UserRoomStoredMsg struct {
+	RoomID   int
+	Msg      *BaseMsg
+	Mentions []string // 消息里@到的用户
+	Remote   bool     // 其他节点的消息，发送人不在本节点统计
+}
+
+type UserMentionsMsg struct {
+	ConnID int
+}
+
+type UserAckMsg struct {
+	ConnID int
+	MsgID  int64
+}
+
+type UserRoomsMsg struct {
+	ConnID int
+}
+
+type UserNickMsg struct {
+	ConnID int
+	Name   string
+}
+
+type UserProfileMsg struct {
+	ConnID int
+	Field  string
+	Value  string
+}
+
+type RoomRenameMsg struct {
+	ConnID      int
+	UserName    string
+	OldName     string
+	DisplayName string
+}
+
+type RoomTypingMsg struct {
+	ConnID int
+}
+
+type RoomAckMsg struct {
+	UserName string
+	MsgID    int64
+}
+
+type RoomOpMsg struct {
+	RoomID int
+	Name   string
+	Op     bool // false为取消
+	Reply  chan bool
+}
+
+type RoomNoticeMsg struct {
+	RoomID  int
+	Type    int
+	Content string
 }
 
 type RoomPopularMsg struct {
 	ConnID int
 	RoomID int
 }
+
+type ConnKickMsg struct {
+	ConnID int
+	Reply  chan bool
+}
+
+type ConnQueryMsg struct {
+	Reply chan []*ConnInfo
+}
+
+type ConnInfo struct {
+	ConnID      int    `json:"connID"`
+	UserName    string `json:"userName"`
+	RemoteAddr  string `json:"remoteAddr"`
+	ConnectTime int64  `json:"connectTime"`
+}
+
+type BroadcastMsg struct {
+	RoomIDs []int // 为空则推送给所有连接
+	Type    int
+	Content string
+}
+
+type UserQueryMsg struct {
+	Reply     chan []*UserInfo
+	UserInfos []*UserInfo // 每个分片加上自己的用户
+}
+
+type UserInfo struct {
+	UserID      int64  `json:"userID"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Status      int    `json:"status"`
+	RoomID      int    `json:"roomID"`
+	ConnIDs     []int  `json:"connIDs"`
+	LoginTime   int64  `json:"loginTime"`
+	LogoutTime  int64  `json:"logoutTime"`
+	OnlineTime  int64  `json:"onlineTime"`
+}
+
+type RoomQueryMsg struct {
+	Reply     chan []*RoomInfo
+	RoomInfos []*RoomInfo // 每个分片加上自己的房间
+}
+
+type RoomInfo struct {
+	RoomID  int   `json:"roomID"`
+	Members []int `json:"members"`
+	MsgNum  int   `json:"msgNum"`
+}
+
+type RoomHistoryMsg struct {
+	RoomID int
+	Reply  chan []*ChatMsg
+}
@@ -0,0 +1,310 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 命令参数类型
+const (
+	ArgWord   = iota + 1 // 一个词
+	ArgInt               // 整数，消息ID也用它
+	ArgRoomID            // 房间号，不对时回复RoomIDErr
+	ArgText              // 剩下的全部内容，只能放在最后
+)
+
+// 命令权限
+const (
+	PermGuest    = iota // 不用登录
+	PermUser            // 登录后才能用
+	PermOperator        // 所在房间的管理员
+)
+
+// ArgSpec 一个参数的声明
+type ArgSpec struct {
+	Name     string
+	Type     int
+	Optional bool // 可选参数只能放在必填参数后面
+}
+
+// CommandFunc 处理一条命令，在消息管理协程里执行，不能阻塞
+type CommandFunc func(ctx *CommandCtx)
+
+// Command 一个斜杠命令
+type Command struct {
+	Name    string // 带斜杠，比如/history
+	Args    []ArgSpec
+	Perm    int
+	Help    string
+	ArgErr  string // 参数不对时回复的通知，为空回复CommandArgErr
+	Handler CommandFunc
+}
+
+// Usage 命令格式，比如/history <roomID> [beforeID] [limit]
+func (cmd *Command) Usage() string {
+	usage := cmd.Name
+	for _, arg := range cmd.Args {
+		name := arg.Name
+		if arg.Type == ArgText {
+			name += "..."
+		}
+		if arg.Optional {
+			usage += " [" + name + "]"
+		} else {
+			usage += " <" + name + ">"
+		}
+	}
+	return usage
+}
+
+// CommandArgs 按声明解析好的参数
+type CommandArgs struct {
+	values map[string]string
+	ints   map[string]int64
+}
+
+// Has 可选参数有没有传
+func (a *CommandArgs) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a *CommandArgs) String(name string) string {
+	return a.values[name]
+}
+
+func (a *CommandArgs) Int(name string) int {
+	return int(a.ints[name])
+}
+
+func (a *CommandArgs) Int64(name string) int64 {
+	return a.ints[name]
+}
+
+// CommandCtx 一次命令调用
+type CommandCtx struct {
+	s   *Service
+	cmd *Command
+
+	ConnID   int
+	UserName string // 未登录为空
+	RoomID   int    // 管理员命令所在的房间，其余命令为-1
+	Content  string // 整行内容
+	Args     *CommandArgs
+}
+
+// Reply 回复给发命令的连接一条系统消息
+func (ctx *CommandCtx) Reply(content string) {
+	ctx.Push(&BaseMsg{
+		Type:    MsgTypeSystem,
+		Content: content,
+	})
+}
+
+// Push 推送消息给发命令的连接
+func (ctx *CommandCtx) Push(baseMsg ...*BaseMsg) {
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, ctx.ConnID)
+	ctx.s.msgManage.pushMsgChan <- &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: baseMsg,
+	}
+}
+
+// commandRegistry 命令表，Start之后只读
+type commandRegistry struct {
+	commands map[string]*Command
+}
+
+func newCommandRegistry() *commandRegistry {
+	cr := &commandRegistry{
+		commands: make(map[string]*Command),
+	}
+	for _, cmd := range builtinCommands() {
+		if err := cr.register(cmd); err != nil {
+			panic(err)
+		}
+	}
+	return cr
+}
+
+func (cr *commandRegistry) register(cmd *Command) error {
+	if !strings.HasPrefix(cmd.Name, "/") || len(cmd.Name) < 2 || strings.Contains(cmd.Name, " ") {
+		return fmt.Errorf("command name %q must be /word", cmd.Name)
+	}
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s has no handler", cmd.Name)
+	}
+	if _, ok := cr.commands[cmd.Name]; ok {
+		return fmt.Errorf("command %s already registered", cmd.Name)
+	}
+	optional := false
+	for i, arg := range cmd.Args {
+		if arg.Type == ArgText && i != len(cmd.Args)-1 {
+			return fmt.Errorf("command %s text arg %s must be last", cmd.Name, arg.Name)
+		}
+		if optional && !arg.Optional {
+			return fmt.Errorf("command %s required arg %s after optional", cmd.Name, arg.Name)
+		}
+		optional = arg.Optional
+	}
+	cr.commands[cmd.Name] = cmd
+	return nil
+}
+
+func (cr *commandRegistry) list() []*Command {
+	cmdList := make([]*Command, 0, len(cr.commands))
+	for _, cmd := range cr.commands {
+		cmdList = append(cmdList, cmd)
+	}
+	sort.Slice(cmdList, func(i, j int) bool {
+		return cmdList[i].Name < cmdList[j].Name
+	})
+	return cmdList
+}
+
+// parseArgs 按空格切分，和客户端约定一个空格分隔。解析失败返回要回复的通知
+func (cmd *Command) parseArgs(content string) (*CommandArgs, string) {
+	argErr := cmd.ArgErr
+	if argErr == "" {
+		argErr = fmt.Sprintf(CommandArgErr, cmd.Usage())
+	}
+
+	args := &CommandArgs{
+		values: make(map[string]string),
+		ints:   make(map[string]int64),
+	}
+	msgArr := strings.Split(content, " ")[1:]
+	// 末尾多打的空格不算参数
+	for len(msgArr) > 0 && msgArr[len(msgArr)-1] == "" {
+		msgArr = msgArr[:len(msgArr)-1]
+	}
+
+	for i, spec := range cmd.Args {
+		if i >= len(msgArr) {
+			if !spec.Optional {
+				return nil, argErr
+			}
+			break
+		}
+
+		value := msgArr[i]
+		if spec.Type == ArgText {
+			value = strings.Join(msgArr[i:], " ")
+			msgArr = msgArr[:i+1]
+		}
+		if value == "" {
+			return nil, argErr
+		}
+
+		switch spec.Type {
+		case ArgInt:
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, argErr
+			}
+			args.ints[spec.Name] = number
+		case ArgRoomID:
+			roomID, err := strconv.Atoi(value)
+			if err != nil || roomID < 0 || roomID > RoomNum-1 {
+				return nil, RoomIDErr
+			}
+			args.ints[spec.Name] = int64(roomID)
+		}
+		args.values[spec.Name] = value
+	}
+	if len(msgArr) > len(cmd.Args) {
+		return nil, argErr
+	}
+	return args, ""
+}
+
+// RegisterCommand 注册插件命令，要在Start之前调用，名字不能和已有的重复
+func (s *Service) RegisterCommand(cmd *Command) error {
+	return s.commandRegistry().register(cmd)
+}
+
+func (s *Service) commandRegistry() *commandRegistry {
+	if s.commands == nil {
+		s.commands = newCommandRegistry()
+	}
+	return s.commands
+}
+
+// commandLogic 以/开头的都是命令，不认识的也不会当成聊天发出去
+func (mm *MsgManage) commandLogic(msg *ConnMsg) {
+	name := strings.SplitN(msg.Content, " ", 2)[0]
+	cmd := mm.s.commands.commands[name]
+	if cmd == nil {
+		mm.sendToUserMsg(msg.ConnID, fmt.Sprintf(UnknownCommand, name))
+		return
+	}
+
+	userName := mm.connUsers[msg.ConnID]
+	if cmd.Perm != PermGuest && userName == "" {
+		mm.sendToUserMsg(msg.ConnID, NotLogin)
+		return
+	}
+
+	args, argErr := cmd.parseArgs(msg.Content)
+	if argErr != "" {
+		mm.sendToUserMsg(msg.ConnID, argErr)
+		return
+	}
+
+	ctx := &CommandCtx{
+		s:        mm.s,
+		cmd:      cmd,
+		ConnID:   msg.ConnID,
+		UserName: userName,
+		RoomID:   -1,
+		Content:  msg.Content,
+		Args:     args,
+	}
+	if cmd.Perm == PermOperator {
+		// 管理员在房间里，交给房间管理确认后再回来执行
+		mm.s.connRoomShard(ctx.ConnID).roomOperatorChan <- ctx
+		return
+	}
+	cmd.Handler(ctx)
+}
+
+// connLoginLogic 登录成功后记下连接对应的用户，再回复登录成功，
+// 保证客户端收到成功之后发的命令都能通过权限检查
+func (mm *MsgManage) connLoginLogic(msg *ConnLoginMsg) {
+	delete(mm.connLogins, msg.ConnID)
+	content := msg.Err
+	if content == "" {
+		if msg.UserName == "" {
+			delete(mm.connUsers, msg.ConnID)
+			return
+		}
+		mm.connUsers[msg.ConnID] = msg.UserName
+		content = LoginSuccess
+	}
+
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, msg.ConnID)
+	pushMsg := make([]*BaseMsg, 0)
+	pushMsg = append(pushMsg, &BaseMsg{
+		Type:    MsgTypeSystem,
+		Content: content,
+	})
+	mm.pushMsgToConn(&PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushMsg,
+	})
+}
+
+// roomOperatorLogic 确认是所在房间的管理员，交回消息管理执行
+func (rm *RoomManage) roomOperatorLogic(ctx *CommandCtx) {
+	room := rm.connRoom(ctx.ConnID)
+	if room == nil || !room.Operators[ctx.UserName] {
+		rm.sendSingleMsg(ctx.ConnID, NoPermission)
+		return
+	}
+	ctx.RoomID = room.RoomID
+	rm.s.msgManage.commandRunChan <- ctx
+}
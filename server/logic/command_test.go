@@ -0,0 +1,179 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand_parseArgs(t *testing.T) {
+	history := &Command{
+		Name: History,
+		Args: []ArgSpec{
+			{Name: "roomID", Type: ArgRoomID},
+			{Name: "beforeID", Type: ArgInt, Optional: true},
+			{Name: "limit", Type: ArgInt, Optional: true},
+		},
+		ArgErr: HistoryArgErr,
+	}
+	edit := &Command{
+		Name: Edit,
+		Args: []ArgSpec{
+			{Name: "msgID", Type: ArgInt},
+			{Name: "content", Type: ArgText},
+		},
+	}
+
+	cases := []struct {
+		cmd     *Command
+		content string
+		argErr  string
+		check   func(a *CommandArgs) bool
+	}{
+		{history, "/history 3", "", func(a *CommandArgs) bool { return a.Int("roomID") == 3 && !a.Has("beforeID") }},
+		{history, "/history 3 10 5 ", "", func(a *CommandArgs) bool { return a.Int64("beforeID") == 10 && a.Int("limit") == 5 }},
+		{history, "/history", HistoryArgErr, nil},
+		{history, "/history 99", RoomIDErr, nil},
+		{history, "/history 3 x", HistoryArgErr, nil},
+		{history, "/history 3 1 2 3", HistoryArgErr, nil},
+		{edit, "/edit 7 hello  world", "", func(a *CommandArgs) bool { return a.String("content") == "hello  world" }},
+		{edit, "/edit 7", fmt.Sprintf(CommandArgErr, "/edit <msgID> <content...>"), nil},
+	}
+	for _, c := range cases {
+		args, argErr := c.cmd.parseArgs(c.content)
+		if argErr != c.argErr {
+			t.Errorf("%q argErr = %q, want %q", c.content, argErr, c.argErr)
+			continue
+		}
+		if c.check != nil && !c.check(args) {
+			t.Errorf("%q args = %+v", c.content, args)
+		}
+	}
+}
+
+func TestCommand_register(t *testing.T) {
+	s := &Service{}
+	noop := func(ctx *CommandCtx) {}
+	bad := []*Command{
+		{Name: "ping", Handler: noop},
+		{Name: "/ping"},
+		{Name: Who, Handler: noop},
+		{Name: "/ping", Handler: noop, Args: []ArgSpec{{Name: "text", Type: ArgText}, {Name: "n", Type: ArgInt}}},
+		{Name: "/ping", Handler: noop, Args: []ArgSpec{{Name: "a", Type: ArgWord, Optional: true}, {Name: "b", Type: ArgWord}}},
+	}
+	for _, cmd := range bad {
+		if err := s.RegisterCommand(cmd); err == nil {
+			t.Errorf("register %+v should fail", cmd)
+		}
+	}
+	if err := s.RegisterCommand(&Command{Name: "/ping", Handler: noop}); err != nil {
+		t.Errorf("register /ping err %v", err)
+	}
+}
+
+func TestHarness_commands(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	guest := h.dial()
+	guest.send(Who)
+	guest.expectContent(NotLogin)
+	guest.send(Help)
+	help := guest.expect("guest help", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, Help)
+	})
+	if strings.Contains(help.Content, Who) || !strings.Contains(help.Content, Name+" <name>") {
+		t.Errorf("guest help:\n%s", help.Content)
+	}
+
+	alice := h.login("alice")
+	alice.joinRoom(1)
+	bob := h.login("bob")
+	bob.joinRoom(1)
+
+	alice.send(Help + " history")
+	alice.expectContent(History + " <roomID> [beforeID] [limit] - page through room history")
+
+	// 不认识的命令不会当成聊天
+	alice.send("/shrug")
+	alice.expectContent(fmt.Sprintf(UnknownCommand, "/shrug"))
+	alice.send(Stats)
+	alice.expectContent(fmt.Sprintf(CommandArgErr, Stats+" <name>"))
+
+	// /logout不带参数，带了不会登出别的名字，也不会发到房间
+	alice.send(Logout + " bob")
+	alice.expectContent(fmt.Sprintf(CommandArgErr, Logout))
+	alice.send(Logout)
+	bob.expect("alice leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "alice"
+	})
+	chatMsg := bob.say("after")
+	if chatMsg.Content != "after" {
+		t.Errorf("bob got %s:%s", chatMsg.UserName, chatMsg.Content)
+	}
+	alice.send(Who)
+	alice.expectContent(NotLogin)
+}
+
+func TestHarness_commandPlugin(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &Service{Config: config, Clock: clock}
+
+	err := s.RegisterCommand(&Command{
+		Name: "/roll",
+		Args: []ArgSpec{{Name: "sides", Type: ArgInt}},
+		Perm: PermUser,
+		Help: "roll a die",
+		Handler: func(ctx *CommandCtx) {
+			ctx.Reply(fmt.Sprintf("%s rolled %d", ctx.UserName, ctx.Args.Int("sides")))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterCommand(&Command{
+		Name: "/topic",
+		Args: []ArgSpec{{Name: "topic", Type: ArgText}},
+		Perm: PermOperator,
+		Help: "announce a topic",
+		Handler: func(ctx *CommandCtx) {
+			ctx.s.roomShard(ctx.RoomID).roomNoticeChan <- &RoomNoticeMsg{
+				RoomID:  ctx.RoomID,
+				Type:    MsgTypeAnnounce,
+				Content: "topic: " + ctx.Args.String("topic"),
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(s.Stop)
+	h := &testHarness{t: t, s: s, clock: clock}
+
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	alice.send("/roll 6")
+	alice.expectContent("alice rolled 6")
+
+	alice.send("/topic release today")
+	alice.expectContent(NoPermission)
+
+	reply := make(chan bool, 1)
+	s.roomShard(2).roomOpChan <- &RoomOpMsg{RoomID: 2, Name: "alice", Op: true, Reply: reply}
+	<-reply
+	alice.send("/topic release today")
+	alice.expect("topic", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeAnnounce && baseMsg.RoomID == 2 && baseMsg.Content == "topic: release today"
+	})
+
+	alice.send(Help)
+	alice.expect("help with plugins", func(baseMsg *BaseMsg) bool {
+		return strings.Contains(baseMsg.Content, "/roll <sides> - roll a die") &&
+			strings.Contains(baseMsg.Content, "/topic <topic...> - announce a topic")
+	})
+}
@@ -0,0 +1,419 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinCommands 内置命令，插件用Service.RegisterCommand加
+func builtinCommands() []*Command {
+	return []*Command{
+		{
+			Name:    Help,
+			Args:    []ArgSpec{{Name: "command", Type: ArgWord, Optional: true}},
+			Perm:    PermGuest,
+			Help:    "list commands or show one",
+			Handler: helpCommand,
+		},
+		{
+			Name:    Name,
+			Args:    []ArgSpec{{Name: "name", Type: ArgWord}},
+			Perm:    PermGuest,
+			Help:    "log in with a name",
+			ArgErr:  NameInvalid,
+			Handler: nameCommand,
+		},
+		{
+			Name:    Logout,
+			Perm:    PermUser,
+			Help:    "log out this connection",
+			Handler: logoutCommand,
+		},
+		{
+			Name:    ChangeRoom,
+			Args:    []ArgSpec{{Name: "roomID", Type: ArgRoomID}},
+			Perm:    PermUser,
+			Help:    "switch to a room",
+			ArgErr:  RoomIDErr,
+			Handler: changeRoomCommand,
+		},
+		{
+			Name:    Rooms,
+			Perm:    PermUser,
+			Help:    "list rooms with member and unread counts",
+			Handler: roomsCommand,
+		},
+		{
+			Name:    Who,
+			Args:    []ArgSpec{{Name: "roomID", Type: ArgRoomID, Optional: true}},
+			Perm:    PermUser,
+			Help:    "list members of a room, default your room",
+			ArgErr:  RoomIDErr,
+			Handler: whoCommand,
+		},
+		{
+			Name:    Stats,
+			Args:    []ArgSpec{{Name: "name", Type: ArgWord}},
+			Perm:    PermUser,
+			Help:    "show a user's activity",
+			Handler: statsCommand,
+		},
+		{
+			Name:    Popular,
+			Args:    []ArgSpec{{Name: "roomID", Type: ArgRoomID}},
+			Perm:    PermUser,
+			Help:    "most used word in a room in the last 10 minutes",
+			ArgErr:  RoomIDErr,
+			Handler: popularCommand,
+		},
+		{
+			Name: History,
+			Args: []ArgSpec{
+				{Name: "roomID", Type: ArgRoomID},
+				{Name: "beforeID", Type: ArgInt, Optional: true},
+				{Name: "limit", Type: ArgInt, Optional: true},
+			},
+			Perm:    PermUser,
+			Help:    "page through room history",
+			ArgErr:  HistoryArgErr,
+			Handler: historyCommand,
+		},
+		{
+			Name: Search,
+			Args: []ArgSpec{
+				{Name: "roomID", Type: ArgRoomID},
+				{Name: "query", Type: ArgText},
+			},
+			Perm:    PermUser,
+			Help:    "search room history, supports \"phrase\" from: since: until:",
+			ArgErr:  SearchArgErr,
+			Handler: searchCommand,
+		},
+		{
+			Name: Edit,
+			Args: []ArgSpec{
+				{Name: "msgID", Type: ArgInt},
+				{Name: "content", Type: ArgText},
+			},
+			Perm:    PermUser,
+			Help:    "edit your message",
+			ArgErr:  EditArgErr,
+			Handler: editCommand,
+		},
+		{
+			Name:    Delete,
+			Args:    []ArgSpec{{Name: "msgID", Type: ArgInt}},
+			Perm:    PermUser,
+			Help:    "delete your message",
+			ArgErr:  EditArgErr,
+			Handler: deleteCommand,
+		},
+		{
+			Name: Reply,
+			Args: []ArgSpec{
+				{Name: "msgID", Type: ArgInt},
+				{Name: "content", Type: ArgText},
+			},
+			Perm:    PermUser,
+			Help:    "reply to a message in a thread",
+			ArgErr:  ReplyArgErr,
+			Handler: replyCommand,
+		},
+		{
+			Name: React,
+			Args: []ArgSpec{
+				{Name: "msgID", Type: ArgInt},
+				{Name: "emoji", Type: ArgWord},
+			},
+			Perm:    PermUser,
+			Help:    "add a reaction",
+			ArgErr:  ReactArgErr,
+			Handler: reactCommand,
+		},
+		{
+			Name: Unreact,
+			Args: []ArgSpec{
+				{Name: "msgID", Type: ArgInt},
+				{Name: "emoji", Type: ArgWord},
+			},
+			Perm:    PermUser,
+			Help:    "remove a reaction",
+			ArgErr:  ReactArgErr,
+			Handler: reactCommand,
+		},
+		{
+			Name: Direct,
+			Args: []ArgSpec{
+				{Name: "name", Type: ArgWord},
+				{Name: "content", Type: ArgText},
+			},
+			Perm:    PermUser,
+			Help:    "send a direct message",
+			ArgErr:  DirectArgErr,
+			Handler: directCommand,
+		},
+		{
+			Name:    Mentions,
+			Perm:    PermUser,
+			Help:    "list recent mentions",
+			Handler: mentionsCommand,
+		},
+		{
+			Name:    Ack,
+			Args:    []ArgSpec{{Name: "msgID", Type: ArgInt}},
+			Perm:    PermUser,
+			Help:    "mark messages read up to msgID",
+			ArgErr:  AckArgErr,
+			Handler: ackCommand,
+		},
+		{
+			Name:    Typing,
+			Perm:    PermUser,
+			Help:    "tell your room you are typing",
+			Handler: typingCommand,
+		},
+		{
+			Name:    Nick,
+			Args:    []ArgSpec{{Name: "name", Type: ArgWord}},
+			Perm:    PermUser,
+			Help:    "set your display name",
+			ArgErr:  NameInvalid,
+			Handler: nickCommand,
+		},
+		{
+			Name: Profile,
+			Args: []ArgSpec{
+				{Name: "field", Type: ArgWord},
+				{Name: "value", Type: ArgText, Optional: true},
+			},
+			Perm:    PermUser,
+			Help:    "set status or tz, no value clears it",
+			ArgErr:  ProfileArgErr,
+			Handler: profileCommand,
+		},
+	}
+}
+
+// helpCommand 只列出当前连接能用的命令
+func helpCommand(ctx *CommandCtx) {
+	registry := ctx.s.commands
+	if ctx.Args.Has("command") {
+		name := ctx.Args.String("command")
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		cmd := registry.commands[name]
+		if cmd == nil {
+			ctx.Reply(fmt.Sprintf(UnknownCommand, name))
+			return
+		}
+		ctx.Reply(cmd.Usage() + " - " + cmd.Help)
+		return
+	}
+
+	lines := make([]string, 0, len(registry.commands))
+	for _, cmd := range registry.list() {
+		if cmd.Perm != PermGuest && ctx.UserName == "" {
+			continue
+		}
+		lines = append(lines, cmd.Usage()+" - "+cmd.Help)
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func nameCommand(ctx *CommandCtx) {
+	name := ctx.Args.String("name")
+	// 已登录的交给原来的分片回复已登录
+	shardName := name
+	if ctx.UserName != "" {
+		shardName = ctx.UserName
+	} else {
+		// 上一个/name还没有结果时不知道会登录到哪个分片，先拒绝。
+		// Guest命令在消息管理的协程里执行，可以直接改connLogins
+		mm := ctx.s.msgManage
+		if mm.connLogins[ctx.ConnID] {
+			ctx.Reply(LoginPending)
+			return
+		}
+		mm.connLogins[ctx.ConnID] = true
+	}
+	ctx.s.userShard(shardName).userNameMsgChan <- &UserNameMsg{
+		Name:   name,
+		ConnID: ctx.ConnID,
+	}
+}
+
+func logoutCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userLogoutMsgChan <- &UserLogoutMsg{
+		ConnID: ctx.ConnID,
+	}
+}
+
+func changeRoomCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userRoomMsgChan <- &UserRoomMsg{
+		RoomID: ctx.Args.Int("roomID"),
+		ConnID: ctx.ConnID,
+	}
+}
+
+func roomsCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userRoomsChan <- &UserRoomsMsg{
+		ConnID: ctx.ConnID,
+	}
+}
+
+func whoCommand(ctx *CommandCtx) {
+	roomID := -1
+	if ctx.Args.Has("roomID") {
+		roomID = ctx.Args.Int("roomID")
+	}
+	roomManage := ctx.s.roomShard(roomID)
+	if roomID < 0 {
+		roomManage = ctx.s.connRoomShard(ctx.ConnID)
+	}
+	roomManage.roomWhoChan <- &RoomWhoMsg{
+		ConnID: ctx.ConnID,
+		RoomID: roomID,
+	}
+}
+
+func statsCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userStatMsgChan <- &UserStatsMsg{
+		Name:   ctx.Args.String("name"),
+		ConnID: ctx.ConnID,
+	}
+}
+
+func popularCommand(ctx *CommandCtx) {
+	ctx.s.roomShard(ctx.Args.Int("roomID")).roomPopularChan <- &RoomPopularMsg{
+		RoomID: ctx.Args.Int("roomID"),
+		ConnID: ctx.ConnID,
+	}
+}
+
+func historyCommand(ctx *CommandCtx) {
+	historyMsg := &RoomHistoryPageMsg{
+		ConnID:   ctx.ConnID,
+		RoomID:   ctx.Args.Int("roomID"),
+		BeforeID: ctx.Args.Int64("beforeID"),
+		Limit:    HistoryDefaultLimit,
+	}
+	if historyMsg.BeforeID < 0 {
+		ctx.Reply(HistoryArgErr)
+		return
+	}
+	if ctx.Args.Has("limit") {
+		historyMsg.Limit = ctx.Args.Int("limit")
+		if historyMsg.Limit <= 0 {
+			ctx.Reply(HistoryArgErr)
+			return
+		}
+		if historyMsg.Limit > HistoryMaxLimit {
+			historyMsg.Limit = HistoryMaxLimit
+		}
+	}
+	ctx.s.userShard(ctx.UserName).userHistoryChan <- historyMsg
+}
+
+func searchCommand(ctx *CommandCtx) {
+	query, err := ParseSearchQuery(ctx.Args.String("query"), ctx.s.now())
+	if err != nil {
+		ctx.Reply(SearchArgErr)
+		return
+	}
+	ctx.s.userShard(ctx.UserName).userSearchChan <- &UserSearchMsg{
+		ConnID: ctx.ConnID,
+		RoomID: ctx.Args.Int("roomID"),
+		Query:  query,
+	}
+}
+
+func editCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userEditChan <- &UserEditMsg{
+		ConnID:  ctx.ConnID,
+		MsgID:   ctx.Args.Int64("msgID"),
+		Content: ctx.Args.String("content"),
+	}
+}
+
+func deleteCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userEditChan <- &UserEditMsg{
+		ConnID: ctx.ConnID,
+		MsgID:  ctx.Args.Int64("msgID"),
+		Delete: true,
+	}
+}
+
+func replyCommand(ctx *CommandCtx) {
+	parentID := ctx.Args.Int64("msgID")
+	if parentID <= 0 {
+		ctx.Reply(ReplyArgErr)
+		return
+	}
+	ctx.s.userShard(ctx.UserName).userSendMsgChan <- &UserSendMsg{
+		ConnID:   ctx.ConnID,
+		Content:  ctx.Args.String("content"),
+		ParentID: parentID,
+	}
+}
+
+func reactCommand(ctx *CommandCtx) {
+	emoji := ctx.Args.String("emoji")
+	if len(emoji) > MaxEmojiLen {
+		ctx.Reply(ReactArgErr)
+		return
+	}
+	ctx.s.userShard(ctx.UserName).userReactChan <- &UserReactMsg{
+		ConnID: ctx.ConnID,
+		MsgID:  ctx.Args.Int64("msgID"),
+		Emoji:  emoji,
+		Remove: ctx.cmd.Name == Unreact,
+	}
+}
+
+func directCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userDirectChan <- &UserDirectMsg{
+		ConnID:  ctx.ConnID,
+		ToUser:  ctx.Args.String("name"),
+		Content: ctx.Args.String("content"),
+	}
+}
+
+func mentionsCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userMentionsChan <- &UserMentionsMsg{
+		ConnID: ctx.ConnID,
+	}
+}
+
+func ackCommand(ctx *CommandCtx) {
+	msgID := ctx.Args.Int64("msgID")
+	if msgID <= 0 {
+		ctx.Reply(AckArgErr)
+		return
+	}
+	ctx.s.userShard(ctx.UserName).userAckChan <- &UserAckMsg{
+		ConnID: ctx.ConnID,
+		MsgID:  msgID,
+	}
+}
+
+func typingCommand(ctx *CommandCtx) {
+	ctx.s.connRoomShard(ctx.ConnID).roomTypingChan <- &RoomTypingMsg{
+		ConnID: ctx.ConnID,
+	}
+}
+
+func nickCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userNickChan <- &UserNickMsg{
+		ConnID: ctx.ConnID,
+		Name:   ctx.Args.String("name"),
+	}
+}
+
+func profileCommand(ctx *CommandCtx) {
+	ctx.s.userShard(ctx.UserName).userProfileChan <- &UserProfileMsg{
+		ConnID: ctx.ConnID,
+		Field:  ctx.Args.String("field"),
+		Value:  ctx.Args.String("value"),
+	}
+}
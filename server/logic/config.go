@@ -0,0 +1,71 @@
+package logic
+
+import (
+	"runtime"
+	"time"
+)
+
+type Config struct {
+	ListenAddr   string // 聊天服务监听地址
+	AdminAddr    string // 管理接口监听地址，为空则不启动
+	AdminToken   string // 管理接口鉴权token，为空则不开启管理接口
+	BadWordsFile string // 脏词库文件
+
+	IntegrationTokens map[string]string // 集成发消息接口的token，value是集成的名字
+
+	InboxSize      int   // 每个用户离线消息最多保留条数
+	InboxTTLSecond int64 // 离线消息保留时间
+
+	DirectReadReceipt bool // 私聊已读后是否通知发送人
+
+	MsgMiddleware  []string         // 房间默认启用的中间件，按顺序执行。为nil用DefaultMsgMiddleware，空列表为都不启用
+	RoomMiddleware map[int][]string // 单独配置的房间，覆盖默认
+
+	Webhooks            map[int]*WebhookConfig // 房间事件推送，key是房间ID
+	WebhookQueueFile    string                 // 待投递事件落盘的文件，为空不落盘
+	WebhookRetryBase    time.Duration          // 第一次重试的等待时间，之后翻倍
+	WebhookRetryMax     time.Duration
+	WebhookMaxAttempts  int           // 超过次数丢弃
+	WebhookQueueCompact int           // 完成的投递超过这么多条就压缩队列文件，为0每次都压缩
+	WebhookSyncInterval time.Duration // 队列文件攒一批再刷盘，最多等这么久，为0每条都刷
+	WebhookSyncBatch    int           // 没刷盘的记录攒够这么多条立即刷
+
+	NodeID             int           // 多节点时每个节点不同，1到BackplaneMaxNode-1
+	BackplaneChannel   string        // 节点之间同步用的频道
+	BackplaneRetryBase time.Duration // 订阅断开后第一次重新订阅的等待时间，之后翻倍
+	BackplaneRetryMax  time.Duration
+
+	RoomShards int // 房间分片数，每个分片一个协程，最多RoomNum个
+	UserShards int // 用户分片数
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:   "127.0.0.1:5678",
+		AdminAddr:    "127.0.0.1:5679",
+		BadWordsFile: "list.txt",
+
+		InboxSize:      100,
+		InboxTTLSecond: 7 * 24 * 3600,
+
+		DirectReadReceipt: true,
+
+		MsgMiddleware: append([]string(nil), DefaultMsgMiddleware...),
+
+		WebhookQueueFile:    "webhook.queue",
+		WebhookRetryBase:    time.Second,
+		WebhookRetryMax:     5 * time.Minute,
+		WebhookMaxAttempts:  10,
+		WebhookQueueCompact: 1000,
+		WebhookSyncInterval: 100 * time.Millisecond,
+		WebhookSyncBatch:    256,
+
+		NodeID:             1,
+		BackplaneChannel:   "simplechat",
+		BackplaneRetryBase: 100 * time.Millisecond,
+		BackplaneRetryMax:  30 * time.Second,
+
+		RoomShards: runtime.NumCPU(),
+		UserShards: runtime.NumCPU(),
+	}
+}
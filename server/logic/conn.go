@@ -2,9 +2,11 @@ package logic
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net"
+	"strings"
+	"sync"
 )
 
 type ConnManage struct {
@@ -14,6 +16,14 @@ type ConnManage struct {
 
 	listener net.Listener
 	connNum  int
+
+	newConnChan   chan net.Conn      // 新建立的连接
+	connCloseChan chan int           // 连接断开
+	connKickChan  chan *ConnKickMsg  // 强制断开连接
+	connQueryChan chan *ConnQueryMsg // 查询连接
+
+	wg        sync.WaitGroup
+	closeChan chan bool
 }
 
 type UserConn struct {
@@ -21,8 +31,10 @@ type UserConn struct {
 	UserName string
 
 	conn        net.Conn
+	connectTime int64
 	receiveChan chan *ConnMsg
 	sendChan    chan *PushConnMsg
+	closeNotify chan int
 	closeChan   chan bool
 }
 
@@ -30,25 +42,40 @@ func (cm *ConnManage) init(s *Service) {
 	cm.s = s
 	cm.connNum = 0
 	cm.UserConn = make(map[int]*UserConn)
+	cm.newConnChan = make(chan net.Conn, 64)
+	cm.connCloseChan = make(chan int, 64)
+	cm.connKickChan = make(chan *ConnKickMsg, 64)
+	cm.connQueryChan = make(chan *ConnQueryMsg, 64)
+	cm.closeChan = make(chan bool, 1)
 }
 
 func (cm *ConnManage) Start(s *Service) {
 	cm.init(s)
 
 	// 初始化监听
-	listener, err := net.Listen("tcp", "127.0.0.1:5678")
+	listener, err := net.Listen("tcp", s.Config.ListenAddr)
 	if err != nil {
 		log.Printf("listen port err %s", err.Error())
 		return
 	}
 	cm.listener = listener
+
+	// 连接管理
+	cm.wg.Add(1)
+	go cm.connLogic()
+
 	// 监听
+	cm.wg.Add(1)
 	go cm.listen()
 }
 
 func (cm *ConnManage) Stop() {
 	// 关闭监听
-	cm.listener.Close()
+	if cm.listener != nil {
+		cm.listener.Close()
+	}
+	close(cm.closeChan)
+	cm.wg.Wait()
 
 	// 关闭用户连接
 	for _, user := range cm.UserConn {
@@ -57,14 +84,43 @@ func (cm *ConnManage) Stop() {
 }
 
 func (cm *ConnManage) listen() {
+	defer cm.wg.Done()
 	for {
 		conn, err := cm.listener.Accept()
 		if err != nil {
+			// 监听已关闭
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("listener accept err %s", err.Error())
 			continue
 		}
-		cm.connNum++
-		cm.newUserConn(cm.connNum, conn)
+
+		select {
+		case cm.newConnChan <- conn:
+		case <-cm.closeChan:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (cm *ConnManage) connLogic() {
+	defer cm.wg.Done()
+	for {
+		select {
+		case conn := <-cm.newConnChan:
+			cm.connNum++
+			cm.newUserConn(cm.connNum, conn)
+		case connID := <-cm.connCloseChan:
+			cm.closeLogic(connID)
+		case kickMsg := <-cm.connKickChan:
+			cm.kickLogic(kickMsg)
+		case queryMsg := <-cm.connQueryChan:
+			cm.queryLogic(queryMsg)
+		case <-cm.closeChan:
+			return
+		}
 	}
 }
 
@@ -73,8 +129,10 @@ func (cm *ConnManage) newUserConn(id int, conn net.Conn) {
 	userConn := &UserConn{
 		ConnID:      id,
 		conn:        conn,
+		connectTime: cm.s.now(),
 		receiveChan: cm.s.msgManage.receiveMsgChan,
 		sendChan:    make(chan *PushConnMsg, 64),
+		closeNotify: cm.connCloseChan,
 		closeChan:   make(chan bool, 1),
 	}
 	cm.UserConn[id] = userConn
@@ -91,6 +149,50 @@ func (cm *ConnManage) newUserConn(id int, conn net.Conn) {
 	userConn.Start()
 }
 
+func (cm *ConnManage) closeLogic(connID int) {
+	userConn := cm.UserConn[connID]
+	if userConn == nil {
+		return
+	}
+	delete(cm.UserConn, connID)
+	userConn.Stop()
+
+	// 注销消息通道
+	cm.s.msgManage.connMsgDelChan <- connID
+
+	// 断开的连接算登出，多端登录时其他连接不受影响。
+	// 这里不知道登录名，发给所有用户分片，只有登录所在的分片会处理
+	for _, userManage := range cm.s.userShards {
+		userManage.userLogoutMsgChan <- &UserLogoutMsg{ConnID: connID}
+	}
+
+	log.Printf("conn %d closed", connID)
+}
+
+func (cm *ConnManage) kickLogic(msg *ConnKickMsg) {
+	userConn := cm.UserConn[msg.ConnID]
+	if userConn == nil {
+		msg.Reply <- false
+		return
+	}
+
+	// 关闭连接后读协程报错，走正常的下线流程
+	userConn.conn.Close()
+	msg.Reply <- true
+}
+
+func (cm *ConnManage) queryLogic(msg *ConnQueryMsg) {
+	connInfos := make([]*ConnInfo, 0, len(cm.UserConn))
+	for _, userConn := range cm.UserConn {
+		connInfos = append(connInfos, &ConnInfo{
+			ConnID:      userConn.ConnID,
+			RemoteAddr:  userConn.conn.RemoteAddr().String(),
+			ConnectTime: userConn.connectTime,
+		})
+	}
+	msg.Reply <- connInfos
+}
+
 func (uc *UserConn) Start() {
 	// 读消息
 	go uc.connRead()
@@ -112,21 +214,24 @@ func (uc *UserConn) connRead() {
 		if err != nil {
 			log.Printf("conn %d read buffer err %s", uc.ConnID, err.Error())
 
-			// 通知下线
-			msg := &ConnMsg{
-				ConnID:  uc.ConnID,
-				Content: fmt.Sprintf("%s %d", Logout, uc.ConnID),
-			}
-			uc.receiveChan <- msg
+			// 通知连接管理回收，由它通知用户分片下线
+			uc.closeNotify <- uc.ConnID
 			return
 		}
 
+		// 按换行拆成多条，没有换行的整段算一条
 		buffMsg := string(buffer[:n])
-		msg := &ConnMsg{
-			ConnID:  uc.ConnID,
-			Content: buffMsg,
+		for _, line := range strings.Split(buffMsg, "\n") {
+			line = strings.TrimRight(line, "\r")
+			if line == "" {
+				continue
+			}
+			msg := &ConnMsg{
+				ConnID:  uc.ConnID,
+				Content: line,
+			}
+			uc.receiveChan <- msg
 		}
-		uc.receiveChan <- msg
 
 		log.Printf("receive msg %s", buffMsg)
 	}
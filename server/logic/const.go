@@ -1,15 +1,60 @@
 package logic
 
+import "time"
+
 const JoinRoomChatMsg = 50
 
+const (
+	HistoryDefaultLimit = 50
+	HistoryMaxLimit     = 100
+	SearchMaxResult     = 20
+)
+
 const RoomNum = 10
 
+// UserMaxShard 用户分片数上限
+const UserMaxShard = 256
+
 const (
 	JoinRoomSuccess = "Notify:JoinRoomSuccess"
 	LoginSuccess    = "Notify:LoginSuccess"
 	NameRepeat      = "Notify:NameRepeat"
 	AlreadyLogin    = "Notify:AlreadyLogin"
+	LoginPending    = "Notify:LoginPending"
 	RoomIDErr       = "Notify:RoomIDErr"
+	HistoryEmpty    = "Notify:HistoryEmpty"
+	HistoryArgErr   = "Notify:HistoryArgErr"
+	SearchEmpty     = "Notify:SearchEmpty"
+	SearchArgErr    = "Notify:SearchArgErr"
+	NotRoomMember   = "Notify:NotRoomMember"
+	RoomBanned      = "Notify:RoomBanned"
+	MsgNotFound     = "Notify:MsgNotFound"
+	NoPermission    = "Notify:NoPermission"
+	EditArgErr      = "Notify:EditArgErr"
+	ReplyArgErr     = "Notify:ReplyArgErr"
+	ReactArgErr     = "Notify:ReactArgErr"
+	DirectArgErr    = "Notify:DirectArgErr"
+	UserNotFound    = "Notify:UserNotFound"
+	OfflineMsg      = "Notify:OfflineMsg %d"
+	MentionEmpty    = "Notify:MentionEmpty"
+	AckArgErr       = "Notify:AckArgErr"
+	NameInvalid     = "Notify:NameInvalid"
+	NickSuccess     = "Notify:NickSuccess"
+	ProfileArgErr   = "Notify:ProfileArgErr"
+	ProfileSuccess  = "Notify:ProfileSuccess"
+	NotLogin        = "Notify:NotLogin"
+	UnknownCommand  = "Notify:UnknownCommand %s"
+	CommandArgErr   = "Notify:CommandArgErr %s"
+	MsgInvalid      = "Notify:MsgInvalid"
+	MsgSpam         = "Notify:MsgSpam"
+)
+
+const (
+	UserJoinRoom  = "Notify:UserJoinRoom %s"
+	UserLeaveRoom = "Notify:UserLeaveRoom %s"
+	UserKicked    = "Notify:UserKicked %s"
+	UserBanned    = "Notify:UserBanned %s"
+	UserRename    = "Notify:UserRename %s %s"
 )
 
 const (
@@ -18,10 +63,73 @@ const (
 	Name       = "/name"
 	ChangeRoom = "/room"
 	Logout     = "/logout"
+	Who        = "/who"
+	Rooms      = "/rooms"
+	History    = "/history"
+	Search     = "/search"
+	Edit       = "/edit"
+	Delete     = "/delete"
+	Reply      = "/reply"
+	React      = "/react"
+	Unreact    = "/unreact"
+	Direct     = "/msg"
+	Mentions   = "/mentions"
+	Ack        = "/ack"
+	Typing     = "/typing"
+	Nick       = "/nick"
+	Profile    = "/profile"
+	Help       = "/help"
+)
+
+const (
+	ProfileStatus   = "status"
+	ProfileTimezone = "tz"
+)
+
+const (
+	NameMaxLen          = 20 // 用户名和昵称的最大长度
+	ProfileStatusMaxLen = 100
 )
 
 const (
 	PopularBeforeSecond = 600
+	RoomIdleSecond      = 300 // 超过该时间没发言视为idle
+)
+
+const (
+	PresenceActive  = "active"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+const StatsTimeLayout = "2006-01-02 15:04:05"
+
+const (
+	SessionMaxNum       = 200       // 每个用户保留的会话记录数
+	RollingOnlineSecond = 24 * 3600 // 统计最近一段时间的在线时长
+)
+
+const AdminReplyTimeout = 3 * time.Second
+
+// 管理接口的读写超时，防止慢速客户端一直占着连接；写超时要比等管理器回复的时间长
+const (
+	AdminReadHeaderTimeout = 5 * time.Second
+	AdminReadTimeout       = 10 * time.Second
+	AdminWriteTimeout      = 10 * time.Second
+	AdminIdleTimeout       = 60 * time.Second
+)
+
+const WebhookTimeout = 10 * time.Second // 单次推送请求的超时
+
+const BackplaneMaxNode = 1024 // 多节点时序号部分为 序号*BackplaneMaxNode+NodeID
+
+const BackplaneRetryMin = 100 * time.Millisecond // 没配置重新订阅的等待时间时用
+
+const MsgIDRoomBase = RoomNum + 1 // 消息ID为 序号部分*MsgIDRoomBase+房间ID，私聊的房间ID记为RoomNum
+
+const (
+	RedisDialTimeout  = 3 * time.Second
+	RedisReplyTimeout = 3 * time.Second
 )
 
 const (
@@ -29,3 +137,40 @@ const (
 	StatusOnline
 	StatusLogout
 )
+
+const (
+	_               = iota
+	MsgTypeChat     // 聊天消息
+	MsgTypeSystem   // 系统通知
+	MsgTypeAnnounce // 公告
+	MsgTypeJoin     // 有人加入房间
+	MsgTypeLeave    // 有人离开房间
+	MsgTypeHistory  // 历史消息
+	MsgTypeSearch   // 搜索结果
+	MsgTypeEdit     // 消息被编辑
+	MsgTypeDelete   // 消息被删除
+	MsgTypeReaction // 消息的表情回应有变化
+	MsgTypeDirect   // 私聊
+	MsgTypeMention  // 被@提醒
+	MsgTypeReceipt  // 私聊已读回执
+	MsgTypeTyping   // 正在输入
+	MsgTypePopular  // 房间高频词
+	MsgTypeStats    // 用户统计
+)
+
+const (
+	TypingThrottleSecond = 3 // 同一个人两次输入提示的最小间隔
+	TypingExpireSecond   = 6 // 输入提示的有效时间
+)
+
+const MentionMaxNum = 50
+
+const DirectMaxNum = 100
+
+const MaxEmojiLen = 32
+
+const (
+	MsgMaxLen        = 2000 // 一条聊天消息的最大字数
+	SpamMsgNum       = 5    // 窗口内最多发几条
+	SpamWindowSecond = 10
+)
@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"log"
+)
+
+type ChatEdit struct {
+	Content  string // 编辑前的内容
+	EditTime int64
+	Editor   string
+}
+
+func (rm *RoomManage) roomEditLogic(msg *RoomEditMsg) {
+	room, cMsg := rm.findRoomMsg(msg.MsgID)
+	if cMsg == nil || cMsg.Deleted {
+		rm.sendSingleMsg(msg.ConnID, MsgNotFound)
+		return
+	}
+
+	// 只有作者和房间管理员可以操作，集成发的消息只有管理员
+	isAuthor := cMsg.UserName == msg.UserName && cMsg.Integration == ""
+	if !isAuthor && !room.Operators[msg.UserName] {
+		rm.sendSingleMsg(msg.ConnID, NoPermission)
+		return
+	}
+
+	now := rm.s.now()
+	msgType := MsgTypeEdit
+	eventType := WebhookEventEdit
+	if msg.Delete {
+		room.deleteMsg(cMsg, msg.UserName, now)
+		msgType = MsgTypeDelete
+		eventType = WebhookEventDelete
+	} else {
+		room.editMsg(cMsg, msg.Content, msg.UserName, now)
+		cMsg.Annotations = msg.Annotations
+	}
+	log.Printf("room %d msg %d edit by %s delete %v", room.RoomID, cMsg.MsgID, msg.UserName, msg.Delete)
+
+	// 通知房间内所有人更新
+	rm.pushToRoom(room, 0, cMsg.toBaseMsg(msgType))
+	rm.publishUpdate(cMsg, cMsg.toBaseMsg(msgType))
+
+	// 推送事件的UserName是操作的人，删除后内容为空
+	rm.s.webhookManage.emit(&WebhookEvent{
+		Type:     eventType,
+		RoomID:   room.RoomID,
+		Time:     now,
+		UserName: msg.UserName,
+		MsgID:    cMsg.MsgID,
+		Content:  cMsg.MsgContent,
+		ParentID: cMsg.ParentID,
+	})
+}
+
+// publishUpdate 编辑、删除或回应后的消息同步给其他节点，baseMsg是推给房间的那条
+func (rm *RoomManage) publishUpdate(cMsg *ChatMsg, baseMsg *BaseMsg) {
+	rm.s.backplaneManage.publish(&backplaneEvent{
+		Kind: backplaneRoomUpdate,
+		Chat: cMsg.clone(),
+		Msg:  baseMsg,
+	})
+}
+
+func (rm *RoomManage) roomOpLogic(msg *RoomOpMsg) {
+	room := rm.Rooms[msg.RoomID]
+	if room == nil {
+		msg.Reply <- false
+		return
+	}
+
+	action := WebhookActionOp
+	if msg.Op {
+		room.Operators[msg.Name] = true
+	} else {
+		delete(room.Operators, msg.Name)
+		action = WebhookActionDeop
+	}
+	msg.Reply <- true
+
+	rm.s.webhookManage.emit(&WebhookEvent{
+		Type:     WebhookEventModeration,
+		Action:   action,
+		RoomID:   room.RoomID,
+		Time:     rm.s.now(),
+		UserName: msg.Name,
+	})
+}
+
+// findRoomMsg 在这个分片的房间里找消息
+func (rm *RoomManage) findRoomMsg(msgID int64) (*Room, *ChatMsg) {
+	for _, room := range rm.Rooms {
+		if cMsg := room.findMsg(msgID); cMsg != nil {
+			return room, cMsg
+		}
+	}
+	return nil, nil
+}
+
+// editMsg 修改消息内容，旧内容留在编辑记录里
+func (r *Room) editMsg(cMsg *ChatMsg, content string, editor string, now int64) {
+	r.unindexMsg(cMsg)
+	cMsg.Edits = append(cMsg.Edits, &ChatEdit{
+		Content:  cMsg.MsgContent,
+		EditTime: now,
+		Editor:   editor,
+	})
+	cMsg.MsgContent = content
+	cMsg.EditTime = now
+	r.indexMsg(cMsg)
+}
+
+// deleteMsg 删除消息，只保留墓碑和编辑记录
+func (r *Room) deleteMsg(cMsg *ChatMsg, editor string, now int64) {
+	r.unindexMsg(cMsg)
+	cMsg.Edits = append(cMsg.Edits, &ChatEdit{
+		Content:  cMsg.MsgContent,
+		EditTime: now,
+		Editor:   editor,
+	})
+	cMsg.MsgContent = ""
+	cMsg.Deleted = true
+	cMsg.EditTime = now
+}
+
+// updateMsg 用其他节点编辑、删除或回应后的消息覆盖本地的
+func (r *Room) updateMsg(cMsg *ChatMsg, remote *ChatMsg) {
+	r.unindexMsg(cMsg)
+	cMsg.MsgContent = remote.MsgContent
+	cMsg.EditTime = remote.EditTime
+	cMsg.Deleted = remote.Deleted
+	cMsg.Edits = remote.Edits
+	cMsg.Reactions = remote.Reactions
+	cMsg.Annotations = remote.Annotations
+	if !cMsg.Deleted {
+		r.indexMsg(cMsg)
+	}
+}
+
+// unindexMsg 把消息从倒排索引中去掉
+func (r *Room) unindexMsg(cMsg *ChatMsg) {
+	seen := make(map[string]bool)
+	for _, word := range tokenize(cMsg.MsgContent) {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+
+		msgIDs := r.Index[word]
+		for i, msgID := range msgIDs {
+			if msgID == cMsg.MsgID {
+				msgIDs = append(msgIDs[:i], msgIDs[i+1:]...)
+				break
+			}
+		}
+		if len(msgIDs) == 0 {
+			delete(r.Index, word)
+		} else {
+			r.Index[word] = msgIDs
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package logic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoom_editAndDeleteMsg(t *testing.T) {
+	room := &Room{Index: make(map[string][]int64)}
+	for i, content := range []string{"hello world", "hello there", "bye world"} {
+		cMsg := &ChatMsg{MsgID: int64(i + 1), UserName: "alice", MsgContent: content}
+		room.ChatMsg = append(room.ChatMsg, cMsg)
+		room.indexMsg(cMsg)
+	}
+
+	room.editMsg(room.ChatMsg[0], "goodbye there", "alice", 100)
+	if got := room.ChatMsg[0]; got.MsgContent != "goodbye there" || got.EditTime != 100 || len(got.Edits) != 1 || got.Edits[0].Content != "hello world" {
+		t.Fatalf("editMsg() = %+v", got)
+	}
+	if got := room.Index["there"]; !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("index there = %v, want [1 2]", got)
+	}
+	if got := room.Index["world"]; !reflect.DeepEqual(got, []int64{3}) {
+		t.Errorf("index world = %v, want [3]", got)
+	}
+
+	room.deleteMsg(room.ChatMsg[1], "bob", 200)
+	if got := room.ChatMsg[1]; !got.Deleted || got.MsgContent != "" || got.Edits[0].Editor != "bob" {
+		t.Fatalf("deleteMsg() = %+v", got)
+	}
+	if _, ok := room.Index["hello"]; ok {
+		t.Errorf("index hello should be removed")
+	}
+	if got := room.search(&SearchQuery{From: "alice"}, 10); len(got) != 2 {
+		t.Errorf("search after delete = %d msgs, want 2", len(got))
+	}
+}
@@ -0,0 +1,261 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testExpectTimeout = 2 * time.Second
+
+// testHarness 在随机端口上起一个完整的Service，时间由FakeClock控制
+type testHarness struct {
+	t     *testing.T
+	s     *Service
+	clock *FakeClock
+}
+
+func newTestHarness(t *testing.T, config *Config) *testHarness {
+	if config == nil {
+		config = DefaultConfig()
+		config.BadWordsFile = ""
+	}
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &Service{Config: config, Clock: clock}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return &testHarness{t: t, s: s, clock: clock}
+}
+
+// testClient 脚本化的客户端，按顺序发命令、等回复
+type testClient struct {
+	t       *testing.T
+	name    string
+	conn    net.Conn
+	msgChan chan *BaseMsg
+}
+
+func (h *testHarness) dial() *testClient {
+	h.t.Helper()
+	conn, err := net.Dial("tcp", h.s.Addr())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{
+		t:       h.t,
+		conn:    conn,
+		msgChan: make(chan *BaseMsg, 1024),
+	}
+	go c.read()
+	return c
+}
+
+// login 建立连接并登录
+func (h *testHarness) login(name string) *testClient {
+	h.t.Helper()
+	c := h.dial()
+	c.name = name
+	c.send(Name + " " + name)
+	c.expectContent(LoginSuccess)
+	return c
+}
+
+func (c *testClient) read() {
+	defer close(c.msgChan)
+	decoder := json.NewDecoder(c.conn)
+	for {
+		pushMsg := &PushConnMsg{}
+		if err := decoder.Decode(pushMsg); err != nil {
+			return
+		}
+		for _, baseMsg := range pushMsg.PushConnMsg {
+			c.msgChan <- baseMsg
+		}
+	}
+}
+
+func (c *testClient) send(content string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(content + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect 等到第一条满足条件的消息，之前收到的都丢掉
+func (c *testClient) expect(desc string, match func(*BaseMsg) bool) *BaseMsg {
+	c.t.Helper()
+	timer := time.NewTimer(testExpectTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case baseMsg, ok := <-c.msgChan:
+			if !ok {
+				c.t.Fatalf("%s: conn closed while waiting for %s", c.name, desc)
+			}
+			if match(baseMsg) {
+				return baseMsg
+			}
+		case <-timer.C:
+			c.t.Fatalf("%s: timeout waiting for %s", c.name, desc)
+		}
+	}
+}
+
+func (c *testClient) expectContent(content string) *BaseMsg {
+	c.t.Helper()
+	return c.expect(fmt.Sprintf("content %q", content), func(baseMsg *BaseMsg) bool {
+		return baseMsg.Content == content
+	})
+}
+
+// expectChat 等某人在房间里说的一句话
+func (c *testClient) expectChat(userName string, content string) *BaseMsg {
+	c.t.Helper()
+	return c.expect(fmt.Sprintf("chat %s:%s", userName, content), func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeChat && baseMsg.UserName == userName && baseMsg.Content == content
+	})
+}
+
+// say 在房间里说一句话，等自己收到回显说明房间已经存下
+func (c *testClient) say(content string) *BaseMsg {
+	c.t.Helper()
+	c.send(content)
+	return c.expectChat(c.name, content)
+}
+
+// joinRoom 切换房间，房间管理处理完才会回复成功
+func (c *testClient) joinRoom(roomID int) {
+	c.t.Helper()
+	c.send(fmt.Sprintf("%s %d", ChangeRoom, roomID))
+	c.expectContent(JoinRoomSuccess)
+}
+
+func TestHarness_popularWindow(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	alice.joinRoom(1)
+
+	alice.say("aa aa aa")
+	h.clock.Advance((PopularBeforeSecond + 1) * time.Second)
+	alice.say("bb")
+
+	alice.send(fmt.Sprintf("%s %d", Popular, 1))
+	alice.expectContent("bb")
+}
+
+func TestHarness_roomChat(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	bob := h.login("bob")
+	bob.joinRoom(2)
+	alice.expect("bob join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "bob"
+	})
+
+	chatMsg := bob.say("hello alice")
+	if chatMsg.MsgTime != h.clock.Now().Unix() {
+		t.Errorf("msg time = %d, want fake clock %d", chatMsg.MsgTime, h.clock.Now().Unix())
+	}
+	alice.expectChat("bob", "hello alice")
+}
+
+func TestHarness_typing(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	alice.joinRoom(1)
+	bob := h.login("bob")
+	bob.joinRoom(1)
+	expectTyping := func() *BaseMsg {
+		t.Helper()
+		return bob.expect("alice typing", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeTyping && baseMsg.UserName == "alice"
+		})
+	}
+
+	start := h.clock.Now().Unix()
+	alice.send(Typing)
+	typing := expectTyping()
+	if typing.RoomID != 1 || typing.MsgTime != start || typing.ExpireTime != start+TypingExpireSecond {
+		t.Errorf("typing = %+v", typing)
+	}
+
+	// 限流时间内的不推，到了再推
+	for i := 1; i <= TypingThrottleSecond; i++ {
+		h.clock.Advance(time.Second)
+		alice.send(Typing)
+	}
+	typing = expectTyping()
+	if typing.MsgTime != start+TypingThrottleSecond {
+		t.Errorf("typing time = %d, want %d", typing.MsgTime, start+TypingThrottleSecond)
+	}
+
+	// 过期后客户端隐藏，再输入推送新的过期时间
+	h.clock.Advance(TypingExpireSecond * time.Second)
+	if now := h.clock.Now().Unix(); typing.ExpireTime > now {
+		t.Errorf("typing expire %d after %d", typing.ExpireTime, now)
+	}
+	alice.send(Typing)
+	typing = expectTyping()
+	if now := h.clock.Now().Unix(); typing.ExpireTime != now+TypingExpireSecond {
+		t.Errorf("typing expire = %d, want %d", typing.ExpireTime, now+TypingExpireSecond)
+	}
+
+	// 不记入房间消息
+	bob.send(fmt.Sprintf("%s %d", History, 1))
+	bob.expectContent(HistoryEmpty)
+}
+
+func TestHarness_onlineTime(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	bob := h.login("bob")
+
+	h.clock.Advance(30 * time.Minute)
+	bob.send(Stats + " alice")
+	bob.expect("alice stats", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "stats alice") &&
+			strings.Contains(baseMsg.Content, "onlineTime: 30m0s")
+	})
+
+	// 断开后在线时长不再增长
+	alice.conn.Close()
+	for i := 0; i < 100; i++ {
+		h.clock.Advance(time.Minute)
+		bob.send(Stats + " alice")
+		baseMsg := bob.expect("alice stats", func(baseMsg *BaseMsg) bool {
+			return strings.HasPrefix(baseMsg.Content, "stats alice")
+		})
+		if !strings.Contains(baseMsg.Content, "presence: "+PresenceOffline) {
+			continue
+		}
+		onlineLine := statsLine(baseMsg.Content, "onlineTime:")
+		h.clock.Advance(time.Hour)
+		bob.send(Stats + " alice")
+		baseMsg = bob.expect("alice stats", func(baseMsg *BaseMsg) bool {
+			return strings.HasPrefix(baseMsg.Content, "stats alice")
+		})
+		if got := statsLine(baseMsg.Content, "onlineTime:"); got != onlineLine {
+			t.Errorf("offline %s, want %s", got, onlineLine)
+		}
+		return
+	}
+	t.Fatal("alice never went offline")
+}
+
+func statsLine(content string, prefix string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+type InboxItem struct {
+	Msg         *BaseMsg
+	QueueTime   int64
+	Delivered   bool
+	DeliverTime int64
+}
+
+func (um *UserManage) directLogic(msg *UserDirectMsg) {
+	// 先在发送人的分片填上发送人，收件人在别的分片就转过去
+	if msg.FromUser == "" {
+		userName := um.userConnIDToName[msg.ConnID]
+		if userName == "" {
+			return
+		}
+		msg.FromUser = userName
+		msg.FromConnIDs = um.users[userName].connIDList()
+		if shard := um.s.userShard(msg.ToUser); shard != um {
+			shard.userDirectChan <- msg
+			return
+		}
+	}
+	userName := msg.FromUser
+
+	toUser := um.users[msg.ToUser]
+	remote := um.remoteOnline(msg.ToUser)
+	if toUser == nil && !remote {
+		um.sendSingleMsg(msg.ConnID, UserNotFound)
+		return
+	}
+
+	now := um.s.now()
+	baseMsg := &BaseMsg{
+		Type:     MsgTypeDirect,
+		MsgID:    um.s.newMsgID(RoomNum),
+		MsgTime:  now,
+		UserName: userName,
+		Content:  um.filterBadWords(msg.Content),
+		ToUser:   msg.ToUser,
+	}
+
+	// 对方在其他节点在线的由那个节点投递
+	if remote {
+		baseMsgCopy := *baseMsg
+		um.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneDirect, Msg: &baseMsgCopy})
+	}
+
+	// 对方不在线先存起来，自己的其他连接也同步一份
+	connIDSet := make(map[int]bool)
+	for _, connID := range msg.FromConnIDs {
+		connIDSet[connID] = true
+	}
+	if toUser != nil {
+		toUser.addDirect(baseMsg)
+		if toUser.Status == StatusOnline {
+			for connID := range toUser.ConnIDs {
+				connIDSet[connID] = true
+			}
+		} else if !remote {
+			um.queueInbox(toUser, baseMsg, now)
+		}
+	}
+	connIDs := make([]int, 0, len(connIDSet))
+	for connID := range connIDSet {
+		connIDs = append(connIDs, connID)
+	}
+	sort.Ints(connIDs)
+
+	pushToOtherMsg := make([]*BaseMsg, 0)
+	pushToOtherMsg = append(pushToOtherMsg, baseMsg)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	um.s.msgManage.pushMsgChan <- pushMsg
+}
+
+// queueRoomOffline 给下线前在房间里的用户留言
+func (um *UserManage) queueRoomOffline(roomID int, baseMsg *BaseMsg, now int64) {
+	for name := range um.roomOfflineUsers[roomID] {
+		user := um.users[name]
+		if user != nil && user.Status != StatusOnline {
+			um.queueInbox(user, baseMsg, now)
+		}
+	}
+}
+
+// queueInbox 存一条离线消息，超出上限丢掉最早的
+func (um *UserManage) queueInbox(user *User, baseMsg *BaseMsg, now int64) {
+	if um.s.Config.InboxSize <= 0 {
+		return
+	}
+
+	user.pruneInbox(now, um.s.Config.InboxTTLSecond)
+	if len(user.Inbox) >= um.s.Config.InboxSize {
+		user.Inbox = user.Inbox[len(user.Inbox)-um.s.Config.InboxSize+1:]
+	}
+	user.Inbox = append(user.Inbox, &InboxItem{
+		Msg:       baseMsg,
+		QueueTime: now,
+	})
+}
+
+// deliverInbox 登录后推送未投递的离线消息，并标记为已投递
+func (um *UserManage) deliverInbox(user *User, connID int, now int64) {
+	user.pruneInbox(now, um.s.Config.InboxTTLSecond)
+
+	pushToOtherMsg := make([]*BaseMsg, 0, len(user.Inbox))
+	for _, item := range user.Inbox {
+		if item.Delivered {
+			continue
+		}
+		pushToOtherMsg = append(pushToOtherMsg, item.Msg)
+		item.Delivered = true
+		item.DeliverTime = now
+	}
+	if len(pushToOtherMsg) == 0 {
+		return
+	}
+
+	um.sendSingleMsg(connID, fmt.Sprintf(OfflineMsg, len(pushToOtherMsg)))
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, connID)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	um.s.msgManage.pushMsgChan <- pushMsg
+}
+
+func (um *UserManage) addRoomOfflineUser(roomID int, name string) {
+	if um.roomOfflineUsers[roomID] == nil {
+		um.roomOfflineUsers[roomID] = make(map[string]bool)
+	}
+	if !um.roomOfflineUsers[roomID][name] {
+		atomic.AddInt32(&um.roomOfflineNum[roomID], 1)
+	}
+	um.roomOfflineUsers[roomID][name] = true
+}
+
+func (um *UserManage) delRoomOfflineUser(roomID int, name string) {
+	if !um.roomOfflineUsers[roomID][name] {
+		return
+	}
+	delete(um.roomOfflineUsers[roomID], name)
+	atomic.AddInt32(&um.roomOfflineNum[roomID], -1)
+}
+
+// hasRoomOffline 房间有离线的用户在这个分片，房间分片调用
+func (um *UserManage) hasRoomOffline(roomID int) bool {
+	return atomic.LoadInt32(&um.roomOfflineNum[roomID]) > 0
+}
+
+// pruneInbox 清掉过期的离线消息，已投递的保留到过期
+func (u *User) pruneInbox(now int64, ttlSecond int64) {
+	inbox := u.Inbox[:0]
+	for _, item := range u.Inbox {
+		if now-item.QueueTime > ttlSecond {
+			continue
+		}
+		inbox = append(inbox, item)
+	}
+	// 去掉尾部残留的引用
+	for i := len(inbox); i < len(u.Inbox); i++ {
+		u.Inbox[i] = nil
+	}
+	u.Inbox = inbox
+}
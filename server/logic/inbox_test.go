@@ -0,0 +1,36 @@
+package logic
+
+import "testing"
+
+func TestUserManage_inbox(t *testing.T) {
+	s := &Service{
+		Config:    &Config{InboxSize: 2, InboxTTLSecond: 100},
+		msgManage: &MsgManage{pushMsgChan: make(chan *PushMsg, 8)},
+	}
+	um := &UserManage{s: s}
+	user := &User{Name: "alice", ConnIDs: map[int]bool{1: true}}
+
+	um.queueInbox(user, &BaseMsg{MsgID: 1}, 0)
+	um.queueInbox(user, &BaseMsg{MsgID: 2}, 50)
+	um.queueInbox(user, &BaseMsg{MsgID: 3}, 60)
+	if len(user.Inbox) != 2 || user.Inbox[0].Msg.MsgID != 2 {
+		t.Fatalf("inbox over size should drop oldest, got %d items", len(user.Inbox))
+	}
+
+	// 第2条过期
+	um.deliverInbox(user, 1, 155)
+	if len(user.Inbox) != 1 || !user.Inbox[0].Delivered || user.Inbox[0].DeliverTime != 155 {
+		t.Fatalf("deliverInbox() inbox = %+v", user.Inbox)
+	}
+	<-s.msgManage.pushMsgChan
+	pushMsg := <-s.msgManage.pushMsgChan
+	if len(pushMsg.PushMsg) != 1 || pushMsg.PushMsg[0].MsgID != 3 {
+		t.Errorf("deliverInbox() push = %+v", pushMsg.PushMsg)
+	}
+
+	// 已投递的不再推送
+	um.deliverInbox(user, 1, 156)
+	if len(s.msgManage.pushMsgChan) != 0 {
+		t.Errorf("delivered items should not be pushed again")
+	}
+}
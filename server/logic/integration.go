@@ -0,0 +1,101 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const postAsTaken = "as is a registered user" // 不能冒充已有用户的登录名或昵称
+
+type integrationMsgReq struct {
+	Room *int   `json:"room"`
+	Text string `json:"text"`
+	As   string `json:"as"` // 显示的发送人，为空用集成的名字
+}
+
+type integrationMsgResp struct {
+	MsgID       int64  `json:"msgID"`
+	RoomID      int    `json:"roomID"`
+	UserName    string `json:"userName"`
+	Content     string `json:"content"` // 经过中间件后的内容
+	Integration string `json:"integration"`
+}
+
+// integrationAuth 按token找到是哪个集成
+func (am *AdminManage) integrationAuth(handler func(w http.ResponseWriter, r *http.Request, integration string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		integration := ""
+		for integrationToken, name := range am.s.Config.IntegrationTokens {
+			if integrationToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(integrationToken)) == 1 {
+				integration = name
+			}
+		}
+		if integration == "" {
+			writeJSON(w, http.StatusUnauthorized, &adminErrResp{Error: "unauthorized"})
+			return
+		}
+		handler(w, r, integration)
+	}
+}
+
+// POST /api/messages
+func (am *AdminManage) postMessageHandler(w http.ResponseWriter, r *http.Request, integration string) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := &integrationMsgReq{}
+	// 不管房间启用了哪些中间件，空白的消息都不收
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Room == nil || strings.TrimSpace(req.Text) == "" {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: "room and text required"})
+		return
+	}
+	if req.As == "" {
+		req.As = integration
+	}
+
+	result, err := am.postMessage(&UserPostMsg{
+		RoomID:      *req.Room,
+		UserName:    req.As,
+		Integration: integration,
+		Content:     req.Text,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &adminErrResp{Error: err.Error()})
+		return
+	}
+	if result.Err != "" {
+		writeJSON(w, http.StatusBadRequest, &adminErrResp{Error: result.Err})
+		return
+	}
+	log.Printf("integration %s post msg %d to room %d as %s", integration, result.Msg.MsgID, result.Msg.RoomID, req.As)
+	writeJSON(w, http.StatusOK, &integrationMsgResp{
+		MsgID:       result.Msg.MsgID,
+		RoomID:      result.Msg.RoomID,
+		UserName:    result.Msg.UserName,
+		Content:     result.Msg.Content,
+		Integration: result.Msg.Integration,
+	})
+}
+
+func (am *AdminManage) postMessage(msg *UserPostMsg) (*PostResult, error) {
+	msg.Reply = make(chan *PostResult, 1)
+	timer := time.NewTimer(AdminReplyTimeout)
+	defer timer.Stop()
+
+	select {
+	case am.s.userShard(msg.UserName).userPostChan <- msg:
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+	select {
+	case result := <-msg.Reply:
+		return result, nil
+	case <-timer.C:
+		return nil, errReplyTimeout
+	}
+}
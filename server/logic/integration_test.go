@@ -0,0 +1,104 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func integrationPost(t *testing.T, s *Service, token string, body string) (int, *integrationMsgResp, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://"+s.AdminAddr()+"/api/messages", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := &adminErrResp{}
+		json.NewDecoder(resp.Body).Decode(errResp)
+		return resp.StatusCode, nil, errResp.Error
+	}
+	msgResp := &integrationMsgResp{}
+	if err := json.NewDecoder(resp.Body).Decode(msgResp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, msgResp, ""
+}
+
+func TestHarness_integrationPost(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = "127.0.0.1:0"
+	config.IntegrationTokens = map[string]string{"ci-token": "ci"}
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &Service{Config: config, Clock: clock}
+	s.Start()
+	t.Cleanup(s.Stop)
+	h := &testHarness{t: t, s: s, clock: clock}
+
+	if code, _, _ := integrationPost(t, s, "wrong", `{"room":2,"text":"hi"}`); code != http.StatusUnauthorized {
+		t.Errorf("wrong token code = %d", code)
+	}
+	// 没有管理token时不开放管理接口
+	if code := adminDo(t, s, http.MethodGet, "/admin/rooms", "ci-token", nil); code != http.StatusNotFound {
+		t.Errorf("admin api code = %d, want %d", code, http.StatusNotFound)
+	}
+
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	code, msgResp, _ := integrationPost(t, s, "ci-token", `{"room":2,"text":"build #7 passed https://ci.example.com/7","as":"builds"}`)
+	if code != http.StatusOK || msgResp.UserName != "builds" || msgResp.Integration != "ci" || msgResp.RoomID != 2 {
+		t.Fatalf("post code = %d, resp = %+v", code, msgResp)
+	}
+	postedID := msgResp.MsgID
+	chatMsg := alice.expectChat("builds", "build #7 passed https://ci.example.com/7")
+	if chatMsg.MsgID != msgResp.MsgID || chatMsg.Integration != "ci" || chatMsg.Annotations[AnnotationLinks] != "ci.example.com" {
+		t.Errorf("pushed msg = %+v", chatMsg)
+	}
+
+	// as为空用集成的名字
+	if code, msgResp, _ = integrationPost(t, s, "ci-token", `{"room":2,"text":"deploy done"}`); code != http.StatusOK || msgResp.UserName != "ci" {
+		t.Errorf("default as code = %d, resp = %+v", code, msgResp)
+	}
+	alice.expectChat("ci", "deploy done")
+
+	for body, want := range map[string]string{
+		`{"room":2,"text":"  "}`:              "room and text required",
+		`{"room":2}`:                          "room and text required",
+		`{"room":2,"text":"hi","as":"ALICE"}`: postAsTaken,
+		`{"room":10,"text":"hi"}`:             RoomIDErr,
+		`{"room":2,"text":"hi","as":"a b"}`:   NameInvalid,
+		`{"text":"hi"}`:                       "room and text required",
+		fmt.Sprintf(`{"room":2,"text":"%s"}`, strings.Repeat("x", MsgMaxLen+1)): MsgInvalid,
+	} {
+		if code, _, errMsg := integrationPost(t, s, "ci-token", body); code != http.StatusBadRequest || errMsg != want {
+			t.Errorf("post %.30s code = %d err = %q, want %q", body, code, errMsg, want)
+		}
+	}
+
+	// 历史里带着集成标记，同名用户不能改
+	builds := h.login("builds")
+	builds.joinRoom(2)
+	if code, _, errMsg := integrationPost(t, s, "ci-token", `{"room":2,"text":"hi","as":"builds"}`); code != http.StatusBadRequest || errMsg != postAsTaken {
+		t.Errorf("post as registered user code = %d err = %q", code, errMsg)
+	}
+	builds.send(fmt.Sprintf("%s %d fixed", Edit, postedID))
+	builds.expectContent(NoPermission)
+	builds.send(History + " 2")
+	history := builds.expect("history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory
+	})
+	if history.UserName != "builds" || history.Integration != "ci" {
+		t.Errorf("history msg = %+v", history)
+	}
+}
@@ -0,0 +1,87 @@
+package logic
+
+import (
+	"strings"
+)
+
+func (um *UserManage) roomStoredLogic(msg *UserRoomStoredMsg) {
+	now := um.s.now()
+
+	// 记录发言统计
+	if sender := um.users[msg.Msg.UserName]; sender != nil && msg.Msg.Integration == "" && !msg.Remote {
+		sender.addRoomMsg(msg.RoomID, msg.Msg.MsgTime)
+	}
+
+	// 给离线的房间成员留言
+	um.queueRoomOffline(msg.RoomID, msg.Msg, now)
+
+	// @提醒，不管在不在同一个房间
+	for _, name := range msg.Mentions {
+		user := um.users[name]
+		if user == nil {
+			continue
+		}
+
+		mentionMsg := *msg.Msg
+		mentionMsg.Type = MsgTypeMention
+		mentionMsg.ToUser = user.Name
+		user.addMention(&mentionMsg)
+
+		if user.Status != StatusOnline {
+			um.queueInbox(user, &mentionMsg, now)
+			continue
+		}
+		um.pushToUser(user, &mentionMsg)
+	}
+}
+
+func (um *UserManage) mentionsLogic(msg *UserMentionsMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
+		return
+	}
+	user := um.users[userName]
+	if user == nil {
+		return
+	}
+	if len(user.Mentions) == 0 {
+		um.sendSingleMsg(msg.ConnID, MentionEmpty)
+		return
+	}
+
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, msg.ConnID)
+	pushToOtherMsg := make([]*BaseMsg, 0, len(user.Mentions))
+	pushToOtherMsg = append(pushToOtherMsg, user.Mentions...)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	um.s.msgManage.pushMsgChan <- pushMsg
+}
+
+// addMention 只保留最近MentionMaxNum条
+func (u *User) addMention(mentionMsg *BaseMsg) {
+	u.Mentions = append(u.Mentions, mentionMsg)
+	if len(u.Mentions) > MentionMaxNum {
+		u.Mentions = append([]*BaseMsg(nil), u.Mentions[len(u.Mentions)-MentionMaxNum:]...)
+	}
+}
+
+// parseMentions 找出消息里@到的用户名，去重并保持顺序
+func parseMentions(content string) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(content) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], ".,!?;:)")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,28 @@
+package logic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseMentions(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"none", "hello world", []string{}},
+		{"single", "hi @alice", []string{"alice"}},
+		{"punctuation", "@alice, @bob! are you there?", []string{"alice", "bob"}},
+		{"duplicate", "@alice @alice", []string{"alice"}},
+		{"bare_at", "@ alone", []string{}},
+		{"email_not_mention", "mail bob@example.com", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMentions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 内置中间件
+const (
+	MiddlewareValidate  = "validate"  // 空消息、过长、控制字符
+	MiddlewareProfanity = "profanity" // 脏词替换成*
+	MiddlewareSpam      = "spam"      // 短时间内发太多
+	MiddlewareUnfurl    = "unfurl"    // 标注消息里的链接
+)
+
+// DefaultMsgMiddleware Config.MsgMiddleware没设置时启用的中间件，自己拼的Config也会过滤脏词
+var DefaultMsgMiddleware = []string{MiddlewareValidate, MiddlewareProfanity, MiddlewareUnfurl}
+
+// AnnotationLinks unfurl标注的链接域名，逗号分隔
+const AnnotationLinks = "links"
+
+var (
+	errMsgInvalid = errors.New(MsgInvalid)
+	errMsgSpam    = errors.New(MsgSpam)
+)
+
+// InboundMsg 进入房间前的一条聊天消息，中间件可以改Content、加标注，返回错误则拒绝
+type InboundMsg struct {
+	um *UserManage // 发送人所在的用户分片
+
+	ConnID      int
+	UserName    string
+	RoomID      int
+	Content     string
+	ParentID    int64
+	Time        int64
+	Annotations map[string]string
+	Integration string // 集成通过HTTP接口发的消息，ConnID为0
+}
+
+// Annotate 给消息加一个标注，跟着消息存进房间、推给客户端
+func (m *InboundMsg) Annotate(key string, value string) {
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+	m.Annotations[key] = value
+}
+
+// InboundFunc 在用户管理协程里执行，返回的错误内容会回复给发送人，消息丢弃
+type InboundFunc func(msg *InboundMsg) error
+
+// OutboundFunc 在消息管理协程里执行，推给每个连接前调用。
+// 同一条消息会推给多个连接，要修改先拷贝一份再返回；返回nil则这个连接收不到
+type OutboundFunc func(connID int, msg *BaseMsg) *BaseMsg
+
+// Middleware 一个中间件，Inbound和Outbound可以只有一个
+type Middleware struct {
+	Name     string
+	Inbound  InboundFunc
+	Outbound OutboundFunc
+}
+
+// middlewareRegistry 中间件表，Start时按配置算好每个房间的顺序，之后只读
+type middlewareRegistry struct {
+	middlewares map[string]*Middleware
+	rooms       map[int][]*Middleware
+	outbound    bool // 有房间启用了出站中间件
+}
+
+func newMiddlewareRegistry() *middlewareRegistry {
+	mr := &middlewareRegistry{
+		middlewares: make(map[string]*Middleware),
+		rooms:       make(map[int][]*Middleware),
+	}
+	for _, m := range builtinMiddlewares() {
+		if err := mr.register(m); err != nil {
+			panic(err)
+		}
+	}
+	return mr
+}
+
+func builtinMiddlewares() []*Middleware {
+	return []*Middleware{
+		{Name: MiddlewareValidate, Inbound: validateInbound},
+		{Name: MiddlewareProfanity, Inbound: profanityInbound},
+		{Name: MiddlewareSpam, Inbound: spamInbound},
+		{Name: MiddlewareUnfurl, Inbound: unfurlInbound},
+	}
+}
+
+func (mr *middlewareRegistry) register(m *Middleware) error {
+	if m.Name == "" {
+		return errors.New("middleware name is empty")
+	}
+	if m.Inbound == nil && m.Outbound == nil {
+		return fmt.Errorf("middleware %s has no inbound or outbound func", m.Name)
+	}
+	if _, ok := mr.middlewares[m.Name]; ok {
+		return fmt.Errorf("middleware %s already registered", m.Name)
+	}
+	mr.middlewares[m.Name] = m
+	return nil
+}
+
+// build 房间有单独配置的用单独配置，否则用默认的
+func (mr *middlewareRegistry) build(config *Config) {
+	mr.outbound = false
+	for roomID := 0; roomID < RoomNum; roomID++ {
+		names, ok := config.RoomMiddleware[roomID]
+		if !ok {
+			names = config.MsgMiddleware
+		}
+		if names == nil {
+			names = DefaultMsgMiddleware
+		}
+
+		chain := make([]*Middleware, 0, len(names))
+		for _, name := range names {
+			m := mr.middlewares[name]
+			if m == nil {
+				log.Printf("room %d unknown middleware %s", roomID, name)
+				continue
+			}
+			chain = append(chain, m)
+			if m.Outbound != nil {
+				mr.outbound = true
+			}
+		}
+		mr.rooms[roomID] = chain
+	}
+}
+
+// inbound 依次执行，第一个错误就停下
+func (mr *middlewareRegistry) inbound(msg *InboundMsg) error {
+	for _, m := range mr.rooms[msg.RoomID] {
+		if m.Inbound == nil {
+			continue
+		}
+		if err := m.Inbound(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboundMsgs 过滤推给一个连接的消息，按消息所在房间的配置。不属于房间的消息不经过
+func (mr *middlewareRegistry) outboundMsgs(connID int, pushMsg []*BaseMsg) []*BaseMsg {
+	result := make([]*BaseMsg, 0, len(pushMsg))
+	for _, baseMsg := range pushMsg {
+		if !baseMsg.inRoom() {
+			result = append(result, baseMsg)
+			continue
+		}
+		for _, m := range mr.rooms[baseMsg.RoomID] {
+			if m.Outbound == nil {
+				continue
+			}
+			if baseMsg = m.Outbound(connID, baseMsg); baseMsg == nil {
+				break
+			}
+		}
+		if baseMsg != nil {
+			result = append(result, baseMsg)
+		}
+	}
+	return result
+}
+
+// inRoom 房间里的消息和事件。系统通知、公告、私聊、回执和统计的RoomID是0，不代表房间0
+func (m *BaseMsg) inRoom() bool {
+	switch m.Type {
+	case MsgTypeChat, MsgTypeJoin, MsgTypeLeave, MsgTypeHistory, MsgTypeSearch, MsgTypeEdit,
+		MsgTypeDelete, MsgTypeReaction, MsgTypeMention, MsgTypeTyping, MsgTypePopular:
+		return true
+	}
+	return false
+}
+
+// RegisterMiddleware 注册中间件，要在Start之前调用。
+// 注册后还要在Config.MsgMiddleware或RoomMiddleware里写上名字才会启用
+func (s *Service) RegisterMiddleware(m *Middleware) error {
+	return s.middlewareRegistry().register(m)
+}
+
+func (s *Service) middlewareRegistry() *middlewareRegistry {
+	if s.middlewares == nil {
+		s.middlewares = newMiddlewareRegistry()
+	}
+	return s.middlewares
+}
+
+func validateInbound(msg *InboundMsg) error {
+	if strings.TrimSpace(msg.Content) == "" || utf8.RuneCountInString(msg.Content) > MsgMaxLen {
+		return errMsgInvalid
+	}
+	// 控制字符会弄乱别人的终端
+	msg.Content = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' {
+			return -1
+		}
+		return r
+	}, msg.Content)
+	return nil
+}
+
+func profanityInbound(msg *InboundMsg) error {
+	msg.Content = msg.um.filterBadWords(msg.Content)
+	return nil
+}
+
+// spamInbound 发送时间记在用户身上，窗口内超过条数就拒绝。集成不算在同名用户身上
+func spamInbound(msg *InboundMsg) error {
+	user := msg.um.users[msg.UserName]
+	if user == nil || msg.Integration != "" {
+		return nil
+	}
+
+	recent := user.RecentMsgTimes[:0]
+	for _, msgTime := range user.RecentMsgTimes {
+		if msg.Time-msgTime < SpamWindowSecond {
+			recent = append(recent, msgTime)
+		}
+	}
+	user.RecentMsgTimes = recent
+	if len(recent) >= SpamMsgNum {
+		return errMsgSpam
+	}
+	user.RecentMsgTimes = append(user.RecentMsgTimes, msg.Time)
+	return nil
+}
+
+// unfurlInbound 只标注域名，不去抓网页，避免卡住用户协程
+func unfurlInbound(msg *InboundMsg) error {
+	hosts := make([]string, 0)
+	for _, word := range strings.Fields(msg.Content) {
+		if !strings.HasPrefix(word, "http://") && !strings.HasPrefix(word, "https://") {
+			continue
+		}
+		link, err := url.Parse(word)
+		if err != nil || link.Host == "" {
+			continue
+		}
+		hosts = append(hosts, link.Host)
+	}
+	if len(hosts) > 0 {
+		msg.Annotate(AnnotationLinks, strings.Join(hosts, ","))
+	}
+	return nil
+}
+
+func cloneAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	annotationsCopy := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		annotationsCopy[key] = value
+	}
+	return annotationsCopy
+}
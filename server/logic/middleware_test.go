@@ -0,0 +1,194 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_builtin(t *testing.T) {
+	msg := &InboundMsg{Content: "hi\x1b[31m there"}
+	if err := validateInbound(msg); err != nil || msg.Content != "hi[31m there" {
+		t.Errorf("validate = %q, err %v", msg.Content, err)
+	}
+	for _, content := range []string{"", "   ", strings.Repeat("a", MsgMaxLen+1)} {
+		if err := validateInbound(&InboundMsg{Content: content}); err != errMsgInvalid {
+			t.Errorf("validate %d chars err = %v", len(content), err)
+		}
+	}
+
+	msg = &InboundMsg{Content: "see https://example.com/a and http://go.dev ftp://x.org"}
+	if err := unfurlInbound(msg); err != nil || msg.Annotations[AnnotationLinks] != "example.com,go.dev" {
+		t.Errorf("unfurl annotations = %v, err %v", msg.Annotations, err)
+	}
+	msg = &InboundMsg{Content: "no links"}
+	if unfurlInbound(msg); msg.Annotations != nil {
+		t.Errorf("unfurl without links = %v", msg.Annotations)
+	}
+}
+
+func TestMiddlewareRegistry_build(t *testing.T) {
+	// 自己拼的Config没写MsgMiddleware也用默认的，空列表才是都不启用
+	mr := newMiddlewareRegistry()
+	mr.build(&Config{MsgMiddleware: nil, RoomMiddleware: map[int][]string{3: {}}})
+	names := func(roomID int) string {
+		chain := make([]string, 0)
+		for _, m := range mr.rooms[roomID] {
+			chain = append(chain, m.Name)
+		}
+		return strings.Join(chain, ",")
+	}
+	if got := names(0); got != strings.Join(DefaultMsgMiddleware, ",") {
+		t.Errorf("room 0 middleware = %s", got)
+	}
+	if got := names(3); got != "" {
+		t.Errorf("room 3 middleware = %s, want none", got)
+	}
+}
+
+func TestMiddleware_spam(t *testing.T) {
+	um := &UserManage{users: map[string]*User{"alice": {Name: "alice"}}}
+	send := func(now int64) error {
+		return spamInbound(&InboundMsg{um: um, UserName: "alice", Time: now})
+	}
+	for i := 0; i < SpamMsgNum; i++ {
+		if err := send(100); err != nil {
+			t.Fatalf("msg %d err %v", i, err)
+		}
+	}
+	if err := send(100 + SpamWindowSecond - 1); err != errMsgSpam {
+		t.Errorf("over limit err = %v", err)
+	}
+	if err := send(100 + SpamWindowSecond); err != nil {
+		t.Errorf("after window err = %v", err)
+	}
+}
+
+func TestHarness_middleware(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	config.RoomMiddleware = map[int][]string{
+		2: {MiddlewareValidate, "noshout", "tag", MiddlewareSpam},
+		3: {"upper"},
+		0: {"mute"},
+	}
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	s := &Service{Config: config, Clock: clock}
+
+	middlewares := []*Middleware{
+		{
+			Name: "noshout",
+			Inbound: func(msg *InboundMsg) error {
+				if msg.Content == strings.ToUpper(msg.Content) && strings.ToUpper(msg.Content) != strings.ToLower(msg.Content) {
+					return errors.New("Notify:NoShouting")
+				}
+				return nil
+			},
+		},
+		{
+			Name: "tag",
+			Inbound: func(msg *InboundMsg) error {
+				msg.Content = "[" + msg.UserName + "] " + msg.Content
+				msg.Annotate("room", "two")
+				return nil
+			},
+		},
+		{
+			Name: "upper",
+			Outbound: func(connID int, msg *BaseMsg) *BaseMsg {
+				if msg.Type != MsgTypeChat {
+					return msg
+				}
+				if msg.Content == "secret" {
+					return nil
+				}
+				msgCopy := *msg
+				msgCopy.Content = strings.ToUpper(msg.Content)
+				return &msgCopy
+			},
+		},
+		{
+			// 房间0的消息都不推，不在房间里的消息不受影响
+			Name: "mute",
+			Outbound: func(connID int, msg *BaseMsg) *BaseMsg {
+				return nil
+			},
+		},
+	}
+	for _, m := range middlewares {
+		if err := s.RegisterMiddleware(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RegisterMiddleware(&Middleware{Name: MiddlewareSpam, Inbound: spamInbound}); err == nil {
+		t.Errorf("duplicate middleware should fail")
+	}
+	s.Start()
+	t.Cleanup(s.Stop)
+	h := &testHarness{t: t, s: s, clock: clock}
+
+	// 房间2：拒绝、改写、标注、限流
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	alice.send("HELLO")
+	alice.expectContent("Notify:NoShouting")
+	alice.send("hi http://example.com")
+	chatMsg := alice.expectChat("alice", "[alice] hi http://example.com")
+	if chatMsg.Annotations["room"] != "two" || chatMsg.Annotations[AnnotationLinks] != "" {
+		t.Errorf("annotations = %v", chatMsg.Annotations)
+	}
+
+	// 编辑也经过房间的中间件
+	alice.send(fmt.Sprintf("%s %d LOUD", Edit, chatMsg.MsgID))
+	alice.expectContent("Notify:NoShouting")
+	alice.send(fmt.Sprintf("%s %d fixed\x07 link", Edit, chatMsg.MsgID))
+	editMsg := alice.expect("edit", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeEdit
+	})
+	if editMsg.Content != "[alice] fixed link" || editMsg.Annotations["room"] != "two" {
+		t.Errorf("edit = %q annotations %v", editMsg.Content, editMsg.Annotations)
+	}
+
+	// 编辑也算一次发言，等窗口过去再测限流
+	h.clock.Advance(SpamWindowSecond * time.Second)
+	for i := 0; i < SpamMsgNum; i++ {
+		alice.send("again")
+		alice.expectChat("alice", "[alice] again")
+	}
+	alice.send("again")
+	alice.expectContent(MsgSpam)
+
+	// 房间3：只有出站中间件，存的还是原文
+	bob := h.login("bob")
+	bob.joinRoom(3)
+	bob.send("secret")
+	bob.send("quiet words")
+	bob.expectChat("bob", "QUIET WORDS")
+	bob.send(History + " 3")
+	history := bob.expect("history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory
+	})
+	if history.Content != "secret" {
+		t.Errorf("first history msg = %q, want stored original", history.Content)
+	}
+
+	// 默认配置的房间照常标注链接
+	carol := h.login("carol")
+	carol.joinRoom(4)
+	chatMsg = carol.say("look https://go.dev/doc")
+	if chatMsg.Annotations[AnnotationLinks] != "go.dev" {
+		t.Errorf("default room annotations = %v", chatMsg.Annotations)
+	}
+
+	// 登录回复和私聊的RoomID是0，不经过房间0的中间件
+	carol.send(Direct + " bob psst")
+	bob.expect("direct", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDirect && baseMsg.Content == "psst"
+	})
+	carol.send(Who + " 0")
+	carol.expectContent("room 0: ")
+}
@@ -2,7 +2,6 @@ package logic
 
 import (
 	"log"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -14,7 +13,13 @@ type MsgManage struct {
 	pushMsgChan    chan *PushMsg // 推送给玩家的消息
 
 	connMsgDealChan chan *ConnChanMsg         // 注册conn对应的channel
+	connMsgDelChan  chan int                  // 注销conn对应的channel
 	sendUserMsgChan map[int]chan *PushConnMsg // 发送给conn的channel
+	broadcastChan   chan *BroadcastMsg        // 全服广播
+	connLoginChan   chan *ConnLoginMsg        // 连接登录登出
+	commandRunChan  chan *CommandCtx          // 房间确认过权限的命令
+	connUsers       map[int]string            // 连接对应的登录名，检查命令权限
+	connLogins      map[int]bool              // 发了/name还没有结果的连接
 
 	wg        sync.WaitGroup
 	closeChan chan bool
@@ -26,6 +31,12 @@ func (mm *MsgManage) init(s *Service) {
 	mm.pushMsgChan = make(chan *PushMsg, 1024)
 	mm.sendUserMsgChan = make(map[int]chan *PushConnMsg)
 	mm.connMsgDealChan = make(chan *ConnChanMsg, 1024)
+	mm.connMsgDelChan = make(chan int, 1024)
+	mm.broadcastChan = make(chan *BroadcastMsg, 64)
+	mm.connLoginChan = make(chan *ConnLoginMsg, 1024)
+	mm.commandRunChan = make(chan *CommandCtx, 64)
+	mm.connUsers = make(map[int]string)
+	mm.connLogins = make(map[int]bool)
 	mm.closeChan = make(chan bool, 1)
 }
 func (mm *MsgManage) Start(s *Service) {
@@ -47,12 +58,26 @@ func (mm *MsgManage) msgDeal() {
 		case connChanMsg := <-mm.connMsgDealChan:
 			// 注册新连接的消息通道
 			mm.sendUserMsgChan[connChanMsg.ConnID] = connChanMsg.SendChan
+		case connID := <-mm.connMsgDelChan:
+			// 注销断开连接的消息通道
+			delete(mm.sendUserMsgChan, connID)
+			delete(mm.connUsers, connID)
+			delete(mm.connLogins, connID)
 		case receiveMsg := <-mm.receiveMsgChan:
 			// 根据收到的消息做不同处理
 			mm.msgLogic(receiveMsg)
 		case pushMsg := <-mm.pushMsgChan:
 			// 推送给客户端的消息
 			mm.pushMsgToConn(pushMsg)
+		case broadcastMsg := <-mm.broadcastChan:
+			// 推送给所有连接的消息
+			mm.broadcastLogic(broadcastMsg)
+		case connLoginMsg := <-mm.connLoginChan:
+			// 连接登录登出
+			mm.connLoginLogic(connLoginMsg)
+		case ctx := <-mm.commandRunChan:
+			// 房间确认过是管理员的命令
+			ctx.cmd.Handler(ctx)
 		case <-mm.closeChan:
 			return
 		}
@@ -66,101 +91,64 @@ func (mm *MsgManage) pushMsgToConn(msg *PushMsg) {
 	log.Printf("send to user %v msg %v", msg.ConnID, msg.PushMsg)
 	// 发送给对应的玩家
 	for _, connID := range msg.ConnID {
-		if sendChan, ok := mm.sendUserMsgChan[connID]; ok {
-			sendChan <- connMsg
+		sendChan, ok := mm.sendUserMsgChan[connID]
+		if !ok {
+			continue
 		}
+		// 有出站中间件时每个连接单独过一遍
+		if mm.s.middlewares.outbound {
+			pushMsg := mm.s.middlewares.outboundMsgs(connID, msg.PushMsg)
+			if len(pushMsg) == 0 {
+				continue
+			}
+			sendChan <- &PushConnMsg{PushConnMsg: pushMsg}
+			continue
+		}
+		sendChan <- connMsg
 	}
 }
 
-func (mm *MsgManage) msgLogic(msg *ConnMsg) {
-	// 检查是否是特殊处理消息
-	isGM := mm.msgCommand(msg)
-	if isGM {
+func (mm *MsgManage) broadcastLogic(msg *BroadcastMsg) {
+	// 指定房间的交给房间管理推送给房间内的人
+	if len(msg.RoomIDs) > 0 {
+		for _, roomID := range msg.RoomIDs {
+			mm.s.roomShard(roomID).roomNoticeChan <- &RoomNoticeMsg{
+				RoomID:  roomID,
+				Type:    msg.Type,
+				Content: msg.Content,
+			}
+		}
 		return
 	}
 
-	// 直接发给user处理
-	userSendMsg := &UserSendMsg{
-		ConnID:  msg.ConnID,
-		Content: msg.Content,
+	connIDs := make([]int, 0, len(mm.sendUserMsgChan))
+	for connID := range mm.sendUserMsgChan {
+		connIDs = append(connIDs, connID)
 	}
-	mm.s.userManage.userSendMsgChan <- userSendMsg
+	pushMsg := make([]*BaseMsg, 0)
+	pushMsg = append(pushMsg, &BaseMsg{
+		Type:    msg.Type,
+		Content: msg.Content,
+	})
+	mm.pushMsgToConn(&PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushMsg,
+	})
 }
 
-func (mm *MsgManage) msgCommand(msg *ConnMsg) bool {
-	msgArr := strings.Split(msg.Content, " ")
-	if len(msgArr) < 2 {
-		return false
+func (mm *MsgManage) msgLogic(msg *ConnMsg) {
+	// 斜杠开头的是命令
+	if strings.HasPrefix(msg.Content, "/") {
+		mm.commandLogic(msg)
+		return
 	}
-	switch msgArr[0] {
-	// 获取用户信息
-	case Stats:
-		userName := msgArr[1]
-		if userName == "" {
-			return true
-		}
-		userStatMsg := &UserStatsMsg{
-			Name:   userName,
-			ConnID: msg.ConnID,
-		}
-		mm.s.userManage.userStatMsgChan <- userStatMsg
-		return true
-	// 获取房间内最高频率单词
-	case Popular:
-		roomID, err := strconv.Atoi(msgArr[1])
-		if err != nil {
-			log.Printf("popular room id %s atoi err %s", msgArr[1], err.Error())
-			return true
-		}
-		roomPopularMsg := &RoomPopularMsg{
-			RoomID: roomID,
-			ConnID: msg.ConnID,
-		}
-		mm.s.roomManage.roomPopularChan <- roomPopularMsg
-		return true
-	// 取名
-	case Name:
-		userName := msgArr[1]
-		if userName == "" {
-			return true
-		}
-
-		userNameMsg := &UserNameMsg{
-			Name:   userName,
-			ConnID: msg.ConnID,
-		}
-		mm.s.userManage.userNameMsgChan <- userNameMsg
-		return true
-	// 切换房间
-	case ChangeRoom:
-		roomID, err := strconv.Atoi(msgArr[1])
-		if err != nil {
-			log.Printf("choose room id %s atoi err %s", msgArr[1], err.Error())
-			mm.sendToUserMsg(msg.ConnID, RoomIDErr)
-			return true
-		}
-
-		// roomID越界
-		if roomID < 0 || roomID > RoomNum-1 {
-			mm.sendToUserMsg(msg.ConnID, RoomIDErr)
-			return true
-		}
 
-		userRoomMsg := &UserRoomMsg{
-			RoomID: roomID,
-			ConnID: msg.ConnID,
-		}
-		mm.s.userManage.userRoomMsgChan <- userRoomMsg
-		return true
-	// 登出
-	case Logout:
-		userMsg := &UserLogoutMsg{
-			ConnID: msg.ConnID,
-		}
-		mm.s.userManage.userLogoutMsgChan <- userMsg
+	// 直接发给user处理
+	userSendMsg := &UserSendMsg{
+		ConnID:  msg.ConnID,
+		Content: msg.Content,
 	}
-
-	return false
+	mm.s.userShard(mm.connUsers[msg.ConnID]).userSendMsgChan <- userSendMsg
 }
 
 func (mm *MsgManage) sendToUserMsg(connID int, content string) {
@@ -168,6 +156,7 @@ func (mm *MsgManage) sendToUserMsg(connID int, content string) {
 	connIDs = append(connIDs, connID)
 	pushMsg := make([]*BaseMsg, 0)
 	pushMsg = append(pushMsg, &BaseMsg{
+		Type:    MsgTypeSystem,
 		Content: content,
 	})
 	mm.pushMsgChan <- &PushMsg{
@@ -0,0 +1,220 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawClient 直接连聊天端口，按顺序发命令、等回复
+type rawClient struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *json.Decoder
+	pending []*BaseMsg
+}
+
+func dialRaw(t *testing.T, s *Service) *rawClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn, decoder: json.NewDecoder(conn)}
+}
+
+// loginRaw 连接、登录并进入房间，roomID为0不进房间
+func loginRaw(t *testing.T, s *Service, name string, roomID int) *rawClient {
+	t.Helper()
+	c := dialRaw(t, s)
+	c.send(Name + " " + name)
+	c.expectContent(LoginSuccess)
+	if roomID != 0 {
+		c.send(fmt.Sprintf("%s %d", ChangeRoom, roomID))
+		c.expectContent(JoinRoomSuccess)
+	}
+	return c
+}
+
+// send 一次写一条，等到回复再发下一条，避免两条粘在一起
+func (c *rawClient) send(content string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(content)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect 等到第一条满足条件的消息，之前收到的都丢掉
+func (c *rawClient) expect(desc string, match func(*BaseMsg) bool) *BaseMsg {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		for len(c.pending) > 0 {
+			baseMsg := c.pending[0]
+			c.pending = c.pending[1:]
+			if match(baseMsg) {
+				return baseMsg
+			}
+		}
+		pushMsg := &PushConnMsg{}
+		if err := c.decoder.Decode(pushMsg); err != nil {
+			c.t.Fatalf("waiting for %s: %v", desc, err)
+		}
+		c.pending = pushMsg.PushConnMsg
+	}
+}
+
+func (c *rawClient) expectContent(content string) *BaseMsg {
+	c.t.Helper()
+	return c.expect(fmt.Sprintf("content %q", content), func(baseMsg *BaseMsg) bool {
+		return baseMsg.Content == content
+	})
+}
+
+// waitConns 等到连接都注册好
+func waitConns(t *testing.T, s *Service, num int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		connInfos, err := s.adminManage.queryConns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(connInfos) == num {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("conns = %d, want %d", len(connInfos), num)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMsgManage_broadcast(t *testing.T) {
+	s := startAdminService(t)
+	alice := loginRaw(t, s, "alice", 1)
+	bob := loginRaw(t, s, "bob", 2)
+	guest := dialRaw(t, s)
+	waitConns(t, s, 3)
+
+	post := func(body string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.adminManage.broadcastHandler(w, httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(body)))
+		return w.Code
+	}
+	isAnnounce := func(content string) func(*BaseMsg) bool {
+		return func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeAnnounce && baseMsg.Content == content
+		}
+	}
+
+	// 不带房间推给所有连接，没登录的也收到
+	if code := post(`{"content": "maintenance at 10"}`); code != http.StatusOK {
+		t.Fatalf("broadcast code = %d", code)
+	}
+	for _, c := range []*rawClient{guest, alice, bob} {
+		announce := c.expect("server announce", isAnnounce("maintenance at 10"))
+		if announce.UserName != "" {
+			t.Errorf("announce from %q", announce.UserName)
+		}
+	}
+
+	// 指定房间只推给房间里的人
+	if code := post(`{"content": "room one only", "rooms": [1]}`); code != http.StatusOK {
+		t.Fatalf("room broadcast code = %d", code)
+	}
+	alice.expect("room announce", isAnnounce("room one only"))
+	if code := post(`{"content": "room two", "rooms": [2]}`); code != http.StatusOK {
+		t.Fatalf("room broadcast code = %d", code)
+	}
+	bob.expect("room two announce", func(baseMsg *BaseMsg) bool {
+		if baseMsg.Content == "room one only" {
+			t.Error("bob got the announce for room 1")
+		}
+		return isAnnounce("room two")(baseMsg)
+	})
+
+	for _, body := range []string{`{"content": ""}`, `{"content": "x", "rooms": [10]}`, `not json`} {
+		if code := post(body); code != http.StatusBadRequest {
+			t.Errorf("broadcast %s code = %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRoomManage_whoAndRooms(t *testing.T) {
+	s := startAdminService(t)
+	alice := loginRaw(t, s, "alice", 1)
+	bob := loginRaw(t, s, "bob", 1)
+	carol := loginRaw(t, s, "carol", 0)
+
+	// 按进房间的先后排
+	bob.send(Who)
+	bob.expectContent("room 1: alice(active) bob(active)")
+	bob.send(fmt.Sprintf("%s %d", Who, 3))
+	bob.expectContent("room 3: ")
+	bob.send(fmt.Sprintf("%s %d", Who, RoomNum))
+	bob.expectContent(RoomIDErr)
+
+	// 不在房间里查自己所在的房间
+	carol.send(Who)
+	carol.expectContent(RoomIDErr)
+
+	carol.send(Rooms)
+	rooms := carol.expect("rooms", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "room 0: ")
+	})
+	lines := strings.Split(rooms.Content, "\n")
+	if len(lines) != RoomNum || lines[0] != "room 0: 0 users" || lines[1] != "room 1: 2 users" {
+		t.Errorf("rooms = %q", rooms.Content)
+	}
+
+	alice.send(fmt.Sprintf("%s %d", ChangeRoom, 2))
+	alice.expectContent(JoinRoomSuccess)
+	carol.send(Rooms)
+	rooms = carol.expect("rooms", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "room 0: ")
+	})
+	if lines := strings.Split(rooms.Content, "\n"); lines[1] != "room 1: 1 users" || lines[2] != "room 2: 1 users" {
+		t.Errorf("rooms after switch = %q", rooms.Content)
+	}
+}
+
+func TestRoomManage_joinLeave(t *testing.T) {
+	s := startAdminService(t)
+	alice := loginRaw(t, s, "alice", 1)
+	carol := loginRaw(t, s, "carol", 2)
+	isMember := func(msgType int, userName string) func(*BaseMsg) bool {
+		return func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == msgType && baseMsg.UserName == userName
+		}
+	}
+
+	// 进出房间推给房间里的其他人，带上是谁、哪个房间
+	bob := loginRaw(t, s, "bob", 1)
+	join := alice.expect("bob join", isMember(MsgTypeJoin, "bob"))
+	if join.RoomID != 1 || join.Content != fmt.Sprintf(UserJoinRoom, "bob") {
+		t.Errorf("join = %+v", join)
+	}
+	bob.send("hello")
+	chat := alice.expectContent("hello")
+	if chat.Type != MsgTypeChat || chat.UserName != "bob" {
+		t.Errorf("chat = %+v", chat)
+	}
+
+	// 换房间时旧房间收到离开，新房间收到加入
+	bob.send(fmt.Sprintf("%s %d", ChangeRoom, 2))
+	leave := alice.expect("bob leave", isMember(MsgTypeLeave, "bob"))
+	if leave.RoomID != 1 || leave.Content != fmt.Sprintf(UserLeaveRoom, "bob") {
+		t.Errorf("leave = %+v", leave)
+	}
+	if join := carol.expect("bob join", isMember(MsgTypeJoin, "bob")); join.RoomID != 2 {
+		t.Errorf("join = %+v", join)
+	}
+}
@@ -0,0 +1,145 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+func (um *UserManage) nickLogic(msg *UserNickMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
+		return
+	}
+	user := um.users[userName]
+	if user == nil {
+		return
+	}
+
+	if !um.validName(msg.Name) {
+		um.sendSingleMsg(msg.ConnID, NameInvalid)
+		return
+	}
+	if !um.s.userNames.claim(msg.Name, user.Name) {
+		um.sendSingleMsg(msg.ConnID, NameRepeat)
+		return
+	}
+	if msg.Name != user.Name {
+		um.publishName(msg.Name, user.Name, true)
+	}
+	// 换掉的昵称放出来给别人用
+	if user.DisplayName != "" && !strings.EqualFold(user.DisplayName, msg.Name) {
+		um.s.userNames.release(user.DisplayName, user.Name)
+		um.publishName(user.DisplayName, user.Name, false)
+	}
+
+	// 改回登录名相当于清掉昵称
+	oldName := user.displayName()
+	if msg.Name == user.Name {
+		user.DisplayName = ""
+	} else {
+		user.DisplayName = msg.Name
+	}
+	um.sendSingleMsg(msg.ConnID, NickSuccess)
+
+	if oldName == user.displayName() || user.RoomID == 0 {
+		return
+	}
+
+	// 通知所在房间
+	um.s.roomShard(user.RoomID).roomRenameChan <- &RoomRenameMsg{
+		ConnID:      msg.ConnID,
+		UserName:    user.Name,
+		OldName:     oldName,
+		DisplayName: user.DisplayName,
+	}
+}
+
+func (um *UserManage) profileLogic(msg *UserProfileMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
+		return
+	}
+	user := um.users[userName]
+	if user == nil {
+		return
+	}
+
+	switch msg.Field {
+	case ProfileStatus:
+		if utf8.RuneCountInString(msg.Value) > ProfileStatusMaxLen {
+			um.sendSingleMsg(msg.ConnID, ProfileArgErr)
+			return
+		}
+		user.StatusText = um.filterBadWords(msg.Value)
+	case ProfileTimezone:
+		// 为空恢复成服务器时区
+		if msg.Value != "" {
+			if _, err := time.LoadLocation(msg.Value); err != nil {
+				um.sendSingleMsg(msg.ConnID, ProfileArgErr)
+				return
+			}
+		}
+		user.Timezone = msg.Value
+	default:
+		um.sendSingleMsg(msg.ConnID, ProfileArgErr)
+		return
+	}
+	um.sendSingleMsg(msg.ConnID, ProfileSuccess)
+}
+
+// validName 用户名和昵称只允许字母数字下划线和横线，不能带脏词
+func (um *UserManage) validName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > NameMaxLen {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	for _, word := range um.badWords {
+		if word != "" && strings.Contains(name, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *User) displayName() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Name
+}
+
+func (rm *RoomManage) roomRenameLogic(msg *RoomRenameMsg) {
+	room := rm.connRoom(msg.ConnID)
+	if room == nil {
+		return
+	}
+	// 多端登录时房间里有多个连接
+	for _, member := range room.Users {
+		if member.UserName == msg.UserName {
+			member.DisplayName = msg.DisplayName
+		}
+	}
+
+	newName := msg.DisplayName
+	if newName == "" {
+		newName = msg.UserName
+	}
+	baseMsg := &BaseMsg{
+		Type:        MsgTypeSystem,
+		UserName:    msg.UserName,
+		RoomID:      room.RoomID,
+		Content:     fmt.Sprintf(UserRename, msg.OldName, newName),
+		DisplayName: msg.DisplayName,
+	}
+	rm.pushToRoom(room, 0, baseMsg)
+
+	baseMsgCopy := *baseMsg
+	rm.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneRoomPush, Msg: &baseMsgCopy})
+}
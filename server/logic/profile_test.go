@@ -0,0 +1,67 @@
+package logic
+
+import "testing"
+
+func TestUserManage_validName(t *testing.T) {
+	um := &UserManage{badWords: []string{"damn"}}
+	tests := []struct {
+		name string
+		arg  string
+		want bool
+	}{
+		{"simple", "alice", true},
+		{"digits_and_marks", "bob_2-x", true},
+		{"unicode_letters", "小明", true},
+		{"empty", "", false},
+		{"space", "al ice", false},
+		{"symbol", "alice!", false},
+		{"too_long", "abcdefghijklmnopqrstu", false},
+		{"bad_word", "damnit", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := um.validName(tt.arg); got != tt.want {
+				t.Errorf("validName(%q) = %v, want %v", tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserNames_claim(t *testing.T) {
+	names := &userNames{}
+	for _, claim := range [][2]string{{"alice", "alice"}, {"Queen", "alice"}, {"bob", "bob"}} {
+		if !names.claim(claim[0], claim[1]) {
+			t.Fatalf("claim(%q, %q) failed", claim[0], claim[1])
+		}
+	}
+
+	tests := []struct {
+		name  string
+		arg   string
+		owner string
+		want  bool
+	}{
+		{"other_login_name", "ALICE", "bob", false},
+		{"other_display_name", "queen", "bob", false},
+		{"own_names", "queen", "alice", true},
+		{"free", "carol", "bob", true},
+		{"new_user", "Bob", "Bob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := names.claim(tt.arg, tt.owner); got != tt.want {
+				t.Errorf("claim(%q, %q) = %v, want %v", tt.arg, tt.owner, got, tt.want)
+			}
+		})
+	}
+
+	// 换掉的昵称可以被别人用，登录名放不掉
+	names.release("QUEEN", "alice")
+	names.release("alice", "alice")
+	if !names.claim("queen", "bob") || names.claim("alice", "bob") {
+		t.Errorf("release should free the nick but keep the login name")
+	}
+	if !names.isUser("alice") || names.isUser("Alice") || names.isUser("queen") {
+		t.Errorf("isUser should match login names exactly")
+	}
+}
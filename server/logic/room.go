@@ -1,36 +1,78 @@
 package logic
 
 import (
+	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"sync"
-	"time"
 )
 
+// RoomManage 管理一个分片里的房间
 type RoomManage struct {
-	s *Service
-
-	Rooms map[int]*Room
-
-	roomChangeChan     chan *RoomChangeMsg  // 切换房间
-	roomReceiveMsgChan chan *RoomReceiveMsg // 房间聊天
-	roomPopularChan    chan *RoomPopularMsg // 房间十分钟内最高频率单词
-	roomLogoutMsg      chan *RoomLogoutMsg  // 登出用户
+	s     *Service
+	shard int // 第几个分片
+
+	Rooms map[int]*Room // 只有分到这个分片的房间
+
+	roomChangeChan     chan *RoomChangeMsg      // 切换房间
+	roomReceiveMsgChan chan *RoomReceiveMsg     // 房间聊天
+	roomPopularChan    chan *RoomPopularMsg     // 房间十分钟内最高频率单词
+	roomLogoutMsg      chan *RoomLogoutMsg      // 登出用户
+	roomQueryChan      chan *RoomQueryMsg       // 查询房间
+	roomHistoryChan    chan *RoomHistoryMsg     // 查询房间历史消息
+	roomNoticeChan     chan *RoomNoticeMsg      // 房间通知
+	roomWhoChan        chan *RoomWhoMsg         // 查询房间成员
+	roomListChan       chan *RoomListMsg        // 查询房间列表
+	roomHistoryPage    chan *RoomHistoryPageMsg // 分页拉取历史消息
+	roomSearchChan     chan *RoomSearchMsg      // 搜索历史消息
+	roomEditChan       chan *RoomEditMsg        // 编辑删除消息
+	roomOpChan         chan *RoomOpMsg          // 设置房间管理员
+	roomReactChan      chan *RoomReactMsg       // 表情回应
+	roomAckChan        chan *RoomAckMsg         // 确认已读
+	roomRenameChan     chan *RoomRenameMsg      // 改昵称
+	roomTypingChan     chan *RoomTypingMsg      // 正在输入
+	roomOperatorChan   chan *CommandCtx         // 确认管理员命令
+	roomRemoteChan     chan *backplaneEvent     // 其他节点的房间消息
 
 	wg        sync.WaitGroup
 	closeChan chan bool
 }
 
 type Room struct {
-	RoomID  int         // 房间唯一ID
-	ChatMsg []*ChatMsg  // 房间内消息
-	Users   map[int]int // 房间内玩家
+	RoomID  int                 // 房间唯一ID
+	ChatMsg []*ChatMsg          // 房间内消息
+	Users   map[int]*RoomMember // 房间内玩家
+	Index   map[string][]int64  // 倒排索引，词对应的消息ID
+
+	Operators   map[string]bool  // 房间管理员
+	ReadCursors map[string]int64 // 每个用户已读到的消息ID
+}
+
+type RoomMember struct {
+	ConnID      int
+	UserName    string
+	DisplayName string
+	JoinTime    int64
+	ActiveTime  int64 // 最近一次发言时间
+	TypingTime  int64 // 最近一次推送输入提示的时间
 }
 
 type ChatMsg struct {
+	MsgID      int64
+	RoomID     int
 	UserName   string
 	MsgContent string
 	MsgTime    int64
+	EditTime   int64       // 最后编辑时间
+	Deleted    bool        // 删除后只保留墓碑
+	Edits      []*ChatEdit // 编辑记录
+	ParentID   int64       // 回复的消息ID
+	Reactions  []*Reaction // 表情回应
+
+	DisplayName string            // 发送时的昵称
+	Annotations map[string]string // 中间件加的标注
+	Integration string            // 集成发的消息
 }
 
 func (rm *RoomManage) init(s *Service) {
@@ -40,6 +82,21 @@ func (rm *RoomManage) init(s *Service) {
 	rm.roomReceiveMsgChan = make(chan *RoomReceiveMsg, 1024)
 	rm.roomPopularChan = make(chan *RoomPopularMsg, 1024)
 	rm.roomLogoutMsg = make(chan *RoomLogoutMsg, 64)
+	rm.roomQueryChan = make(chan *RoomQueryMsg, 64)
+	rm.roomHistoryChan = make(chan *RoomHistoryMsg, 64)
+	rm.roomNoticeChan = make(chan *RoomNoticeMsg, 1024)
+	rm.roomWhoChan = make(chan *RoomWhoMsg, 64)
+	rm.roomListChan = make(chan *RoomListMsg, 64)
+	rm.roomHistoryPage = make(chan *RoomHistoryPageMsg, 1024)
+	rm.roomSearchChan = make(chan *RoomSearchMsg, 1024)
+	rm.roomEditChan = make(chan *RoomEditMsg, 1024)
+	rm.roomOpChan = make(chan *RoomOpMsg, 64)
+	rm.roomReactChan = make(chan *RoomReactMsg, 1024)
+	rm.roomAckChan = make(chan *RoomAckMsg, 1024)
+	rm.roomTypingChan = make(chan *RoomTypingMsg, 1024)
+	rm.roomRenameChan = make(chan *RoomRenameMsg, 64)
+	rm.roomOperatorChan = make(chan *CommandCtx, 64)
+	rm.roomRemoteChan = make(chan *backplaneEvent, 1024)
 	rm.closeChan = make(chan bool, 1)
 }
 
@@ -59,10 +116,17 @@ func (rm *RoomManage) Stop() {
 
 func (rm *RoomManage) initRoom() {
 	for i := 0; i < RoomNum; i++ {
+		if rm.s.roomShard(i) != rm {
+			continue
+		}
 		room := &Room{
 			RoomID:  i,
 			ChatMsg: make([]*ChatMsg, 0),
-			Users:   make(map[int]int),
+			Users:   make(map[int]*RoomMember),
+			Index:   make(map[string][]int64),
+
+			Operators:   make(map[string]bool),
+			ReadCursors: make(map[string]int64),
 		}
 		rm.Rooms[i] = room
 		log.Printf("init chat room %d", i)
@@ -81,6 +145,36 @@ func (rm *RoomManage) roomLogic() {
 			rm.roomPopularLogic(roomPopularMsg)
 		case roomLogoutMsg := <-rm.roomLogoutMsg:
 			rm.roomLogoutLogic(roomLogoutMsg)
+		case roomQueryMsg := <-rm.roomQueryChan:
+			rm.roomQueryLogic(roomQueryMsg)
+		case roomHistoryMsg := <-rm.roomHistoryChan:
+			rm.roomHistoryLogic(roomHistoryMsg)
+		case roomNoticeMsg := <-rm.roomNoticeChan:
+			rm.roomNoticeLogic(roomNoticeMsg)
+		case roomWhoMsg := <-rm.roomWhoChan:
+			rm.roomWhoLogic(roomWhoMsg)
+		case roomListMsg := <-rm.roomListChan:
+			rm.roomListLogic(roomListMsg)
+		case roomHistoryPageMsg := <-rm.roomHistoryPage:
+			rm.roomHistoryPageLogic(roomHistoryPageMsg)
+		case roomSearchMsg := <-rm.roomSearchChan:
+			rm.roomSearchLogic(roomSearchMsg)
+		case roomEditMsg := <-rm.roomEditChan:
+			rm.roomEditLogic(roomEditMsg)
+		case roomOpMsg := <-rm.roomOpChan:
+			rm.roomOpLogic(roomOpMsg)
+		case roomReactMsg := <-rm.roomReactChan:
+			rm.roomReactLogic(roomReactMsg)
+		case roomAckMsg := <-rm.roomAckChan:
+			rm.roomAckLogic(roomAckMsg)
+		case roomTypingMsg := <-rm.roomTypingChan:
+			rm.roomTypingLogic(roomTypingMsg)
+		case roomRenameMsg := <-rm.roomRenameChan:
+			rm.roomRenameLogic(roomRenameMsg)
+		case ctx := <-rm.roomOperatorChan:
+			rm.roomOperatorLogic(ctx)
+		case event := <-rm.roomRemoteChan:
+			rm.roomRemoteLogic(event)
 		case <-rm.closeChan:
 			return
 		}
@@ -90,33 +184,83 @@ func (rm *RoomManage) roomLogic() {
 func (rm *RoomManage) roomMsgLogic(msg *RoomReceiveMsg) {
 	room := rm.Rooms[msg.RoomID]
 	if room == nil {
+		if msg.Reply != nil {
+			msg.Reply <- &PostResult{Err: RoomIDErr}
+		}
 		return
 	}
 
+	// 回复的消息必须在同一个房间
+	if msg.ParentID > 0 {
+		parentMsg := room.findMsg(msg.ParentID)
+		if parentMsg == nil || parentMsg.Deleted {
+			rm.sendSingleMsg(msg.ConnID, MsgNotFound)
+			return
+		}
+	}
+
+	// 记录此条消息
+	now := rm.s.now()
+	if member := room.Users[msg.ConnID]; member != nil {
+		member.ActiveTime = now
+		// 发言后下一次输入马上提示
+		member.TypingTime = 0
+	}
+	chatMsg := &ChatMsg{
+		MsgID:      rm.s.newMsgID(room.RoomID),
+		RoomID:     room.RoomID,
+		UserName:   msg.UserName,
+		MsgContent: msg.Content,
+		MsgTime:    now,
+		ParentID:   msg.ParentID,
+
+		DisplayName: msg.DisplayName,
+		Annotations: msg.Annotations,
+		Integration: msg.Integration,
+	}
+	room.ChatMsg = append(room.ChatMsg, chatMsg)
+	room.indexMsg(chatMsg)
+
 	// 转发给房间内所有人
 	connIDs := make([]int, 0)
 	for connID := range room.Users {
 		connIDs = append(connIDs, connID)
 	}
 	pushToOtherMsg := make([]*BaseMsg, 0)
-	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
-		UserName: msg.UserName,
-		Content:  msg.Content,
-	})
+	pushToOtherMsg = append(pushToOtherMsg, chatMsg.toBaseMsg(MsgTypeChat))
 	pushMsg := &PushMsg{
 		ConnID:  connIDs,
 		PushMsg: pushToOtherMsg,
 	}
 	rm.s.msgManage.pushMsgChan <- pushMsg
-
-	// 记录此条消息
-	now := time.Now().Unix()
-	chatMsg := &ChatMsg{
-		UserName:   msg.UserName,
-		MsgContent: msg.Content,
-		MsgTime:    now,
+	if msg.Reply != nil {
+		msg.Reply <- &PostResult{Msg: chatMsg.toBaseMsg(MsgTypeChat)}
 	}
-	room.ChatMsg = append(room.ChatMsg, chatMsg)
+
+	// 通知用户管理处理离线留言和@提醒
+	rm.s.roomStored(&UserRoomStoredMsg{
+		RoomID:   room.RoomID,
+		Msg:      chatMsg.toBaseMsg(MsgTypeChat),
+		Mentions: msg.Mentions,
+	})
+
+	rm.s.backplaneManage.publish(&backplaneEvent{
+		Kind:     backplaneRoomMsg,
+		Chat:     chatMsg.clone(),
+		Mentions: msg.Mentions,
+	})
+
+	rm.s.webhookManage.emit(&WebhookEvent{
+		Type:        WebhookEventMessage,
+		RoomID:      room.RoomID,
+		Time:        chatMsg.MsgTime,
+		UserName:    chatMsg.UserName,
+		MsgID:       chatMsg.MsgID,
+		Content:     chatMsg.MsgContent,
+		ParentID:    chatMsg.ParentID,
+		Annotations: cloneAnnotations(chatMsg.Annotations),
+		Integration: chatMsg.Integration,
+	})
 
 	// TODO 消息清理 十分钟之前并且消息不处于最近50条
 }
@@ -124,20 +268,45 @@ func (rm *RoomManage) roomMsgLogic(msg *RoomReceiveMsg) {
 func (rm *RoomManage) roomChangeLogic(msg *RoomChangeMsg) {
 	// 找到旧的房间
 	oldRoom := rm.Rooms[msg.OldRoomID]
-	if oldRoom != nil {
+	if oldRoom != nil && oldRoom.hasUser(msg.ConnID) {
 		oldRoom.delUser(msg.ConnID)
+		rm.s.connRooms.Delete(msg.ConnID)
+		// 多端登录时最后一个连接离开才通知
+		if !oldRoom.hasUserName(msg.UserName) {
+			rm.memberNotice(oldRoom, msg.ConnID, MsgTypeLeave, msg.UserName)
+		}
 	}
 
-	// 加入新的房间
-	newRoom := rm.Rooms[msg.NewRoomID]
-	if newRoom != nil {
-		newRoom.addUser(msg.ConnID)
+	// 新房间在别的分片，离开旧房间后转过去
+	if msg.NewRoomID >= 0 && msg.NewRoomID < RoomNum && rm.s.roomShard(msg.NewRoomID) != rm {
+		joinMsg := *msg
+		joinMsg.OldRoomID = -1
+		rm.s.roomShard(msg.NewRoomID).roomChangeChan <- &joinMsg
+		return
 	}
 
+	// 加入新的房间，已经又换过房间或者登出的不再加入
+	newRoom := rm.Rooms[msg.NewRoomID]
+	if newRoom != nil && !rm.s.latestRoomChange(msg.ConnID, msg.Seq) {
+		return
+	}
 	if newRoom == nil {
 		return
 	}
+	if !newRoom.hasUserName(msg.UserName) {
+		rm.memberNotice(newRoom, msg.ConnID, MsgTypeJoin, msg.UserName)
+	}
+	newRoom.addUser(msg.ConnID, msg.UserName, msg.DisplayName, rm.s.now())
+	rm.s.connRooms.Store(msg.ConnID, newRoom.RoomID)
+	newRoom.initReadCursor(msg.UserName)
 
+	// 先推最近的消息，再回复成功。已经在房间里了再回复，之后的房间消息一定能收到
+	rm.pushJoinHistory(newRoom, msg.ConnID)
+	rm.sendSingleMsg(msg.ConnID, JoinRoomSuccess)
+}
+
+// pushJoinHistory 进房间时推送最近的消息，按历史消息推送，和新的聊天区分开
+func (rm *RoomManage) pushJoinHistory(newRoom *Room, connID int) {
 	// 找出房间最近50条
 	roomMsg := make([]*ChatMsg, 0)
 	roomMsgLen := len(newRoom.ChatMsg)
@@ -155,13 +324,10 @@ func (rm *RoomManage) roomChangeLogic(msg *RoomChangeMsg) {
 	// 推送消息
 	pushToOtherMsg := make([]*BaseMsg, 0)
 	for _, cMsg := range roomMsg {
-		pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
-			UserName: cMsg.UserName,
-			Content:  cMsg.MsgContent,
-		})
+		pushToOtherMsg = append(pushToOtherMsg, cMsg.toBaseMsg(MsgTypeHistory))
 	}
 	connIDs := make([]int, 0)
-	connIDs = append(connIDs, msg.ConnID)
+	connIDs = append(connIDs, connID)
 	pushMsg := &PushMsg{
 		ConnID:  connIDs,
 		PushMsg: pushToOtherMsg,
@@ -170,12 +336,112 @@ func (rm *RoomManage) roomChangeLogic(msg *RoomChangeMsg) {
 
 }
 
+// historyPage 取ID小于beforeID的最近limit条消息，按ID升序
+func (r *Room) historyPage(beforeID int64, limit int) []*ChatMsg {
+	end := len(r.ChatMsg)
+	if beforeID > 0 {
+		// 消息按ID递增追加，二分查找
+		end = sort.Search(len(r.ChatMsg), func(i int) bool {
+			return r.ChatMsg[i].MsgID >= beforeID
+		})
+	}
+	begin := end - limit
+	if begin < 0 {
+		begin = 0
+	}
+	return r.ChatMsg[begin:end]
+}
+
+// insertMsg 按ID插入，其他节点的消息可能比本地最新的早到
+func (r *Room) insertMsg(cMsg *ChatMsg) {
+	i := sort.Search(len(r.ChatMsg), func(i int) bool {
+		return r.ChatMsg[i].MsgID >= cMsg.MsgID
+	})
+	r.ChatMsg = append(r.ChatMsg, nil)
+	copy(r.ChatMsg[i+1:], r.ChatMsg[i:])
+	r.ChatMsg[i] = cMsg
+}
+
+func (c *ChatMsg) toBaseMsg(msgType int) *BaseMsg {
+	return &BaseMsg{
+		Type:     msgType,
+		MsgID:    c.MsgID,
+		MsgTime:  c.MsgTime,
+		UserName: c.UserName,
+		RoomID:   c.RoomID,
+		Content:  c.MsgContent,
+		EditTime: c.EditTime,
+		Deleted:  c.Deleted,
+
+		ParentID:  c.ParentID,
+		Reactions: cloneReactions(c.Reactions),
+
+		DisplayName: c.DisplayName,
+		Annotations: cloneAnnotations(c.Annotations),
+		Integration: c.Integration,
+	}
+}
+
+// clone 深拷贝一份，避免和房间协程共享
+func (c *ChatMsg) clone() *ChatMsg {
+	cMsgCopy := *c
+	cMsgCopy.Edits = append([]*ChatEdit(nil), c.Edits...)
+	cMsgCopy.Reactions = cloneReactions(c.Reactions)
+	cMsgCopy.Annotations = cloneAnnotations(c.Annotations)
+	return &cMsgCopy
+}
+
 func (r *Room) delUser(connID int) {
 	delete(r.Users, connID)
 }
 
-func (r *Room) addUser(connID int) {
-	r.Users[connID] = connID
+func (r *Room) addUser(connID int, userName string, displayName string, now int64) {
+	r.Users[connID] = &RoomMember{
+		ConnID:      connID,
+		UserName:    userName,
+		DisplayName: displayName,
+		JoinTime:    now,
+		ActiveTime:  now,
+	}
+}
+
+func (r *Room) hasUser(connID int) bool {
+	_, ok := r.Users[connID]
+	return ok
+}
+
+func (r *Room) hasUserName(userName string) bool {
+	for _, member := range r.Users {
+		if member.UserName == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// userMembers 按用户聚合房间内的连接，多端登录只保留最近活跃的那个
+func (r *Room) userMembers() []*RoomMember {
+	memberMap := make(map[string]*RoomMember)
+	for _, member := range r.Users {
+		userMember := memberMap[member.UserName]
+		if userMember == nil {
+			memberCopy := *member
+			memberMap[member.UserName] = &memberCopy
+			continue
+		}
+		if member.JoinTime < userMember.JoinTime {
+			userMember.JoinTime = member.JoinTime
+		}
+		if member.ActiveTime > userMember.ActiveTime {
+			userMember.ActiveTime = member.ActiveTime
+		}
+	}
+
+	members := make([]*RoomMember, 0, len(memberMap))
+	for _, member := range memberMap {
+		members = append(members, member)
+	}
+	return members
 }
 
 func (rm *RoomManage) roomPopularLogic(msg *RoomPopularMsg) {
@@ -185,13 +451,15 @@ func (rm *RoomManage) roomPopularLogic(msg *RoomPopularMsg) {
 	}
 
 	// 获取最多频率单词
-	maxPopularWord := getMaxPopularWord(room.ChatMsg)
+	maxPopularWord := getMaxPopularWord(room.ChatMsg, rm.s.now())
 
 	// 发送给用户
 	connIDs := make([]int, 0)
 	connIDs = append(connIDs, msg.ConnID)
 	pushToOtherMsg := make([]*BaseMsg, 0)
 	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
+		Type:    MsgTypePopular,
+		RoomID:  room.RoomID,
 		Content: maxPopularWord,
 	})
 	pushMsg := &PushMsg{
@@ -203,19 +471,308 @@ func (rm *RoomManage) roomPopularLogic(msg *RoomPopularMsg) {
 
 func (rm *RoomManage) roomLogoutLogic(msg *RoomLogoutMsg) {
 	room := rm.Rooms[msg.RoomID]
-	if room == nil {
+	if room == nil || !room.hasUser(msg.ConnID) {
 		return
 	}
 	room.delUser(msg.ConnID)
+	rm.s.connRooms.Delete(msg.ConnID)
+	if room.hasUserName(msg.UserName) {
+		return
+	}
+	rm.memberNotice(room, msg.ConnID, MsgTypeLeave, msg.UserName)
+}
+
+// memberNotice 通知房间有人进出，同步给其他节点，推送事件
+func (rm *RoomManage) memberNotice(room *Room, exceptConnID int, msgType int, userName string) {
+	content := fmt.Sprintf(UserJoinRoom, userName)
+	eventType := WebhookEventJoin
+	if msgType == MsgTypeLeave {
+		content = fmt.Sprintf(UserLeaveRoom, userName)
+		eventType = WebhookEventLeave
+	}
+	baseMsg := &BaseMsg{
+		Type:     msgType,
+		UserName: userName,
+		RoomID:   room.RoomID,
+		Content:  content,
+	}
+	rm.pushToRoom(room, exceptConnID, baseMsg)
+
+	baseMsgCopy := *baseMsg
+	rm.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneRoomPush, Msg: &baseMsgCopy})
+	rm.s.webhookManage.emit(&WebhookEvent{
+		Type:     eventType,
+		RoomID:   room.RoomID,
+		Time:     rm.s.now(),
+		UserName: userName,
+	})
+}
+
+func (rm *RoomManage) roomNoticeLogic(msg *RoomNoticeMsg) {
+	room := rm.Rooms[msg.RoomID]
+	if room == nil {
+		return
+	}
+	rm.pushToRoom(room, 0, &BaseMsg{
+		Type:    msg.Type,
+		RoomID:  room.RoomID,
+		Content: msg.Content,
+	})
+	rm.s.backplaneManage.publish(&backplaneEvent{
+		Kind: backplaneRoomPush,
+		Msg: &BaseMsg{
+			Type:    msg.Type,
+			RoomID:  room.RoomID,
+			Content: msg.Content,
+		},
+	})
+}
+
+func (rm *RoomManage) roomHistoryPageLogic(msg *RoomHistoryPageMsg) {
+	room := rm.Rooms[msg.RoomID]
+	if room == nil {
+		rm.sendSingleMsg(msg.ConnID, RoomIDErr)
+		return
+	}
+
+	pageMsg := room.historyPage(msg.BeforeID, msg.Limit)
+	if len(pageMsg) == 0 {
+		rm.sendSingleMsg(msg.ConnID, HistoryEmpty)
+		return
+	}
+
+	pushToOtherMsg := make([]*BaseMsg, 0, len(pageMsg))
+	for _, cMsg := range pageMsg {
+		pushToOtherMsg = append(pushToOtherMsg, cMsg.toBaseMsg(MsgTypeHistory))
+	}
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, msg.ConnID)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	rm.s.msgManage.pushMsgChan <- pushMsg
+}
+
+func (rm *RoomManage) roomSearchLogic(msg *RoomSearchMsg) {
+	room := rm.Rooms[msg.RoomID]
+	if room == nil {
+		if msg.Reply != nil {
+			msg.Reply <- nil
+			return
+		}
+		rm.sendSingleMsg(msg.ConnID, RoomIDErr)
+		return
+	}
+
+	result := room.search(msg.Query, SearchMaxResult)
+	if msg.Reply != nil {
+		// 拷贝一份，避免和房间协程共享
+		chatMsg := make([]*ChatMsg, 0, len(result))
+		for _, cMsg := range result {
+			chatMsg = append(chatMsg, cMsg.clone())
+		}
+		msg.Reply <- chatMsg
+		return
+	}
+	if len(result) == 0 {
+		rm.sendSingleMsg(msg.ConnID, SearchEmpty)
+		return
+	}
+
+	pushToOtherMsg := make([]*BaseMsg, 0, len(result))
+	for _, cMsg := range result {
+		pushToOtherMsg = append(pushToOtherMsg, cMsg.toBaseMsg(MsgTypeSearch))
+	}
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, msg.ConnID)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	rm.s.msgManage.pushMsgChan <- pushMsg
+}
+
+func (rm *RoomManage) roomTypingLogic(msg *RoomTypingMsg) {
+	room := rm.connRoom(msg.ConnID)
+	if room == nil {
+		return
+	}
+	member := room.Users[msg.ConnID]
+
+	// 限流，间隔太短不重复推送
+	now := rm.s.now()
+	if now-member.TypingTime < TypingThrottleSecond {
+		return
+	}
+	member.TypingTime = now
+
+	// 不存进房间消息，只推给房间里其他人和其他节点
+	baseMsg := &BaseMsg{
+		Type:       MsgTypeTyping,
+		MsgTime:    now,
+		UserName:   member.UserName,
+		RoomID:     room.RoomID,
+		ExpireTime: now + TypingExpireSecond,
+
+		DisplayName: member.DisplayName,
+	}
+	rm.pushToRoom(room, msg.ConnID, baseMsg)
+
+	baseMsgCopy := *baseMsg
+	rm.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneRoomPush, Msg: &baseMsgCopy})
+}
+
+func (rm *RoomManage) roomWhoLogic(msg *RoomWhoMsg) {
+	room := rm.Rooms[msg.RoomID]
+	// 没指定房间则查自己所在的房间
+	if msg.RoomID < 0 {
+		room = rm.connRoom(msg.ConnID)
+	}
+	if room == nil {
+		rm.sendSingleMsg(msg.ConnID, RoomIDErr)
+		return
+	}
+
+	members := room.userMembers()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].JoinTime < members[j].JoinTime ||
+			members[i].JoinTime == members[j].JoinTime && members[i].UserName < members[j].UserName
+	})
+
+	now := rm.s.now()
+	memberArr := make([]string, 0, len(members))
+	for _, member := range members {
+		memberArr = append(memberArr, fmt.Sprintf("%s(%s)", member.name(), member.presence(now)))
+	}
+	rm.sendSingleMsg(msg.ConnID, fmt.Sprintf("room %d: %s", room.RoomID, strings.Join(memberArr, " ")))
+}
+
+// roomListLogic 从第一个分片开始依次填上自己的房间，最后一个分片回复
+func (rm *RoomManage) roomListLogic(msg *RoomListMsg) {
+	if msg.Rooms == nil {
+		msg.Rooms = make([]string, RoomNum)
+	}
+	for roomID, room := range rm.Rooms {
+		roomInfo := fmt.Sprintf("room %d: %d users", roomID, len(room.userMembers()))
+		if _, ok := room.ReadCursors[msg.UserName]; ok && msg.UserName != "" {
+			roomInfo += fmt.Sprintf(", %d unread", room.unreadCount(msg.UserName))
+		}
+		msg.Rooms[roomID] = roomInfo
+	}
+	if next := rm.shard + 1; next < len(rm.s.roomShards) {
+		rm.s.roomShards[next].roomListChan <- msg
+		return
+	}
+	rm.sendSingleMsg(msg.ConnID, strings.Join(msg.Rooms, "\n"))
+}
+
+// connRoom 找到连接所在的房间
+func (rm *RoomManage) connRoom(connID int) *Room {
+	for _, room := range rm.Rooms {
+		if room.hasUser(connID) {
+			return room
+		}
+	}
+	return nil
+}
+
+// name 有昵称时带上登录名，方便私聊
+func (m *RoomMember) name() string {
+	if m.DisplayName == "" {
+		return m.UserName
+	}
+	return fmt.Sprintf("%s[%s]", m.DisplayName, m.UserName)
+}
+
+func (m *RoomMember) presence(now int64) string {
+	if now-m.ActiveTime > RoomIdleSecond {
+		return PresenceIdle
+	}
+	return PresenceActive
+}
+
+func (rm *RoomManage) sendSingleMsg(connID int, content string) {
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, connID)
+	pushToOtherMsg := make([]*BaseMsg, 0)
+	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
+		Type:    MsgTypeSystem,
+		Content: content,
+	})
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	rm.s.msgManage.pushMsgChan <- pushMsg
+}
+
+// pushToRoom 给房间内除exceptConnID以外的人推送消息
+func (rm *RoomManage) pushToRoom(room *Room, exceptConnID int, baseMsg *BaseMsg) {
+	connIDs := make([]int, 0)
+	for connID := range room.Users {
+		if connID != exceptConnID {
+			connIDs = append(connIDs, connID)
+		}
+	}
+	if len(connIDs) == 0 {
+		return
+	}
+
+	pushToOtherMsg := make([]*BaseMsg, 0)
+	pushToOtherMsg = append(pushToOtherMsg, baseMsg)
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	rm.s.msgManage.pushMsgChan <- pushMsg
+}
+
+// roomQueryLogic 和roomListLogic一样依次经过每个分片
+func (rm *RoomManage) roomQueryLogic(msg *RoomQueryMsg) {
+	for _, room := range rm.Rooms {
+		members := make([]int, 0, len(room.Users))
+		for connID := range room.Users {
+			members = append(members, connID)
+		}
+		sort.Ints(members)
+		msg.RoomInfos = append(msg.RoomInfos, &RoomInfo{
+			RoomID:  room.RoomID,
+			Members: members,
+			MsgNum:  len(room.ChatMsg),
+		})
+	}
+	if next := rm.shard + 1; next < len(rm.s.roomShards) {
+		rm.s.roomShards[next].roomQueryChan <- msg
+		return
+	}
+	sort.Slice(msg.RoomInfos, func(i, j int) bool {
+		return msg.RoomInfos[i].RoomID < msg.RoomInfos[j].RoomID
+	})
+	msg.Reply <- msg.RoomInfos
+}
+
+func (rm *RoomManage) roomHistoryLogic(msg *RoomHistoryMsg) {
+	room := rm.Rooms[msg.RoomID]
+	if room == nil {
+		msg.Reply <- nil
+		return
+	}
+
+	// 拷贝一份，避免和房间协程共享
+	chatMsg := make([]*ChatMsg, 0, len(room.ChatMsg))
+	for _, cMsg := range room.ChatMsg {
+		chatMsg = append(chatMsg, cMsg.clone())
+	}
+	msg.Reply <- chatMsg
 }
 
-func getMaxPopularWord(chatMsg []*ChatMsg) string {
+func getMaxPopularWord(chatMsg []*ChatMsg, now int64) string {
 	// 找到十分钟节点
-	now := time.Now().Unix()
 	lastTenMinTime := now - PopularBeforeSecond
 	wordCount := make(map[string]int)
 	for _, cMsg := range chatMsg {
-		if cMsg.MsgTime < lastTenMinTime {
+		if cMsg.MsgTime < lastTenMinTime || cMsg.Deleted {
 			continue
 		}
 
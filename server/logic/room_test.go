@@ -1,6 +1,7 @@
 package logic
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -9,7 +10,7 @@ func Test_getMaxPopularWord(t *testing.T) {
 	type args struct {
 		chatMsg []*ChatMsg
 	}
-	now := time.Now().Unix()
+	now := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC).Unix()
 	tests := []struct {
 		name string
 		args args
@@ -20,14 +21,12 @@ func Test_getMaxPopularWord(t *testing.T) {
 			args{
 				chatMsg: []*ChatMsg{
 					{
-						"",
-						"aa bb cc dd ee",
-						now,
+						MsgContent: "aa bb cc dd ee",
+						MsgTime:    now,
 					},
 					{
-						"",
-						"aa aa cc dd ee",
-						now,
+						MsgContent: "aa aa cc dd ee",
+						MsgTime:    now,
 					},
 				},
 			},
@@ -38,19 +37,16 @@ func Test_getMaxPopularWord(t *testing.T) {
 			args{
 				chatMsg: []*ChatMsg{
 					{
-						"",
-						"aa bb cc dd",
-						now,
+						MsgContent: "aa bb cc dd",
+						MsgTime:    now,
 					},
 					{
-						"",
-						"aa aa aa aa",
-						now - 601,
+						MsgContent: "aa aa aa aa",
+						MsgTime:    now - PopularBeforeSecond - 1,
 					},
 					{
-						"",
-						"bb bb cc dd",
-						now,
+						MsgContent: "bb bb cc dd",
+						MsgTime:    now,
 					},
 				},
 			},
@@ -59,9 +55,66 @@ func Test_getMaxPopularWord(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getMaxPopularWord(tt.args.chatMsg); got != tt.want {
+			if got := getMaxPopularWord(tt.args.chatMsg, now); got != tt.want {
 				t.Errorf("getMaxPopularWord() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestRoom_historyPage(t *testing.T) {
+	room := &Room{ChatMsg: make([]*ChatMsg, 0)}
+	for i := int64(1); i <= 10; i++ {
+		room.ChatMsg = append(room.ChatMsg, &ChatMsg{MsgID: i * 2})
+	}
+	tests := []struct {
+		name     string
+		beforeID int64
+		limit    int
+		want     []int64
+	}{
+		{"latest", 0, 3, []int64{16, 18, 20}},
+		{"before_exist_id", 8, 2, []int64{4, 6}},
+		{"before_missing_id", 9, 2, []int64{6, 8}},
+		{"limit_over_begin", 6, 5, []int64{2, 4}},
+		{"before_first", 2, 5, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := room.historyPage(tt.beforeID, tt.limit)
+			if len(got) != len(tt.want) {
+				t.Fatalf("historyPage() len = %d, want %d", len(got), len(tt.want))
+			}
+			for i, cMsg := range got {
+				if cMsg.MsgID != tt.want[i] {
+					t.Errorf("historyPage()[%d] = %d, want %d", i, cMsg.MsgID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHarness_historyAccess(t *testing.T) {
+	h := newTestHarness(t, nil)
+	alice := h.login("alice")
+	alice.joinRoom(1)
+	alice.say("members only")
+	bob := h.login("bob")
+
+	// 和/search一样只能查自己所在的房间
+	bob.send(fmt.Sprintf("%s %d", History, 1))
+	bob.expectContent(NotRoomMember)
+	bob.joinRoom(1)
+	bob.send(fmt.Sprintf("%s %d", History, 1))
+	bob.expect("history", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeHistory && baseMsg.Content == "members only"
+	})
+
+	// 被封禁后不能再翻历史
+	reply := make(chan bool, 1)
+	h.s.userShard("bob").userBanChan <- &UserBanMsg{RoomID: 1, Name: "bob", Ban: true, Reply: reply}
+	<-reply
+	bob.expectContent(RoomBanned)
+	bob.send(fmt.Sprintf("%s %d", History, 1))
+	bob.expectContent(RoomBanned)
+}
@@ -0,0 +1,241 @@
+package logic
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errSearchEmpty = errors.New("empty search query")
+
+type SearchQuery struct {
+	Words   []string   // 需要包含的词
+	Phrases [][]string // 需要连续出现的词组
+	From    string     // 发送人
+	Since   int64      // 起始时间，包含
+	Until   int64      // 结束时间，包含，为0不限制
+}
+
+// ParseSearchQuery 解析搜索语句
+// 支持 "词组"、from:alice、since:/until:，时间可以是unix秒、2006-01-02、2006-01-02T15:04 或 10m 这种相对now的时长
+func ParseSearchQuery(query string, now int64) (*SearchQuery, error) {
+	q := &SearchQuery{}
+	for _, term := range splitSearchTerms(query) {
+		// 引号包起来的是词组
+		if strings.HasPrefix(term, "\"") {
+			phrase := tokenize(strings.Trim(term, "\""))
+			if len(phrase) > 0 {
+				q.Phrases = append(q.Phrases, phrase)
+			}
+			continue
+		}
+
+		lowerTerm := strings.ToLower(term)
+		switch {
+		case strings.HasPrefix(lowerTerm, "from:"):
+			q.From = term[len("from:"):]
+		case strings.HasPrefix(lowerTerm, "since:"):
+			since, err := parseSearchTime(term[len("since:"):], now)
+			if err != nil {
+				return nil, err
+			}
+			q.Since = since
+		case strings.HasPrefix(lowerTerm, "until:"):
+			until, err := parseSearchTime(term[len("until:"):], now)
+			if err != nil {
+				return nil, err
+			}
+			q.Until = until
+		default:
+			q.Words = append(q.Words, tokenize(term)...)
+		}
+	}
+
+	if len(q.Words) == 0 && len(q.Phrases) == 0 && q.From == "" && q.Since == 0 && q.Until == 0 {
+		return nil, errSearchEmpty
+	}
+	return q, nil
+}
+
+// splitSearchTerms 按空格切分，引号内的空格保留
+func splitSearchTerms(query string) []string {
+	terms := make([]string, 0)
+	inQuote := false
+	begin := -1
+	for i, r := range query {
+		if r == '"' {
+			inQuote = !inQuote
+		}
+		if r == ' ' && !inQuote {
+			if begin >= 0 {
+				terms = append(terms, query[begin:i])
+				begin = -1
+			}
+			continue
+		}
+		if begin < 0 {
+			begin = i
+		}
+	}
+	if begin >= 0 {
+		terms = append(terms, query[begin:])
+	}
+	return terms
+}
+
+func parseSearchTime(value string, now int64) (int64, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now - int64(d/time.Second), nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, errors.New("bad search time " + value)
+}
+
+// tokenize 转小写后按非字母数字切词
+func tokenize(content string) []string {
+	return strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexMsg 把消息加入房间的倒排索引
+func (r *Room) indexMsg(cMsg *ChatMsg) {
+	seen := make(map[string]bool)
+	for _, word := range tokenize(cMsg.MsgContent) {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+
+		// 保持ID升序，编辑过的消息会插到中间
+		msgIDs := r.Index[word]
+		i := sort.Search(len(msgIDs), func(i int) bool {
+			return msgIDs[i] >= cMsg.MsgID
+		})
+		msgIDs = append(msgIDs, 0)
+		copy(msgIDs[i+1:], msgIDs[i:])
+		msgIDs[i] = cMsg.MsgID
+		r.Index[word] = msgIDs
+	}
+}
+
+// findMsg 根据消息ID找到消息
+func (r *Room) findMsg(msgID int64) *ChatMsg {
+	i := sort.Search(len(r.ChatMsg), func(i int) bool {
+		return r.ChatMsg[i].MsgID >= msgID
+	})
+	if i < len(r.ChatMsg) && r.ChatMsg[i].MsgID == msgID {
+		return r.ChatMsg[i]
+	}
+	return nil
+}
+
+// search 返回最近limit条满足条件的消息，按ID升序
+func (r *Room) search(q *SearchQuery, limit int) []*ChatMsg {
+	// 所有关键词的倒排列表求交集
+	words := make([]string, 0, len(q.Words))
+	words = append(words, q.Words...)
+	for _, phrase := range q.Phrases {
+		words = append(words, phrase...)
+	}
+
+	var candidates []*ChatMsg
+	if len(words) == 0 {
+		candidates = r.ChatMsg
+	} else {
+		msgIDs := r.Index[words[0]]
+		for _, word := range words[1:] {
+			msgIDs = intersectMsgIDs(msgIDs, r.Index[word])
+		}
+		candidates = make([]*ChatMsg, 0, len(msgIDs))
+		for _, msgID := range msgIDs {
+			if cMsg := r.findMsg(msgID); cMsg != nil {
+				candidates = append(candidates, cMsg)
+			}
+		}
+	}
+
+	result := make([]*ChatMsg, 0)
+	for i := len(candidates) - 1; i >= 0 && len(result) < limit; i-- {
+		if q.match(candidates[i]) {
+			result = append(result, candidates[i])
+		}
+	}
+
+	// 翻转成升序
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+func (q *SearchQuery) match(cMsg *ChatMsg) bool {
+	if cMsg.Deleted {
+		return false
+	}
+	if q.From != "" && !strings.EqualFold(q.From, cMsg.UserName) {
+		return false
+	}
+	if cMsg.MsgTime < q.Since {
+		return false
+	}
+	if q.Until > 0 && cMsg.MsgTime > q.Until {
+		return false
+	}
+	if len(q.Phrases) == 0 {
+		return true
+	}
+
+	tokens := tokenize(cMsg.MsgContent)
+	for _, phrase := range q.Phrases {
+		if !containsPhrase(tokens, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPhrase(tokens []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		matched := true
+		for j, word := range phrase {
+			if tokens[i+j] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectMsgIDs 两个升序ID列表求交集
+func intersectMsgIDs(a []int64, b []int64) []int64 {
+	result := make([]int64, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return result
+}
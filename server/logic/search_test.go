@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	now := int64(10000)
+	tests := []struct {
+		name    string
+		query   string
+		want    *SearchQuery
+		wantErr bool
+	}{
+		{
+			"words",
+			"Hello World",
+			&SearchQuery{Words: []string{"hello", "world"}},
+			false,
+		},
+		{
+			"phrase_and_from",
+			"\"deploy is done\" from:alice",
+			&SearchQuery{Phrases: [][]string{{"deploy", "is", "done"}}, From: "alice"},
+			false,
+		},
+		{
+			"time_range",
+			"since:10m until:9900",
+			&SearchQuery{Since: 9400, Until: 9900},
+			false,
+		},
+		{"empty", "  ", nil, true},
+		{"bad_time", "since:yesterday", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSearchQuery(tt.query, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSearchQuery() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSearchQuery() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoom_search(t *testing.T) {
+	room := &Room{Index: make(map[string][]int64)}
+	msgs := []*ChatMsg{
+		{MsgID: 1, UserName: "alice", MsgContent: "deploy is done", MsgTime: 100},
+		{MsgID: 2, UserName: "bob", MsgContent: "is deploy done?", MsgTime: 200},
+		{MsgID: 3, UserName: "alice", MsgContent: "lunch time", MsgTime: 300},
+		{MsgID: 4, UserName: "bob", MsgContent: "Deploy again", MsgTime: 400},
+	}
+	for _, cMsg := range msgs {
+		room.ChatMsg = append(room.ChatMsg, cMsg)
+		room.indexMsg(cMsg)
+	}
+
+	tests := []struct {
+		name  string
+		query *SearchQuery
+		limit int
+		want  []int64
+	}{
+		{"word", &SearchQuery{Words: []string{"deploy"}}, 10, []int64{1, 2, 4}},
+		{"words_and", &SearchQuery{Words: []string{"deploy", "done"}}, 10, []int64{1, 2}},
+		{"phrase", &SearchQuery{Phrases: [][]string{{"deploy", "is"}}}, 10, []int64{1}},
+		{"from", &SearchQuery{Words: []string{"deploy"}, From: "Bob"}, 10, []int64{2, 4}},
+		{"time", &SearchQuery{Since: 200, Until: 300}, 10, []int64{2, 3}},
+		{"limit_latest", &SearchQuery{Words: []string{"deploy"}}, 2, []int64{2, 4}},
+		{"no_match", &SearchQuery{Words: []string{"dinner"}}, 10, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]int64, 0)
+			for _, cMsg := range room.search(tt.query, tt.limit) {
+				got = append(got, cMsg.MsgID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("search() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
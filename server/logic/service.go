@@ -1,26 +1,78 @@
 package logic
 
-import "log"
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
 
 type Service struct {
-	connManage *ConnManage
-	roomManage *RoomManage
-	userManage *UserManage
-	msgManage  *MsgManage
+	Config *Config
+	Clock  Clock // 为空用系统时间
+
+	Backplane Backplane // 多节点共享房间，为空单节点
+
+	lastMsgID   int64 // 全局递增的消息ID，房间消息和私聊共用
+	lastUserID  int64 // 各个用户分片共用的用户ID
+	lastRoomSeq int64 // 连接换房间的序号
+
+	commands    *commandRegistry    // 斜杠命令，内置的加上插件
+	middlewares *middlewareRegistry // 消息中间件
+
+	connManage      *ConnManage
+	roomShards      []*RoomManage // 房间按ID分到各个分片
+	userShards      []*UserManage // 用户按登录名分到各个分片
+	msgManage       *MsgManage
+	adminManage     *AdminManage
+	webhookManage   *WebhookManage
+	backplaneManage *BackplaneManage
+
+	connRooms sync.Map  // 连接所在的房间ID，按连接找房间分片
+	roomSeqs  sync.Map  // 连接最近一次换房间的序号，登出时删掉
+	userNames userNames // 登录名和昵称，各个用户分片共用来查重
 }
 
 func (s *Service) Start() {
-	// 初始化聊天室
-	roomManage := &RoomManage{}
-	roomManage.Start(s)
-	s.roomManage = roomManage
-	log.Printf("roomManage begin")
+	if s.Config == nil {
+		s.Config = DefaultConfig()
+	}
+	if s.Clock == nil {
+		s.Clock = systemClock{}
+	}
+	s.commandRegistry()
+	s.middlewareRegistry().build(s.Config)
+
+	// 初始化事件推送，房间和用户管理会往里发事件
+	webhookManage := &WebhookManage{}
+	webhookManage.Start(s)
+	s.webhookManage = webhookManage
+	log.Printf("webhookManage begin")
+
+	// 初始化节点同步，先订阅，其他管理器都启动后再处理收到的
+	backplaneManage := &BackplaneManage{}
+	backplaneManage.Start(s)
+	s.backplaneManage = backplaneManage
+	log.Printf("backplaneManage begin")
+
+	// 初始化聊天室，分片都建好再启动，启动后会互相转发
+	s.roomShards = make([]*RoomManage, shardNum(s.Config.RoomShards, RoomNum))
+	for i := range s.roomShards {
+		s.roomShards[i] = &RoomManage{shard: i}
+	}
+	for _, roomManage := range s.roomShards {
+		roomManage.Start(s)
+	}
+	log.Printf("roomManage begin, %d shards", len(s.roomShards))
 
 	// 初始化用户信息
-	userManage := &UserManage{}
-	userManage.Start(s)
-	s.userManage = userManage
-	log.Printf("userManage begin")
+	s.userShards = make([]*UserManage, shardNum(s.Config.UserShards, UserMaxShard))
+	for i := range s.userShards {
+		s.userShards[i] = &UserManage{shard: i}
+	}
+	for _, userManage := range s.userShards {
+		userManage.Start(s)
+	}
+	log.Printf("userManage begin, %d shards", len(s.userShards))
 
 	// 初始化msg
 	msgManage := &MsgManage{}
@@ -33,11 +85,53 @@ func (s *Service) Start() {
 	connManage.Start(s)
 	s.connManage = connManage
 	log.Printf("connManage begin")
+
+	// 初始化管理接口
+	adminManage := &AdminManage{}
+	adminManage.Start(s)
+	s.adminManage = adminManage
+	log.Printf("adminManage begin")
+
+	s.backplaneManage.listen()
 }
 
 func (s *Service) Stop() {
+	s.adminManage.Stop()
 	s.connManage.Stop()
+	s.backplaneManage.Stop()
 	s.msgManage.Stop()
-	s.userManage.Stop()
-	s.roomManage.Stop()
+	for _, userManage := range s.userShards {
+		userManage.Stop()
+	}
+	for _, roomManage := range s.roomShards {
+		roomManage.Stop()
+	}
+	s.webhookManage.Stop()
+}
+
+// Addr 聊天服务实际监听的地址
+func (s *Service) Addr() string {
+	if s.connManage.listener == nil {
+		return ""
+	}
+	return s.connManage.listener.Addr().String()
+}
+
+// AdminAddr 管理接口实际监听的地址
+func (s *Service) AdminAddr() string {
+	return s.adminManage.Addr()
+}
+
+// now 当前的unix秒，所有管理器统一从Clock取时间
+func (s *Service) now() int64 {
+	return s.Clock.Now().Unix()
+}
+
+// newMsgID 最低位带上房间ID，按消息ID就能找到房间分片。多节点时再带上节点ID，不同节点不会重复
+func (s *Service) newMsgID(roomID int) int64 {
+	seq := atomic.AddInt64(&s.lastMsgID, 1)
+	if s.Backplane != nil {
+		seq = seq*BackplaneMaxNode + int64(s.Config.NodeID)
+	}
+	return seq*MsgIDRoomBase + int64(roomID)
 }
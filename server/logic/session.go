@@ -0,0 +1,154 @@
+package logic
+
+import "sort"
+
+func (u *User) addConn(connID int) {
+	if u.ConnIDs == nil {
+		u.ConnIDs = make(map[int]bool)
+	}
+	u.ConnIDs[connID] = true
+}
+
+func (u *User) delConn(connID int) {
+	delete(u.ConnIDs, connID)
+}
+
+// connIDList 在线的连接，按连接ID排序
+func (u *User) connIDList() []int {
+	connIDs := make([]int, 0, len(u.ConnIDs))
+	for connID := range u.ConnIDs {
+		connIDs = append(connIDs, connID)
+	}
+	sort.Ints(connIDs)
+	return connIDs
+}
+
+// pushToUser 推送给用户所有在线的连接
+func (um *UserManage) pushToUser(user *User, baseMsg ...*BaseMsg) {
+	if len(user.ConnIDs) == 0 {
+		return
+	}
+	pushToOtherMsg := make([]*BaseMsg, 0, len(baseMsg))
+	pushToOtherMsg = append(pushToOtherMsg, baseMsg...)
+	pushMsg := &PushMsg{
+		ConnID:  user.connIDList(),
+		PushMsg: pushToOtherMsg,
+	}
+	um.s.msgManage.pushMsgChan <- pushMsg
+}
+
+// Session 一个连接从登录到登出
+type Session struct {
+	ConnID     int
+	LoginTime  int64
+	LogoutTime int64 // 为0还在线
+}
+
+func (s *Session) duration(now int64) int64 {
+	if s.LogoutTime == 0 {
+		return now - s.LoginTime
+	}
+	return s.LogoutTime - s.LoginTime
+}
+
+func (u *User) startSession(connID int, now int64) {
+	u.Sessions = append(u.Sessions, &Session{
+		ConnID:    connID,
+		LoginTime: now,
+	})
+	u.SessionCount++
+	u.pruneSessions()
+}
+
+func (u *User) endSession(connID int, now int64) {
+	for i := len(u.Sessions) - 1; i >= 0; i-- {
+		session := u.Sessions[i]
+		if session.ConnID == connID && session.LogoutTime == 0 {
+			session.LogoutTime = now
+			return
+		}
+	}
+}
+
+// pruneSessions 只保留最近SessionMaxNum个，多出来的从最早的已结束的会话开始去掉，还在线的留着。
+// 还在线的会话之前的合并进累计时长；之后的被它完全覆盖，不影响在线时长，只计会话时长
+func (u *User) pruneSessions() {
+	extra := len(u.Sessions) - SessionMaxNum
+	if extra <= 0 {
+		return
+	}
+
+	sessions := make([]*Session, 0, SessionMaxNum)
+	open := false
+	for _, session := range u.Sessions {
+		if extra == 0 || session.LogoutTime == 0 {
+			open = open || session.LogoutTime == 0
+			sessions = append(sessions, session)
+			continue
+		}
+		extra--
+		u.SessionTime += session.duration(0)
+		if open {
+			continue
+		}
+		u.OnlineTime += clipInterval(session.LoginTime, session.LogoutTime, u.ArchiveTime, 0)
+		if session.LogoutTime > u.ArchiveTime {
+			u.ArchiveTime = session.LogoutTime
+		}
+	}
+	u.Sessions = sessions
+}
+
+// onlineTime 累计在线时长，多个连接重叠的时间只算一次
+func (u *User) onlineTime(now int64) int64 {
+	return u.OnlineTime + u.sessionUnion(u.ArchiveTime, now)
+}
+
+// rollingOnlineTime 最近window秒内的在线时长
+func (u *User) rollingOnlineTime(now int64, window int64) int64 {
+	return u.sessionUnion(now-window, now)
+}
+
+// avgSessionTime 每次会话的平均时长，不合并重叠
+func (u *User) avgSessionTime(now int64) int64 {
+	if u.SessionCount == 0 {
+		return 0
+	}
+	sessionTime := u.SessionTime
+	for _, session := range u.Sessions {
+		sessionTime += session.duration(now)
+	}
+	return sessionTime / int64(u.SessionCount)
+}
+
+// sessionUnion 会话在[begin, end]内的并集长度
+func (u *User) sessionUnion(begin int64, end int64) int64 {
+	// 会话按登录时间追加，本身有序
+	var total int64
+	coverEnd := begin
+	for _, session := range u.Sessions {
+		sessionEnd := session.LogoutTime
+		if sessionEnd == 0 {
+			sessionEnd = end
+		}
+		total += clipInterval(session.LoginTime, sessionEnd, coverEnd, end)
+		if sessionEnd > coverEnd {
+			coverEnd = sessionEnd
+		}
+	}
+	return total
+}
+
+// clipInterval [from, to]截掉begin之前和end之后的长度，end为0不截
+func clipInterval(from int64, to int64, begin int64, end int64) int64 {
+	if from < begin {
+		from = begin
+	}
+	if end > 0 && to > end {
+		to = end
+	}
+	if to < from {
+		return 0
+	}
+	return to - from
+}
@@ -0,0 +1,198 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserManage_multiSession(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	s := &Service{
+		Config:     DefaultConfig(),
+		Clock:      clock,
+		msgManage:  &MsgManage{pushMsgChan: make(chan *PushMsg, 16), connLoginChan: make(chan *ConnLoginMsg, 16)},
+		roomShards: []*RoomManage{{roomChangeChan: make(chan *RoomChangeMsg, 4), roomLogoutMsg: make(chan *RoomLogoutMsg, 4)}},
+	}
+	um := &UserManage{s: s}
+	um.users = make(map[string]*User)
+	um.userConnIDToName = make(map[int]string)
+	um.roomOfflineUsers = make(map[int]map[string]bool)
+
+	um.nameLogic(&UserNameMsg{ConnID: 1, Name: "alice"})
+	user := um.users["alice"]
+	user.RoomID = 3
+	loginTime := user.LoginTime
+
+	// 第二个连接跟着进入房间，在线时长从第一个连接算起
+	clock.Advance(100 * time.Second)
+	um.nameLogic(&UserNameMsg{ConnID: 2, Name: "alice"})
+	if user.Status != StatusOnline || len(user.ConnIDs) != 2 || user.SessionCount != 2 || user.LoginTime != loginTime {
+		t.Fatalf("second login user = %+v", user)
+	}
+	changeMsg := <-s.roomShards[0].roomChangeChan
+	if changeMsg.ConnID != 2 || changeMsg.NewRoomID != 3 {
+		t.Errorf("second login room change = %+v", changeMsg)
+	}
+
+	// 断开一个连接还在线
+	clock.Advance(200 * time.Second)
+	um.logoutLogic(&UserLogoutMsg{ConnID: 1})
+	if user.Status != StatusOnline || user.RoomID != 3 || user.LogoutTime != 0 {
+		t.Fatalf("after first logout user = %+v", user)
+	}
+	logoutMsg := <-s.roomShards[0].roomLogoutMsg
+	if logoutMsg.ConnID != 1 || logoutMsg.RoomID != 3 {
+		t.Errorf("first logout room msg = %+v", logoutMsg)
+	}
+	if _, ok := um.userConnIDToName[1]; ok {
+		t.Errorf("logged out conn should be unbound")
+	}
+
+	// 重复登出同一个连接无效
+	um.logoutLogic(&UserLogoutMsg{ConnID: 1})
+	if len(s.roomShards[0].roomLogoutMsg) != 0 {
+		t.Errorf("duplicate logout should be ignored")
+	}
+
+	// 最后一个连接下线，房间要收到原来的房间ID
+	clock.Advance(100 * time.Second)
+	um.logoutLogic(&UserLogoutMsg{ConnID: 2})
+	if user.Status != StatusLogout || len(user.ConnIDs) != 0 || user.LastRoomID != 3 || user.RoomID != 0 {
+		t.Fatalf("after last logout user = %+v", user)
+	}
+	logoutMsg = <-s.roomShards[0].roomLogoutMsg
+	if logoutMsg.ConnID != 2 || logoutMsg.RoomID != 3 {
+		t.Errorf("last logout room msg = %+v", logoutMsg)
+	}
+
+	// 1000-1300和1100-1400重叠，在线400秒，平均每次300秒
+	if got := user.onlineTime(2000); got != 400 {
+		t.Errorf("onlineTime() = %d, want 400", got)
+	}
+	if got := user.avgSessionTime(2000); got != 300 {
+		t.Errorf("avgSessionTime() = %d, want 300", got)
+	}
+	if got := user.rollingOnlineTime(2000, 800); got != 200 {
+		t.Errorf("rollingOnlineTime() = %d, want 200", got)
+	}
+}
+
+func TestUser_sessionUnion(t *testing.T) {
+	user := &User{}
+	user.startSession(1, 100)
+	user.startSession(2, 150)
+	user.endSession(2, 180)
+	user.endSession(1, 200)
+	user.startSession(3, 300)
+
+	tests := []struct {
+		name  string
+		begin int64
+		end   int64
+		want  int64
+	}{
+		{"all", 0, 400, 200},
+		{"nested_overlap", 0, 250, 100},
+		{"window_cuts_session", 190, 350, 60},
+		{"gap_only", 210, 290, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := user.sessionUnion(tt.begin, tt.end); got != tt.want {
+				t.Errorf("sessionUnion(%d, %d) = %d, want %d", tt.begin, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUser_pruneSessions(t *testing.T) {
+	user := &User{}
+	for i := 0; i < SessionMaxNum+10; i++ {
+		begin := int64(i * 100)
+		user.startSession(i, begin)
+		// 相邻会话重叠50秒
+		user.endSession(i, begin+150)
+	}
+
+	if len(user.Sessions) != SessionMaxNum || user.SessionCount != SessionMaxNum+10 {
+		t.Fatalf("sessions = %d, count = %d", len(user.Sessions), user.SessionCount)
+	}
+	end := int64(SessionMaxNum+9)*100 + 150
+	if got := user.onlineTime(end); got != end {
+		t.Errorf("onlineTime() = %d, want %d", got, end)
+	}
+	if got := user.avgSessionTime(end); got != 150 {
+		t.Errorf("avgSessionTime() = %d, want 150", got)
+	}
+}
+
+func TestUser_pruneSessionsOpen(t *testing.T) {
+	// 一个连接一直在线，其他连接不停地登录登出
+	user := &User{}
+	user.startSession(0, 0)
+	for i := 1; i <= SessionMaxNum+10; i++ {
+		begin := int64(i * 100)
+		user.startSession(i, begin)
+		user.endSession(i, begin+50)
+	}
+
+	if len(user.Sessions) > SessionMaxNum || user.Sessions[0].ConnID != 0 {
+		t.Fatalf("sessions = %d, first conn %d", len(user.Sessions), user.Sessions[0].ConnID)
+	}
+	end := int64(SessionMaxNum+20) * 100
+	if got := user.onlineTime(end); got != end {
+		t.Errorf("onlineTime() = %d, want %d", got, end)
+	}
+	if got := user.rollingOnlineTime(end, 500); got != 500 {
+		t.Errorf("rollingOnlineTime() = %d, want 500", got)
+	}
+	count := int64(SessionMaxNum + 11)
+	if got := user.avgSessionTime(end); got != (end+(count-1)*50)/count {
+		t.Errorf("avgSessionTime() = %d, want %d", got, (end+(count-1)*50)/count)
+	}
+
+	// 在线的下线之后接着合并，时长不重复算
+	user.endSession(0, end)
+	for i := 0; i < SessionMaxNum; i++ {
+		begin := end + int64(i*100)
+		user.startSession(1000+i, begin)
+		user.endSession(1000+i, begin+100)
+	}
+	if len(user.Sessions) > SessionMaxNum {
+		t.Fatalf("sessions = %d", len(user.Sessions))
+	}
+	total := end + int64(SessionMaxNum)*100
+	if got := user.onlineTime(total); got != total {
+		t.Errorf("onlineTime() after logout = %d, want %d", got, total)
+	}
+}
+
+func TestRoom_userMembers(t *testing.T) {
+	room := &Room{Users: map[int]*RoomMember{
+		1: {ConnID: 1, UserName: "alice", JoinTime: 10, ActiveTime: 10},
+		2: {ConnID: 2, UserName: "alice", JoinTime: 20, ActiveTime: 50},
+		3: {ConnID: 3, UserName: "bob", JoinTime: 30, ActiveTime: 30},
+	}}
+
+	members := room.userMembers()
+	if len(members) != 2 {
+		t.Fatalf("userMembers() len = %d, want 2", len(members))
+	}
+	for _, member := range members {
+		if member.UserName == "alice" && (member.JoinTime != 10 || member.ActiveTime != 50) {
+			t.Errorf("alice member = %+v, want join 10 active 50", member)
+		}
+	}
+	if room.Users[1].ActiveTime != 10 {
+		t.Errorf("userMembers() should not modify room members")
+	}
+
+	room.delUser(1)
+	if !room.hasUserName("alice") {
+		t.Errorf("alice still has conn 2 in room")
+	}
+	room.delUser(2)
+	if room.hasUserName("alice") {
+		t.Errorf("alice has no conn in room")
+	}
+}
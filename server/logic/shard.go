@@ -0,0 +1,168 @@
+package logic
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 房间和用户都分片，每个分片是一个独立协程的RoomManage/UserManage，各自只管自己的房间和用户。
+// 房间按ID取模，用户按登录名哈希，其他管理器发消息前先找到对应的分片
+
+// shardNum 配置的分片数限制在1到max之间
+func shardNum(n int, max int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// roomShard 房间所在的分片，不存在的房间也落在某个分片上，由它回复房间不存在
+func (s *Service) roomShard(roomID int) *RoomManage {
+	n := len(s.roomShards)
+	return s.roomShards[(roomID%n+n)%n]
+}
+
+// connRoomShard 连接所在房间的分片，不在房间里的交给第一个分片回复
+func (s *Service) connRoomShard(connID int) *RoomManage {
+	roomID, ok := s.connRooms.Load(connID)
+	if !ok {
+		return s.roomShards[0]
+	}
+	return s.roomShard(roomID.(int))
+}
+
+// msgRoomShard 消息所在房间的分片，编辑、回应和已读按消息ID里的房间ID找
+func (s *Service) msgRoomShard(msgID int64) *RoomManage {
+	return s.roomShard(int(msgID % MsgIDRoomBase))
+}
+
+// roomChangeShard 切换房间先到旧房间的分片离开，新房间在别的分片再由它转过去
+func (s *Service) roomChangeShard(msg *RoomChangeMsg) *RoomManage {
+	if msg.OldRoomID >= 0 {
+		return s.roomShard(msg.OldRoomID)
+	}
+	return s.roomShard(msg.NewRoomID)
+}
+
+// nextRoomSeq 用户分片每次让连接换房间都先取一个新序号
+func (s *Service) nextRoomSeq(connID int) int64 {
+	seq := atomic.AddInt64(&s.lastRoomSeq, 1)
+	s.roomSeqs.Store(connID, seq)
+	return seq
+}
+
+// latestRoomChange 连接之后没再换过房间，也没有登出。
+// 跨分片的加入是转发过去的，可能比下一次切换的离开晚到，只认最新的一次
+func (s *Service) latestRoomChange(connID int, seq int64) bool {
+	latest, ok := s.roomSeqs.Load(connID)
+	return ok && latest.(int64) == seq
+}
+
+// roomStored 房间消息只发给要处理的用户分片：发送人的记发言统计，有离线成员的留言，@到的用户提醒
+func (s *Service) roomStored(msg *UserRoomStoredMsg) {
+	shards := make(map[*UserManage]bool)
+	if !msg.Remote && msg.Msg.Integration == "" {
+		shards[s.userShard(msg.Msg.UserName)] = true
+	}
+	for _, name := range msg.Mentions {
+		shards[s.userShard(name)] = true
+	}
+	for _, userManage := range s.userShards {
+		if userManage.hasRoomOffline(msg.RoomID) {
+			shards[userManage] = true
+		}
+	}
+	for userManage := range shards {
+		userManage.roomStoredQueue.push(msg)
+	}
+}
+
+// roomStoredQueue 房间分片放、用户分片取的房间消息。
+// 用户分片发消息会阻塞地等房间分片，反过来不能再阻塞，否则两边通道都满了会互相等
+type roomStoredQueue struct {
+	lock   sync.Mutex
+	msgs   []*UserRoomStoredMsg
+	notify chan bool // 有新的消息，容量1，没取走之前不重复通知
+}
+
+func newRoomStoredQueue() *roomStoredQueue {
+	return &roomStoredQueue{notify: make(chan bool, 1)}
+}
+
+func (q *roomStoredQueue) push(msg *UserRoomStoredMsg) {
+	q.lock.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.lock.Unlock()
+	select {
+	case q.notify <- true:
+	default:
+	}
+}
+
+// take 取走所有排着的消息，按放进来的顺序
+func (q *roomStoredQueue) take() []*UserRoomStoredMsg {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	msgs := q.msgs
+	q.msgs = nil
+	return msgs
+}
+
+// userShard 用户所在的分片。未登录的连接登录名为空，也落在固定的分片上，由它忽略
+func (s *Service) userShard(name string) *UserManage {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return s.userShards[h.Sum32()%uint32(len(s.userShards))]
+}
+
+// userNames 登录名和昵称的登记，不区分大小写。各个用户分片共用，查重不用问其他分片
+type userNames struct {
+	lock   sync.Mutex
+	owners map[string]string // 小写的名字对应的登录名
+}
+
+// claim 名字没被别人占用就记到owner名下，自己的登录名和昵称可以重复认领
+func (n *userNames) claim(name string, owner string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.owners == nil {
+		n.owners = make(map[string]string)
+	}
+	key := strings.ToLower(name)
+	if holder, ok := n.owners[key]; ok && holder != owner {
+		return false
+	}
+	n.owners[key] = owner
+	return true
+}
+
+// release 换掉的昵称放出来，登录名一直占着
+func (n *userNames) release(name string, owner string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	key := strings.ToLower(name)
+	if n.owners[key] == owner && !strings.EqualFold(name, owner) {
+		delete(n.owners, key)
+	}
+}
+
+// taken 名字已经是谁的登录名或昵称，不区分大小写
+func (n *userNames) taken(name string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	_, ok := n.owners[strings.ToLower(name)]
+	return ok
+}
+
+// isUser 是已有用户的登录名，大小写要一致
+func (n *userNames) isUser(name string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	holder, ok := n.owners[strings.ToLower(name)]
+	return ok && holder == name
+}
@@ -0,0 +1,372 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHarness_shards(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.RoomShards = 4
+	config.UserShards = 4
+	h := newTestHarness(t, config)
+	s := h.s
+	if s.userShard("alice") == s.userShard("bob") || s.userShard("bob") == s.userShard("carol") ||
+		s.userShard("alice") == s.userShard("carol") || s.roomShard(1) == s.roomShard(2) {
+		t.Fatal("test users and rooms should be on different shards")
+	}
+
+	alice := h.login("alice")
+	bob := h.login("bob")
+	carol := h.login("carol")
+	bob.joinRoom(1)
+	carol.joinRoom(2)
+	alice.joinRoom(1)
+	bob.expect("alice join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "alice"
+	})
+
+	// 换到另一个分片的房间，两边都收到通知
+	alice.joinRoom(2)
+	bob.expect("alice leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "alice"
+	})
+	carol.expect("alice join", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeJoin && baseMsg.UserName == "alice"
+	})
+	alice.send(Who)
+	alice.expect("who", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "room 2: alice(") && strings.Contains(baseMsg.Content, " carol(")
+	})
+
+	// 房间列表依次经过每个分片
+	alice.send(Rooms)
+	rooms := alice.expect("rooms", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "room 0: ")
+	})
+	lines := strings.Split(rooms.Content, "\n")
+	if len(lines) != RoomNum || !strings.HasPrefix(lines[1], "room 1: 1 users") || !strings.HasPrefix(lines[2], "room 2: 2 users") {
+		t.Errorf("rooms = %q", rooms.Content)
+	}
+
+	// @到别的分片的用户
+	chatMsg := alice.say("hi @bob and @carol")
+	for _, c := range []*testClient{bob, carol} {
+		c.expect("mention", func(baseMsg *BaseMsg) bool {
+			return baseMsg.Type == MsgTypeMention && baseMsg.MsgID == chatMsg.MsgID
+		})
+	}
+
+	// 按消息ID找到房间分片
+	alice.send(fmt.Sprintf("%s %d edited", Edit, chatMsg.MsgID))
+	carol.expect("edit", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeEdit && baseMsg.MsgID == chatMsg.MsgID && baseMsg.Content == "edited"
+	})
+
+	// 私聊、已读回执和查询统计跨用户分片
+	alice.send(Direct + " bob psst")
+	dm := bob.expect("direct", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeDirect && baseMsg.UserName == "alice" && baseMsg.Content == "psst"
+	})
+	bob.send(fmt.Sprintf("%s %d", Ack, dm.MsgID))
+	alice.expect("receipt", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeReceipt && baseMsg.MsgID == dm.MsgID && baseMsg.UserName == "bob"
+	})
+	alice.send(Stats + " bob")
+	alice.expect("bob stats", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeStats && strings.HasPrefix(baseMsg.Content, "stats bob")
+	})
+
+	// 昵称在所有分片里查重
+	bob.send(Nick + " Robert")
+	bob.expectContent(NickSuccess)
+	carol.send(Nick + " robert")
+	carol.expectContent(NameRepeat)
+	carol.send(Nick + " ALICE")
+	carol.expectContent(NameRepeat)
+
+	// 管理接口汇总所有分片
+	userInfos, err := s.adminManage.queryUsers()
+	if err != nil || len(userInfos) != 3 {
+		t.Errorf("queryUsers() = %d users, err %v", len(userInfos), err)
+	}
+	roomInfos, err := s.adminManage.queryRooms()
+	if err != nil || len(roomInfos) != RoomNum {
+		t.Fatalf("queryRooms() = %d rooms, err %v", len(roomInfos), err)
+	}
+	for i, roomInfo := range roomInfos {
+		if roomInfo.RoomID != i {
+			t.Fatalf("queryRooms() not sorted: %+v", roomInfos)
+		}
+	}
+	if len(roomInfos[2].Members) != 2 || roomInfos[2].MsgNum != 1 {
+		t.Errorf("room 2 info = %+v", roomInfos[2])
+	}
+
+	// 离线成员在别的分片，房间消息只通知有离线成员的分片
+	carol.send(Logout)
+	alice.expect("carol leave", func(baseMsg *BaseMsg) bool {
+		return baseMsg.Type == MsgTypeLeave && baseMsg.UserName == "carol"
+	})
+	alice.say("while you were away")
+	carol = h.login("carol")
+	carol.expectContent(fmt.Sprintf(OfflineMsg, 1))
+	carol.expectChat("alice", "while you were away")
+}
+
+func TestHarness_shardsRoomSwitch(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.RoomShards = 4
+	config.UserShards = 4
+	h := newTestHarness(t, config)
+	s := h.s
+
+	// 连着换房间不等回复，转发的加入可能比下一次的离开晚到
+	alice := h.login("alice")
+	for i := 0; i < 50; i++ {
+		alice.send(fmt.Sprintf("%s %d", ChangeRoom, 1+i%3))
+	}
+
+	// 最后一次换到房间2，只在房间2里
+	deadline := time.Now().Add(testExpectTimeout)
+	for {
+		roomInfos, err := s.adminManage.queryRooms()
+		if err != nil {
+			t.Fatal(err)
+		}
+		inRooms := make([]int, 0)
+		for _, roomInfo := range roomInfos {
+			if len(roomInfo.Members) > 0 {
+				inRooms = append(inRooms, roomInfo.RoomID)
+			}
+		}
+		if len(inRooms) == 1 && inRooms[0] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice in rooms %v, want [2]", inRooms)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	alice.send(Who)
+	alice.expect("who", func(baseMsg *BaseMsg) bool {
+		return strings.HasPrefix(baseMsg.Content, "room 2: alice(")
+	})
+}
+
+func TestHarness_shardsLogin(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.UserShards = 4
+	h := newTestHarness(t, config)
+	s := h.s
+	if s.userShard("alice") == s.userShard("bob") {
+		t.Fatal("test users should be on different shards")
+	}
+
+	// 连着发两个/name不等回复，两个名字在不同的分片，只能登录一个
+	c := h.dial()
+	c.send(Name + " alice")
+	c.send(Name + " bob")
+	replies := make([]string, 0)
+	for len(replies) < 2 {
+		c.expect("login reply", func(baseMsg *BaseMsg) bool {
+			switch baseMsg.Content {
+			case LoginSuccess, LoginPending, AlreadyLogin:
+				replies = append(replies, baseMsg.Content)
+				return true
+			}
+			return false
+		})
+	}
+	if replies[0] != LoginSuccess && replies[1] != LoginSuccess || replies[0] == replies[1] {
+		t.Errorf("login replies = %v", replies)
+	}
+	if s.userNames.taken("bob") {
+		t.Error("bob claimed by a conn already logged in as alice")
+	}
+
+	// 登录失败后可以换个名字再登录
+	other := h.dial()
+	other.send(Name + " ALICE")
+	other.expectContent(NameRepeat)
+	other.send(Name + " bob")
+	other.expectContent(LoginSuccess)
+}
+
+func TestService_roomStoredBurst(t *testing.T) {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.RoomShards = 1
+	config.UserShards = 1
+	h := newTestHarness(t, config)
+	// alice下线前在房间1，每条消息都要留言和提醒；不在线也不会推给连接
+	alice := h.login("alice")
+	alice.joinRoom(1)
+	alice.send(Logout)
+	deadline := time.Now().Add(testExpectTimeout)
+	for {
+		userInfos, err := h.s.adminManage.queryUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userInfos) == 1 && userInfos[0].Status != StatusOnline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice still online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 不等回复一直发，@到的用户分片要处理每一条。
+	// 用户分片往房间分片发、房间分片往用户分片通知，两边的通道都满了也不能互相等
+	const num = 5000
+	reply := make(chan *PostResult, num)
+	go func() {
+		for i := 0; i < num; i++ {
+			h.s.userShard("ci").userPostChan <- &UserPostMsg{
+				RoomID:      1,
+				UserName:    "ci",
+				Integration: "ci",
+				Content:     fmt.Sprintf("build %d for @alice", i),
+				Reply:       reply,
+			}
+		}
+	}()
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for i := 0; i < num; i++ {
+		select {
+		case result := <-reply:
+			if result.Err != "" {
+				t.Fatalf("post %d err %s", i, result.Err)
+			}
+		case <-timer.C:
+			t.Fatalf("only %d of %d posts stored", i, num)
+		}
+	}
+}
+
+// benchPopularMsgNum 压/popular的房间里先存的消息数
+const benchPopularMsgNum = 1000
+
+// benchService 没有客户端连接，只压用户分片和房间分片
+func benchService(b *testing.B, shards int) *Service {
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	config.RoomShards = shards
+	config.UserShards = shards
+	s := &Service{Config: config, Clock: NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))}
+	s.Start()
+	b.Cleanup(s.Stop)
+	return s
+}
+
+// benchPost 按集成发消息的路径走一遍用户分片和房间分片，等房间存下后返回
+func benchPost(s *Service, roomID int, userName string, content string) error {
+	msg := &UserPostMsg{
+		RoomID:      roomID,
+		UserName:    userName,
+		Integration: "bench",
+		Content:     content,
+		Reply:       make(chan *PostResult, 1),
+	}
+	s.userShard(userName).userPostChan <- msg
+	if result := <-msg.Reply; result.Err != "" {
+		return errors.New(result.Err)
+	}
+	return nil
+}
+
+// startPopular 房间先存一批消息，之后一直算/popular直到benchmark结束。
+// 每次用设置管理员的回复等房间分片处理过，不会一下子堆满通道
+func startPopular(b *testing.B, s *Service, roomID int) {
+	for i := 0; i < benchPopularMsgNum; i++ {
+		if err := benchPost(s, roomID, "popular", fmt.Sprintf("word%d some common words", i%100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	go func() {
+		defer close(doneChan)
+		rm := s.roomShard(roomID)
+		reply := make(chan bool, 1)
+		for {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+			rm.roomPopularChan <- &RoomPopularMsg{RoomID: roomID}
+			rm.roomOpChan <- &RoomOpMsg{RoomID: roomID, Name: "popular", Reply: reply}
+			<-reply
+			// 和房间协程来回唤醒时会一直占着调度，让其他协程先跑
+			runtime.Gosched()
+		}
+	}()
+	b.Cleanup(func() {
+		close(stopChan)
+		<-doneChan
+	})
+}
+
+// benchmarkShards 单协程和按核数分片对比，用 -cpu 1,2,4,8 看随核数的变化。
+// 每个并发的发送人固定一个房间，避开房间0
+func benchmarkShards(b *testing.B, load func(b *testing.B, s *Service)) {
+	for _, bench := range []struct {
+		name   string
+		shards int
+	}{
+		{"single", 1},
+		{"sharded", runtime.GOMAXPROCS(0)},
+	} {
+		bench := bench
+		b.Run(bench.name, func(b *testing.B) {
+			s := benchService(b, bench.shards)
+			load(b, s)
+
+			var lastSender int32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				sender := atomic.AddInt32(&lastSender, 1)
+				roomID := 1 + int(sender)%(RoomNum-1)
+				userName := fmt.Sprintf("bench%d", sender)
+				for pb.Next() {
+					if err := benchPost(s, roomID, userName, "hello from bench"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPost(b *testing.B) {
+	benchmarkShards(b, func(b *testing.B, s *Service) {})
+}
+
+// BenchmarkPostPopular 房间0一直在算/popular时其他房间的吞吐
+func BenchmarkPostPopular(b *testing.B) {
+	benchmarkShards(b, func(b *testing.B, s *Service) {
+		startPopular(b, s, 0)
+	})
+}
@@ -0,0 +1,161 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (um *UserManage) statLogic(msg *UserStatsMsg) {
+	// 时间按查询人的时区显示，被查的人时区不同时再带上他那边的时间，没登录或没设置用服务器时区。
+	// 先在查询人的分片取时区，被查的用户在别的分片再转过去
+	if msg.Loc == nil {
+		msg.Loc = time.Local
+		if viewer := um.users[um.userConnIDToName[msg.ConnID]]; viewer != nil {
+			msg.Loc = viewer.location()
+		}
+		if shard := um.s.userShard(msg.Name); shard != um {
+			shard.userStatMsgChan <- msg
+			return
+		}
+	}
+
+	user := um.users[msg.Name]
+	if user == nil {
+		um.sendSingleMsg(msg.ConnID, UserNotFound)
+		return
+	}
+	connIDs := make([]int, 0)
+	connIDs = append(connIDs, msg.ConnID)
+	pushToOtherMsg := make([]*BaseMsg, 0)
+	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
+		Type:     MsgTypeStats,
+		UserName: user.Name,
+		Content:  user.statsString(um.s.now(), msg.Loc),
+	})
+	pushMsg := &PushMsg{
+		ConnID:  connIDs,
+		PushMsg: pushToOtherMsg,
+	}
+	um.s.msgManage.pushMsgChan <- pushMsg
+}
+
+func (u *User) addRoomMsg(roomID int, msgTime int64) {
+	if u.RoomMsgCount == nil {
+		u.RoomMsgCount = make(map[int]int)
+	}
+	u.RoomMsgCount[roomID]++
+	u.LastMsgTime = msgTime
+}
+
+func (u *User) presence(now int64) string {
+	if u.Status != StatusOnline {
+		return PresenceOffline
+	}
+	activeTime := u.LoginTime
+	if u.LastMsgTime > activeTime {
+		activeTime = u.LastMsgTime
+	}
+	if now-activeTime > RoomIdleSecond {
+		return PresenceIdle
+	}
+	return PresenceActive
+}
+
+func (u *User) location() *time.Location {
+	if u.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// statsString 每行一项，时间按查询人的时区loc显示，都带上UTC偏移
+func (u *User) statsString(now int64, loc *time.Location) string {
+	userLoc := u.location()
+	presence := u.presence(now)
+	if u.Status == StatusOnline && u.RoomID != 0 {
+		presence += fmt.Sprintf(" in room %d", u.RoomID)
+	}
+	if len(u.ConnIDs) > 1 {
+		presence += fmt.Sprintf(", %d connections", len(u.ConnIDs))
+	}
+
+	lines := []string{
+		fmt.Sprintf("stats %s", u.Name),
+		fmt.Sprintf("userID: %d", u.UserID),
+		fmt.Sprintf("displayName: %s", u.displayName()),
+		fmt.Sprintf("status: %s", u.StatusText),
+		fmt.Sprintf("timezone: %s (%s)", userLoc, zoneOffset(time.Unix(now, 0).In(userLoc))),
+		fmt.Sprintf("presence: %s", presence),
+		fmt.Sprintf("lastLogin: %s", formatStatsTime(u.LoginTime, loc, userLoc)),
+		fmt.Sprintf("lastLogout: %s", formatStatsTime(u.LogoutTime, loc, userLoc)),
+		fmt.Sprintf("lastMessage: %s", formatStatsTime(u.LastMsgTime, loc, userLoc)),
+		fmt.Sprintf("sessions: %d, avg %s", u.SessionCount, formatStatsDuration(u.avgSessionTime(now))),
+		fmt.Sprintf("onlineTime: %s, last %s: %s", formatStatsDuration(u.onlineTime(now)),
+			formatStatsDuration(RollingOnlineSecond), formatStatsDuration(u.rollingOnlineTime(now, RollingOnlineSecond))),
+		fmt.Sprintf("messages: %s", formatRoomMsgCount(u.RoomMsgCount)),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatStatsTime 按查询人的时区显示，被查的人偏移不同时后面再带上他那边的时间
+func formatStatsTime(unix int64, loc *time.Location, userLoc *time.Location) string {
+	if unix == 0 {
+		return "never"
+	}
+	t := time.Unix(unix, 0)
+	viewerTime := formatZoneTime(t.In(loc))
+	userTime := formatZoneTime(t.In(userLoc))
+	if userTime == viewerTime {
+		return viewerTime
+	}
+	return viewerTime + ", their time " + userTime
+}
+
+func formatZoneTime(t time.Time) string {
+	return fmt.Sprintf("%s (%s)", t.Format(StatsTimeLayout), zoneOffset(t))
+}
+
+// zoneOffset 形如UTC、UTC+8、UTC-3:30
+func zoneOffset(t time.Time) string {
+	_, offset := t.Zone()
+	if offset == 0 {
+		return "UTC"
+	}
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	if offset%3600 == 0 {
+		return fmt.Sprintf("UTC%s%d", sign, offset/3600)
+	}
+	return fmt.Sprintf("UTC%s%d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+func formatStatsDuration(second int64) string {
+	return (time.Duration(second) * time.Second).String()
+}
+
+// formatRoomMsgCount 按房间号排序，最后带上总数
+func formatRoomMsgCount(roomMsgCount map[int]int) string {
+	roomIDs := make([]int, 0, len(roomMsgCount))
+	for roomID := range roomMsgCount {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Ints(roomIDs)
+
+	total := 0
+	countArr := make([]string, 0, len(roomIDs)+1)
+	for _, roomID := range roomIDs {
+		total += roomMsgCount[roomID]
+		countArr = append(countArr, fmt.Sprintf("room %d: %d", roomID, roomMsgCount[roomID]))
+	}
+	countArr = append(countArr, fmt.Sprintf("total %d", total))
+	return strings.Join(countArr, ", ")
+}
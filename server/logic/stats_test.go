@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUser_statsString(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	login := time.Date(2024, 1, 2, 10, 0, 0, 0, loc).Unix()
+	user := &User{
+		UserID:      7,
+		Name:        "alice",
+		DisplayName: "Queen",
+		Timezone:    "Asia/Shanghai",
+		LoginTime:   login,
+		LogoutTime:  login - 3600,
+		RoomID:      3,
+		Status:      StatusOnline,
+	}
+	user.startSession(1, login-5400)
+	user.endSession(1, login-3600)
+	user.startSession(2, login)
+	user.addRoomMsg(3, login+60)
+	user.addRoomMsg(1, login+90)
+	user.addRoomMsg(3, login+120)
+
+	got := user.statsString(login+600, loc)
+	wants := []string{
+		"userID: 7",
+		"displayName: Queen",
+		"presence: idle in room 3",
+		"timezone: Asia/Shanghai (UTC+8)",
+		"lastLogin: 2024-01-02 10:00:00 (UTC+8)\n",
+		"lastLogout: 2024-01-02 09:00:00 (UTC+8)\n",
+		"lastMessage: 2024-01-02 10:02:00 (UTC+8)\n",
+		"sessions: 2, avg 20m0s",
+		"onlineTime: 40m0s, last 24h0m0s: 40m0s",
+		"messages: room 1: 1, room 3: 2, total 3",
+	}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Errorf("statsString() missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestUser_statsStringOtherZone(t *testing.T) {
+	viewerLoc, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	login := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC).Unix()
+	user := &User{
+		Name:      "bob",
+		Timezone:  "America/Sao_Paulo",
+		LoginTime: login,
+		Status:    StatusOnline,
+	}
+
+	got := user.statsString(login, viewerLoc)
+	wants := []string{
+		"timezone: America/Sao_Paulo (UTC-3)",
+		"lastLogin: 2024-01-02 15:30:00 (UTC+5:30), their time 2024-01-02 07:00:00 (UTC-3)",
+		"lastLogout: never",
+	}
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Errorf("statsString() missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestUser_presence(t *testing.T) {
+	user := &User{Status: StatusOnline, LoginTime: 1000}
+	if got := user.presence(1000 + RoomIdleSecond); got != PresenceActive {
+		t.Errorf("presence() = %s, want %s", got, PresenceActive)
+	}
+	if got := user.presence(1001 + RoomIdleSecond); got != PresenceIdle {
+		t.Errorf("presence() = %s, want %s", got, PresenceIdle)
+	}
+
+	user.Status = StatusLogout
+	if got := user.presence(1000); got != PresenceOffline {
+		t.Errorf("presence() = %s, want %s", got, PresenceOffline)
+	}
+	if got := formatStatsTime(0, time.UTC, time.UTC); got != "never" {
+		t.Errorf("formatStatsTime(0) = %s, want never", got)
+	}
+}
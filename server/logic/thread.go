@@ -0,0 +1,95 @@
+package logic
+
+type Reaction struct {
+	Emoji string
+	Users []string // 按回应先后排列
+}
+
+func (rm *RoomManage) roomReactLogic(msg *RoomReactMsg) {
+	room, cMsg := rm.findRoomMsg(msg.MsgID)
+	if cMsg == nil || cMsg.Deleted {
+		rm.sendSingleMsg(msg.ConnID, MsgNotFound)
+		return
+	}
+
+	// 只能回应自己所在房间的消息
+	if !room.hasUser(msg.ConnID) {
+		rm.sendSingleMsg(msg.ConnID, NotRoomMember)
+		return
+	}
+
+	changed := false
+	if msg.Remove {
+		changed = cMsg.removeReaction(msg.Emoji, msg.UserName)
+	} else {
+		changed = cMsg.addReaction(msg.Emoji, msg.UserName)
+	}
+	if !changed {
+		return
+	}
+
+	// 通知房间内所有人更新
+	baseMsg := cMsg.toBaseMsg(MsgTypeReaction)
+	baseMsg.UserName = msg.UserName
+	baseMsg.Content = msg.Emoji
+	rm.pushToRoom(room, 0, baseMsg)
+	baseMsgCopy := *baseMsg
+	rm.publishUpdate(cMsg, &baseMsgCopy)
+}
+
+// addReaction 同一个人对同一个表情只算一次
+func (c *ChatMsg) addReaction(emoji string, userName string) bool {
+	for _, reaction := range c.Reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		for _, name := range reaction.Users {
+			if name == userName {
+				return false
+			}
+		}
+		reaction.Users = append(reaction.Users, userName)
+		return true
+	}
+
+	c.Reactions = append(c.Reactions, &Reaction{
+		Emoji: emoji,
+		Users: []string{userName},
+	})
+	return true
+}
+
+func (c *ChatMsg) removeReaction(emoji string, userName string) bool {
+	for i, reaction := range c.Reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		for j, name := range reaction.Users {
+			if name != userName {
+				continue
+			}
+			reaction.Users = append(reaction.Users[:j], reaction.Users[j+1:]...)
+			// 没人回应的表情去掉
+			if len(reaction.Users) == 0 {
+				c.Reactions = append(c.Reactions[:i], c.Reactions[i+1:]...)
+			}
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+func cloneReactions(reactions []*Reaction) []*Reaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+	reactionsCopy := make([]*Reaction, 0, len(reactions))
+	for _, reaction := range reactions {
+		reactionsCopy = append(reactionsCopy, &Reaction{
+			Emoji: reaction.Emoji,
+			Users: append([]string(nil), reaction.Users...),
+		})
+	}
+	return reactionsCopy
+}
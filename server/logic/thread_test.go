@@ -0,0 +1,40 @@
+package logic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChatMsg_reactions(t *testing.T) {
+	cMsg := &ChatMsg{MsgID: 1}
+	steps := []struct {
+		name    string
+		emoji   string
+		user    string
+		remove  bool
+		changed bool
+		want    []*Reaction
+	}{
+		{"add", "+1", "alice", false, true, []*Reaction{{"+1", []string{"alice"}}}},
+		{"add_twice", "+1", "alice", false, false, []*Reaction{{"+1", []string{"alice"}}}},
+		{"add_other_user", "+1", "bob", false, true, []*Reaction{{"+1", []string{"alice", "bob"}}}},
+		{"add_other_emoji", "tada", "bob", false, true, []*Reaction{{"+1", []string{"alice", "bob"}}, {"tada", []string{"bob"}}}},
+		{"remove", "+1", "alice", true, true, []*Reaction{{"+1", []string{"bob"}}, {"tada", []string{"bob"}}}},
+		{"remove_missing", "+1", "alice", true, false, []*Reaction{{"+1", []string{"bob"}}, {"tada", []string{"bob"}}}},
+		{"remove_last", "+1", "bob", true, true, []*Reaction{{"tada", []string{"bob"}}}},
+	}
+	for _, tt := range steps {
+		changed := false
+		if tt.remove {
+			changed = cMsg.removeReaction(tt.emoji, tt.user)
+		} else {
+			changed = cMsg.addReaction(tt.emoji, tt.user)
+		}
+		if changed != tt.changed {
+			t.Errorf("%s changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+		if !reflect.DeepEqual(cMsg.Reactions, tt.want) {
+			t.Errorf("%s reactions = %v, want %v", tt.name, cMsg.Reactions, tt.want)
+		}
+	}
+}
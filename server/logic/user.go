@@ -8,35 +8,76 @@ import (
 	"os"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
+// UserManage 管理一个分片里的用户，按登录名分片
 type UserManage struct {
-	s *Service
+	s     *Service
+	shard int // 第几个分片
 
 	badWords []string
 
 	users            map[string]*User
 	userConnIDToName map[int]string
-
-	userNameMsgChan   chan *UserNameMsg   // 取名
-	userRoomMsgChan   chan *UserRoomMsg   // 选择房间
-	userSendMsgChan   chan *UserSendMsg   // 聊天消息
-	userStatMsgChan   chan *UserStatsMsg  // 用户状态
-	userLogoutMsgChan chan *UserLogoutMsg // 用户登出
+	roomBans         map[int]map[string]bool // 房间封禁的用户
+	roomOfflineUsers map[int]map[string]bool // 离线前在房间里的用户
+	roomOfflineNum   [RoomNum]int32          // 每个房间离线的用户数，房间分片按它决定要不要通知这个分片
+	remoteNodes      map[string]map[int]bool // 在其他节点在线的用户和所在节点
+
+	userNameMsgChan   chan *UserNameMsg        // 取名
+	userRoomMsgChan   chan *UserRoomMsg        // 选择房间
+	userSendMsgChan   chan *UserSendMsg        // 聊天消息
+	userPostChan      chan *UserPostMsg        // 集成通过HTTP接口发消息
+	userStatMsgChan   chan *UserStatsMsg       // 用户状态
+	userLogoutMsgChan chan *UserLogoutMsg      // 用户登出
+	userQueryChan     chan *UserQueryMsg       // 查询用户
+	userBadWordsChan  chan []string            // 更新脏词库
+	userSearchChan    chan *UserSearchMsg      // 搜索房间消息
+	userHistoryChan   chan *RoomHistoryPageMsg // 分页拉取历史消息
+	userBanChan       chan *UserBanMsg         // 房间封禁
+	userEditChan      chan *UserEditMsg        // 编辑删除消息
+	userReactChan     chan *UserReactMsg       // 表情回应
+	userDirectChan    chan *UserDirectMsg      // 私聊
+	roomStoredQueue   *roomStoredQueue         // 房间消息已保存，房间分片放进来
+	userMentionsChan  chan *UserMentionsMsg    // 查询@提醒
+	userAckChan       chan *UserAckMsg         // 确认已读
+	userRoomsChan     chan *UserRoomsMsg       // 房间列表
+	userNickChan      chan *UserNickMsg        // 修改昵称
+	userProfileChan   chan *UserProfileMsg     // 修改个人资料
+	userRemoteChan    chan *backplaneEvent     // 其他节点的私聊、在线状态、封禁和名字认领
+	userReceiptChan   chan *BaseMsg            // 别的分片转来的私聊已读回执
 
 	wg        sync.WaitGroup
 	closeChan chan bool
 }
 
 type User struct {
+	UserID     int64 // 第一次登录时分配，改昵称不变
 	Name       string
-	LoginTime  int64
-	LogoutTime int64
-	OnlineTime int64
+	LoginTime  int64 // 这次上线的时间，多端登录时为第一个连接登录的时间
+	LogoutTime int64 // 最近一次下线的时间
+	OnlineTime int64 // 已归档会话的在线时长，当前的从Sessions算
 	RoomID     int
-	ConnID     int
+	ConnIDs    map[int]bool // 在线的连接，可以多端同时登录
 	Status     int
+	LastRoomID int           // 下线前所在的房间
+	Inbox      []*InboxItem  // 离线消息
+	Mentions   []*BaseMsg    // 最近被@的消息
+	Directs    []*DirectItem // 最近收到的私聊
+
+	DisplayName string // 昵称，为空显示登录名
+	StatusText  string // 状态签名
+	Timezone    string // 时区，为空用服务器时区
+
+	Sessions     []*Session  // 最近的会话，按登录时间排列
+	SessionCount int         // 登录次数，包括已归档的
+	SessionTime  int64       // 已归档会话的时长之和，不合并重叠
+	ArchiveTime  int64       // 已归档会话最晚的结束时间
+	LastMsgTime  int64       // 最近一次房间发言时间
+	RoomMsgCount map[int]int // 每个房间的发言数
+
+	RecentMsgTimes []int64 // 最近的发言时间，spam中间件用
 }
 
 func (um *UserManage) init(s *Service) {
@@ -44,11 +85,31 @@ func (um *UserManage) init(s *Service) {
 	um.users = make(map[string]*User)
 	um.badWords = make([]string, 0)
 	um.userConnIDToName = make(map[int]string)
+	um.roomBans = make(map[int]map[string]bool)
+	um.roomOfflineUsers = make(map[int]map[string]bool)
+	um.remoteNodes = make(map[string]map[int]bool)
 	um.userNameMsgChan = make(chan *UserNameMsg, 64)
 	um.userRoomMsgChan = make(chan *UserRoomMsg, 64)
 	um.userSendMsgChan = make(chan *UserSendMsg, 1024)
+	um.userPostChan = make(chan *UserPostMsg, 64)
 	um.userStatMsgChan = make(chan *UserStatsMsg, 64)
 	um.userLogoutMsgChan = make(chan *UserLogoutMsg, 64)
+	um.userQueryChan = make(chan *UserQueryMsg, 64)
+	um.userBadWordsChan = make(chan []string, 8)
+	um.userSearchChan = make(chan *UserSearchMsg, 1024)
+	um.userHistoryChan = make(chan *RoomHistoryPageMsg, 1024)
+	um.userBanChan = make(chan *UserBanMsg, 64)
+	um.userEditChan = make(chan *UserEditMsg, 1024)
+	um.userReactChan = make(chan *UserReactMsg, 1024)
+	um.userDirectChan = make(chan *UserDirectMsg, 1024)
+	um.roomStoredQueue = newRoomStoredQueue()
+	um.userMentionsChan = make(chan *UserMentionsMsg, 64)
+	um.userAckChan = make(chan *UserAckMsg, 1024)
+	um.userRoomsChan = make(chan *UserRoomsMsg, 64)
+	um.userNickChan = make(chan *UserNickMsg, 64)
+	um.userProfileChan = make(chan *UserProfileMsg, 64)
+	um.userRemoteChan = make(chan *backplaneEvent, 1024)
+	um.userReceiptChan = make(chan *BaseMsg, 1024)
 	um.closeChan = make(chan bool, 1)
 }
 
@@ -69,22 +130,35 @@ func (um *UserManage) Stop() {
 }
 
 func (um *UserManage) loadBadWords() {
-	listFile, err := os.Open("list.txt")
+	badWords, err := readBadWords(um.s.Config.BadWordsFile)
 	if err != nil {
 		log.Printf("load bad words err %s", err.Error())
 		return
 	}
+	um.badWords = badWords
+}
+
+func readBadWords(fileName string) ([]string, error) {
+	listFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
 	defer listFile.Close()
 
+	badWords := make([]string, 0)
 	br := bufio.NewReader(listFile)
 	for {
 		line, _, err := br.ReadLine()
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
 
-		um.badWords = append(um.badWords, string(line))
+		badWords = append(badWords, string(line))
 	}
+	return badWords, nil
 }
 
 func (um *UserManage) userLogic() {
@@ -97,10 +171,51 @@ func (um *UserManage) userLogic() {
 			um.chooseRoomLogic(roomMsg)
 		case sendMsg := <-um.userSendMsgChan:
 			um.sendMsgLogic(sendMsg)
+		case postMsg := <-um.userPostChan:
+			um.postLogic(postMsg)
 		case statMsg := <-um.userStatMsgChan:
 			um.statLogic(statMsg)
 		case logoutMsg := <-um.userLogoutMsgChan:
 			um.logoutLogic(logoutMsg)
+		case queryMsg := <-um.userQueryChan:
+			um.queryLogic(queryMsg)
+		case badWords := <-um.userBadWordsChan:
+			um.badWords = badWords
+			log.Printf("reload bad words %d", len(badWords))
+		case searchMsg := <-um.userSearchChan:
+			um.searchLogic(searchMsg)
+		case historyMsg := <-um.userHistoryChan:
+			um.historyLogic(historyMsg)
+		case banMsg := <-um.userBanChan:
+			um.banLogic(banMsg)
+		case editMsg := <-um.userEditChan:
+			um.editLogic(editMsg)
+		case reactMsg := <-um.userReactChan:
+			um.reactLogic(reactMsg)
+		case directMsg := <-um.userDirectChan:
+			um.directLogic(directMsg)
+		case <-um.roomStoredQueue.notify:
+			for _, roomStoredMsg := range um.roomStoredQueue.take() {
+				um.roomStoredLogic(roomStoredMsg)
+			}
+		case mentionsMsg := <-um.userMentionsChan:
+			um.mentionsLogic(mentionsMsg)
+		case ackMsg := <-um.userAckChan:
+			um.ackLogic(ackMsg)
+		case roomsMsg := <-um.userRoomsChan:
+			// 带上用户名，房间管理算未读数
+			um.s.roomShards[0].roomListChan <- &RoomListMsg{
+				ConnID:   roomsMsg.ConnID,
+				UserName: um.userConnIDToName[roomsMsg.ConnID],
+			}
+		case nickMsg := <-um.userNickChan:
+			um.nickLogic(nickMsg)
+		case profileMsg := <-um.userProfileChan:
+			um.profileLogic(profileMsg)
+		case event := <-um.userRemoteChan:
+			um.userRemoteLogic(event)
+		case receipt := <-um.userReceiptChan:
+			um.receiptLogic(receipt)
 		case <-um.closeChan:
 			return
 		}
@@ -115,25 +230,64 @@ func (um *UserManage) nameLogic(msg *UserNameMsg) {
 		return
 	}
 
-	user := um.users[msg.Name]
-	if user != nil && user.Status == StatusOnline {
-		um.sendSingleMsg(msg.ConnID, NameRepeat)
+	// 登录失败也经过消息管理回复，这个连接才能再发/name
+	if !um.validName(msg.Name) {
+		um.s.msgManage.connLoginChan <- &ConnLoginMsg{ConnID: msg.ConnID, Err: NameInvalid}
 		return
 	}
 
+	// 不区分大小写，和别人的登录名或昵称重复都不行
+	if !um.s.userNames.claim(msg.Name, msg.Name) {
+		um.s.msgManage.connLoginChan <- &ConnLoginMsg{ConnID: msg.ConnID, Err: NameRepeat}
+		return
+	}
+
+	user := um.users[msg.Name]
 	if user == nil {
 		user = &User{
-			Name: msg.Name,
+			UserID: atomic.AddInt64(&um.s.lastUserID, 1),
+			Name:   msg.Name,
 		}
 		um.users[msg.Name] = user
+		um.publishName(msg.Name, msg.Name, true)
 	}
-	user.ConnID = msg.ConnID
-	user.LoginTime = time.Now().Unix()
-	user.Status = StatusOnline
+	// 已经在线的是多端登录，每个连接都记一次会话
+	now := um.s.now()
+	firstConn := user.Status != StatusOnline
+	user.addConn(msg.ConnID)
+	user.startSession(msg.ConnID, now)
 	um.userConnIDToName[msg.ConnID] = msg.Name
+	if firstConn {
+		user.LoginTime = now
+		user.Status = StatusOnline
+		um.delRoomOfflineUser(user.LastRoomID, user.Name)
+		um.publishPresence(user.Name, true)
+	}
+
+	// 发消息，登录成功，消息管理记下连接对应的用户后再回复
+	um.s.msgManage.connLoginChan <- &ConnLoginMsg{
+		ConnID:   msg.ConnID,
+		UserName: user.Name,
+	}
+
+	if firstConn {
+		// 投递离线消息
+		um.deliverInbox(user, msg.ConnID, user.LoginTime)
+		return
+	}
 
-	// 发消息，登录成功
-	um.sendSingleMsg(msg.ConnID, LoginSuccess)
+	// 新连接跟着进入当前所在的房间
+	if user.RoomID != 0 {
+		roomChangeMsg := &RoomChangeMsg{
+			OldRoomID:   -1,
+			NewRoomID:   user.RoomID,
+			ConnID:      msg.ConnID,
+			UserName:    user.Name,
+			DisplayName: user.DisplayName,
+			Seq:         um.s.nextRoomSeq(msg.ConnID),
+		}
+		um.s.roomChangeShard(roomChangeMsg).roomChangeChan <- roomChangeMsg
+	}
 }
 
 func (um *UserManage) chooseRoomLogic(msg *UserRoomMsg) {
@@ -151,30 +305,27 @@ func (um *UserManage) chooseRoomLogic(msg *UserRoomMsg) {
 		return
 	}
 
+	// 被房间封禁
+	if um.roomBans[msg.RoomID][userName] {
+		um.sendSingleMsg(msg.ConnID, RoomBanned)
+		return
+	}
+
 	lastRoomID := user.RoomID
 	user.RoomID = msg.RoomID
 
-	// 发消息，选择房间成功
-	connIDs := make([]int, 0)
-	connIDs = append(connIDs, msg.ConnID)
-	pushToOtherMsg := make([]*BaseMsg, 0)
-	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
-		UserName: "",
-		Content:  JoinRoomSuccess,
-	})
-	pushMsg := &PushMsg{
-		ConnID:  connIDs,
-		PushMsg: pushToOtherMsg,
-	}
-	um.s.msgManage.pushMsgChan <- pushMsg
-
-	// 通知房间管理
-	roomChangeMsg := &RoomChangeMsg{
-		OldRoomID: lastRoomID,
-		NewRoomID: msg.RoomID,
-		ConnID:    user.ConnID,
+	// 通知房间管理，所有连接一起切换，进房间后由房间管理回复成功
+	for _, connID := range user.connIDList() {
+		roomChangeMsg := &RoomChangeMsg{
+			OldRoomID:   lastRoomID,
+			NewRoomID:   msg.RoomID,
+			ConnID:      connID,
+			UserName:    userName,
+			DisplayName: user.DisplayName,
+			Seq:         um.s.nextRoomSeq(connID),
+		}
+		um.s.roomChangeShard(roomChangeMsg).roomChangeChan <- roomChangeMsg
 	}
-	um.s.roomManage.roomChangeChan <- roomChangeMsg
 }
 
 func (um *UserManage) sendMsgLogic(msg *UserSendMsg) {
@@ -190,35 +341,136 @@ func (um *UserManage) sendMsgLogic(msg *UserSendMsg) {
 		return
 	}
 
-	// 单词过滤
-	msgContent := msg.Content
-	for _, word := range um.badWords {
-		msgContent = strings.ReplaceAll(msgContent, word, "*")
+	inboundMsg := &InboundMsg{
+		um:       um,
+		ConnID:   msg.ConnID,
+		UserName: userName,
+		RoomID:   user.RoomID,
+		Content:  msg.Content,
+		ParentID: msg.ParentID,
+		Time:     um.s.now(),
 	}
+	if err := um.routeMsg(inboundMsg, user.DisplayName, nil); err != nil {
+		um.sendSingleMsg(msg.ConnID, err.Error())
+	}
+}
+
+// postLogic 集成发的消息没有连接，检查完和普通聊天走同一条路
+func (um *UserManage) postLogic(msg *UserPostMsg) {
+	if msg.RoomID < 0 || msg.RoomID > RoomNum-1 {
+		msg.Reply <- &PostResult{Err: RoomIDErr}
+		return
+	}
+	if !um.validName(msg.UserName) {
+		msg.Reply <- &PostResult{Err: NameInvalid}
+		return
+	}
+	if um.roomBans[msg.RoomID][msg.UserName] {
+		msg.Reply <- &PostResult{Err: RoomBanned}
+		return
+	}
+	// 先用集成的名义占住这个名字再发，发到房间之前别人认领不了，发完放掉。
+	// 登录名的认领也在这个分片，已有用户的登录名或昵称都占不到
+	owner := "integration:" + msg.Integration
+	if !um.s.userNames.claim(msg.UserName, owner) {
+		msg.Reply <- &PostResult{Err: postAsTaken}
+		return
+	}
+	defer um.s.userNames.release(msg.UserName, owner)
+
+	inboundMsg := &InboundMsg{
+		um:          um,
+		UserName:    msg.UserName,
+		RoomID:      msg.RoomID,
+		Content:     msg.Content,
+		Time:        um.s.now(),
+		Integration: msg.Integration,
+	}
+	if err := um.routeMsg(inboundMsg, "", msg.Reply); err != nil {
+		msg.Reply <- &PostResult{Err: err.Error()}
+	}
+}
 
-	// 发消息给房间
-	roomMsg := &RoomReceiveMsg{
-		ConnID:   user.ConnID,
+// routeMsg 经过房间启用的中间件，找出@到的用户，发给房间
+func (um *UserManage) routeMsg(inboundMsg *InboundMsg, displayName string, reply chan *PostResult) error {
+	if err := um.s.middlewares.inbound(inboundMsg); err != nil {
+		return err
+	}
+
+	mentions := make([]string, 0)
+	for _, name := range parseMentions(inboundMsg.Content) {
+		if name != inboundMsg.UserName && um.s.userNames.isUser(name) {
+			mentions = append(mentions, name)
+		}
+	}
+
+	um.s.roomShard(inboundMsg.RoomID).roomReceiveMsgChan <- &RoomReceiveMsg{
+		ConnID:      inboundMsg.ConnID,
+		UserName:    inboundMsg.UserName,
+		DisplayName: displayName,
+		RoomID:      inboundMsg.RoomID,
+		Content:     inboundMsg.Content,
+		ParentID:    inboundMsg.ParentID,
+		Mentions:    mentions,
+		Annotations: inboundMsg.Annotations,
+		Integration: inboundMsg.Integration,
+		Reply:       reply,
+	}
+	return nil
+}
+
+func (um *UserManage) editLogic(msg *UserEditMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
+		return
+	}
+
+	// 编辑后的内容和新消息一样经过消息所在房间的中间件
+	editMsg := &RoomEditMsg{
+		ConnID:   msg.ConnID,
 		UserName: userName,
-		RoomID:   user.RoomID,
-		Content:  msgContent,
+		MsgID:    msg.MsgID,
+		Delete:   msg.Delete,
+	}
+	if !msg.Delete {
+		inboundMsg := &InboundMsg{
+			um:       um,
+			ConnID:   msg.ConnID,
+			UserName: userName,
+			RoomID:   int(msg.MsgID % MsgIDRoomBase),
+			Content:  msg.Content,
+			Time:     um.s.now(),
+		}
+		if err := um.s.middlewares.inbound(inboundMsg); err != nil {
+			um.sendSingleMsg(msg.ConnID, err.Error())
+			return
+		}
+		editMsg.Content = inboundMsg.Content
+		editMsg.Annotations = inboundMsg.Annotations
 	}
-	um.s.roomManage.roomReceiveMsgChan <- roomMsg
+	um.s.msgRoomShard(msg.MsgID).roomEditChan <- editMsg
 }
 
-func (um *UserManage) statLogic(msg *UserStatsMsg) {
-	user := um.users[msg.Name]
-	if user == nil {
+func (um *UserManage) reactLogic(msg *UserReactMsg) {
+	userName := um.userConnIDToName[msg.ConnID]
+	if userName == "" {
 		return
 	}
 
-	// 发消息
-	onlineTime := user.OnlineTime
-	if user.LogoutTime < user.LoginTime {
-		onlineTime += time.Now().Unix() - user.LoginTime
+	um.s.msgRoomShard(msg.MsgID).roomReactChan <- &RoomReactMsg{
+		ConnID:   msg.ConnID,
+		UserName: userName,
+		MsgID:    msg.MsgID,
+		Emoji:    msg.Emoji,
+		Remove:   msg.Remove,
 	}
-	content := fmt.Sprintf("loginTime:%d onlineTime:%d roomID:%d", user.LoginTime, onlineTime, user.RoomID)
-	um.sendSingleMsg(msg.ConnID, content)
+}
+
+func (um *UserManage) filterBadWords(content string) string {
+	for _, word := range um.badWords {
+		content = strings.ReplaceAll(content, word, "*")
+	}
+	return content
 }
 
 func (um *UserManage) logoutLogic(msg *UserLogoutMsg) {
@@ -230,19 +482,171 @@ func (um *UserManage) logoutLogic(msg *UserLogoutMsg) {
 	if user == nil {
 		return
 	}
+	now := um.s.now()
+	delete(um.userConnIDToName, msg.ConnID)
+	um.s.msgManage.connLoginChan <- &ConnLoginMsg{
+		ConnID: msg.ConnID,
+	}
+	user.delConn(msg.ConnID)
+	user.endSession(msg.ConnID, now)
+	// 还没到的加入不再生效
+	um.s.roomSeqs.Delete(msg.ConnID)
+
+	// 最后一个连接，移出房间前先记成离线成员，之后房间的消息一定会通知到这个分片
+	if len(user.ConnIDs) == 0 && user.RoomID != 0 {
+		um.addRoomOfflineUser(user.RoomID, user.Name)
+	}
+
+	// 先把这个连接移出房间，RoomID清零前通知
+	if user.RoomID != 0 {
+		um.s.roomShard(user.RoomID).roomLogoutMsg <- &RoomLogoutMsg{
+			ConnID:   msg.ConnID,
+			RoomID:   user.RoomID,
+			UserName: userName,
+		}
+	}
+
+	// 还有其他连接在线，不算下线
+	if len(user.ConnIDs) > 0 {
+		return
+	}
 
-	now := time.Now().Unix()
-	user.OnlineTime += now - user.LoginTime
 	user.LogoutTime = now
 	user.Status = StatusLogout
+	um.publishPresence(user.Name, false)
+	if user.RoomID != 0 {
+		user.LastRoomID = user.RoomID
+	}
 	user.RoomID = 0
+}
+
+func (um *UserManage) searchLogic(msg *UserSearchMsg) {
+	if !um.checkRoomRead(msg.ConnID, msg.RoomID) {
+		return
+	}
+
+	um.s.roomShard(msg.RoomID).roomSearchChan <- &RoomSearchMsg{
+		ConnID: msg.ConnID,
+		RoomID: msg.RoomID,
+		Query:  msg.Query,
+	}
+}
+
+func (um *UserManage) historyLogic(msg *RoomHistoryPageMsg) {
+	if !um.checkRoomRead(msg.ConnID, msg.RoomID) {
+		return
+	}
+
+	um.s.roomShard(msg.RoomID).roomHistoryPage <- msg
+}
+
+// checkRoomRead 只能查看自己所在并且没被封禁的房间的消息，不能查看时回复原因
+func (um *UserManage) checkRoomRead(connID int, roomID int) bool {
+	userName := um.userConnIDToName[connID]
+	if userName == "" {
+		return false
+	}
+	user := um.users[userName]
+	if user == nil {
+		return false
+	}
+
+	if um.roomBans[roomID][userName] {
+		um.sendSingleMsg(connID, RoomBanned)
+		return false
+	}
+	if user.RoomID != roomID {
+		um.sendSingleMsg(connID, NotRoomMember)
+		return false
+	}
+	return true
+}
+
+func (um *UserManage) banLogic(msg *UserBanMsg) {
+	um.applyBan(msg.RoomID, msg.Name, msg.Ban)
+	msg.Reply <- true
+
+	// 推送只在操作的节点发，别的节点只跟着封禁
+	if !msg.Ban {
+		um.emitModeration(WebhookActionUnban, msg.RoomID, msg.Name)
+		um.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneUnban, RoomID: msg.RoomID, Name: msg.Name})
+		return
+	}
+	um.emitModeration(WebhookActionBan, msg.RoomID, msg.Name)
+	um.s.backplaneManage.publish(&backplaneEvent{Kind: backplaneBan, RoomID: msg.RoomID, Name: msg.Name})
+}
+
+// applyBan 本节点和别的节点的封禁都走这里，封禁时通知房间，在房间里的踢出房间
+func (um *UserManage) applyBan(roomID int, name string, ban bool) {
+	if !ban {
+		delete(um.roomBans[roomID], name)
+		return
+	}
+	if um.roomBans[roomID][name] {
+		return
+	}
+	if um.roomBans[roomID] == nil {
+		um.roomBans[roomID] = make(map[string]bool)
+	}
+	um.roomBans[roomID][name] = true
 
 	// 通知房间
-	roomMsg := &RoomLogoutMsg{
-		ConnID: user.ConnID,
-		RoomID: user.RoomID,
+	um.s.msgManage.broadcastChan <- &BroadcastMsg{
+		RoomIDs: []int{roomID},
+		Type:    MsgTypeSystem,
+		Content: fmt.Sprintf(UserBanned, name),
+	}
+
+	// 在房间里的踢出房间
+	user := um.users[name]
+	if user == nil || user.Status != StatusOnline || user.RoomID != roomID {
+		return
+	}
+	user.RoomID = 0
+	for _, connID := range user.connIDList() {
+		um.sendSingleMsg(connID, RoomBanned)
+		um.s.roomShard(roomID).roomChangeChan <- &RoomChangeMsg{
+			OldRoomID:   roomID,
+			NewRoomID:   -1,
+			ConnID:      connID,
+			UserName:    user.Name,
+			DisplayName: user.DisplayName,
+			Seq:         um.s.nextRoomSeq(connID),
+		}
+	}
+}
+
+func (um *UserManage) emitModeration(action string, roomID int, name string) {
+	um.s.webhookManage.emit(&WebhookEvent{
+		Type:     WebhookEventModeration,
+		Action:   action,
+		RoomID:   roomID,
+		Time:     um.s.now(),
+		UserName: name,
+	})
+}
+
+// queryLogic 从第一个分片开始依次加上自己的用户，最后一个分片回复
+func (um *UserManage) queryLogic(msg *UserQueryMsg) {
+	now := um.s.now()
+	for _, user := range um.users {
+		msg.UserInfos = append(msg.UserInfos, &UserInfo{
+			UserID:      user.UserID,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			Status:      user.Status,
+			RoomID:      user.RoomID,
+			ConnIDs:     user.connIDList(),
+			LoginTime:   user.LoginTime,
+			LogoutTime:  user.LogoutTime,
+			OnlineTime:  user.onlineTime(now),
+		})
+	}
+	if next := um.shard + 1; next < len(um.s.userShards) {
+		um.s.userShards[next].userQueryChan <- msg
+		return
 	}
-	um.s.roomManage.roomLogoutMsg <- roomMsg
+	msg.Reply <- msg.UserInfos
 }
 
 func (um *UserManage) sendSingleMsg(connID int, content string) {
@@ -250,6 +654,7 @@ func (um *UserManage) sendSingleMsg(connID int, content string) {
 	connIDs = append(connIDs, connID)
 	pushToOtherMsg := make([]*BaseMsg, 0)
 	pushToOtherMsg = append(pushToOtherMsg, &BaseMsg{
+		Type:     MsgTypeSystem,
 		UserName: "",
 		Content:  content,
 	})
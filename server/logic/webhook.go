@@ -0,0 +1,389 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 推送的事件类型
+const (
+	WebhookEventMessage    = "message"
+	WebhookEventJoin       = "join"
+	WebhookEventLeave      = "leave"
+	WebhookEventModeration = "moderation"
+	WebhookEventEdit       = "edit"
+	WebhookEventDelete     = "delete"
+)
+
+// 管理事件的动作
+const (
+	WebhookActionBan   = "ban"
+	WebhookActionUnban = "unban"
+	WebhookActionOp    = "op"
+	WebhookActionDeop  = "deop"
+	WebhookActionKick  = "kick"
+)
+
+// 推送请求带的头
+const (
+	WebhookHeaderSignature = "X-Chat-Signature" // sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+	WebhookHeaderTimestamp = "X-Chat-Timestamp"
+	WebhookHeaderEvent     = "X-Chat-Event"
+	WebhookHeaderDelivery  = "X-Chat-Delivery" // 事件ID，重试时不变，接收方可以用来去重
+)
+
+// WebhookConfig 一个房间的推送配置
+type WebhookConfig struct {
+	URL    string
+	Secret string   // 为空不签名
+	Events []string // 为空推送所有事件
+}
+
+func (wc *WebhookConfig) wants(eventType string) bool {
+	if len(wc.Events) == 0 {
+		return true
+	}
+	for _, name := range wc.Events {
+		if name == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent 推送的JSON内容
+type WebhookEvent struct {
+	ID          int64             `json:"id"`
+	Type        string            `json:"type"`
+	Action      string            `json:"action,omitempty"` // 管理事件才有
+	RoomID      int               `json:"roomID"`
+	Time        int64             `json:"time"`
+	UserName    string            `json:"userName,omitempty"`
+	MsgID       int64             `json:"msgID,omitempty"`
+	Content     string            `json:"content,omitempty"`
+	ParentID    int64             `json:"parentID,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Integration string            `json:"integration,omitempty"` // 集成通过HTTP接口发的消息
+}
+
+type webhookDelivery struct {
+	ID       int64         `json:"id"`
+	RoomID   int           `json:"roomID"`
+	Event    *WebhookEvent `json:"event"`
+	Attempts int           `json:"-"`
+}
+
+type webhookResult struct {
+	RoomID int
+	Err    error
+}
+
+// WebhookManage 把房间事件推到配置的URL。
+// 每个房间一个队列，同时只有一个请求在路上，保证接收方看到的顺序和房间里一致
+type WebhookManage struct {
+	s *Service
+
+	queue   *webhookQueue
+	pending map[int][]*webhookDelivery
+	sending map[int]bool // 请求中或者等待重试
+	lastID  int64
+	client  *http.Client
+	dropped int64 // 事件通道满了丢掉的事件数，原子读写
+
+	eventChan  chan *WebhookEvent  // 新事件
+	resultChan chan *webhookResult // 请求结果
+	retryChan  chan int            // 退避时间到了，房间可以重试
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeChan chan bool
+}
+
+func (wm *WebhookManage) init(s *Service) {
+	wm.s = s
+	wm.pending = make(map[int][]*webhookDelivery)
+	wm.sending = make(map[int]bool)
+	wm.client = &http.Client{Timeout: WebhookTimeout}
+	wm.eventChan = make(chan *WebhookEvent, 1024)
+	wm.resultChan = make(chan *webhookResult, 64)
+	wm.retryChan = make(chan int, 64)
+	wm.ctx, wm.cancel = context.WithCancel(context.Background())
+	wm.closeChan = make(chan bool, 1)
+}
+
+func (wm *WebhookManage) Start(s *Service) {
+	wm.init(s)
+
+	// 没配置推送就不碰队列文件
+	queuePath := ""
+	if len(s.Config.Webhooks) > 0 {
+		queuePath = s.Config.WebhookQueueFile
+	}
+	queue, pending, lastID, err := openWebhookQueue(queuePath)
+	if err != nil {
+		log.Printf("open webhook queue %s err %s", queuePath, err.Error())
+		queue, pending, lastID, _ = openWebhookQueue("")
+	}
+	// 定时刷盘时按批写，否则每条都刷
+	if s.Config.WebhookSyncInterval > 0 {
+		queue.syncBatch = s.Config.WebhookSyncBatch
+	}
+	wm.queue = queue
+	wm.lastID = lastID
+	for _, delivery := range pending {
+		wm.pending[delivery.RoomID] = append(wm.pending[delivery.RoomID], delivery)
+	}
+	if len(pending) > 0 {
+		log.Printf("webhook queue restored %d deliveries", len(pending))
+	}
+
+	wm.wg.Add(1)
+	go wm.webhookLogic()
+}
+
+func (wm *WebhookManage) Stop() {
+	close(wm.closeChan)
+	wm.cancel()
+	wm.wg.Wait()
+	if err := wm.queue.close(); err != nil {
+		log.Printf("close webhook queue err %s", err.Error())
+	}
+}
+
+// emit 房间没配置或者不要这类事件就直接忽略，其他管理器调用。
+// 不能卡住房间分片，事件通道满了就丢掉并计数
+func (wm *WebhookManage) emit(event *WebhookEvent) {
+	if wm == nil {
+		return
+	}
+	config := wm.s.Config.Webhooks[event.RoomID]
+	if config == nil || !config.wants(event.Type) {
+		return
+	}
+	select {
+	case wm.eventChan <- event:
+	default:
+		dropped := atomic.AddInt64(&wm.dropped, 1)
+		log.Printf("webhook room %d event %s dropped, event chan full, %d dropped in total",
+			event.RoomID, event.Type, dropped)
+	}
+}
+
+// Dropped 事件通道满了丢掉的事件数
+func (wm *WebhookManage) Dropped() int64 {
+	return atomic.LoadInt64(&wm.dropped)
+}
+
+func (wm *WebhookManage) webhookLogic() {
+	defer wm.wg.Done()
+	for roomID := range wm.pending {
+		wm.dispatch(roomID)
+	}
+	var syncChan <-chan time.Time
+	if wm.s.Config.WebhookSyncInterval > 0 {
+		ticker := time.NewTicker(wm.s.Config.WebhookSyncInterval)
+		defer ticker.Stop()
+		syncChan = ticker.C
+	}
+	for {
+		select {
+		case <-syncChan:
+			if err := wm.queue.sync(); err != nil {
+				log.Printf("webhook queue sync err %s", err.Error())
+			}
+		case event := <-wm.eventChan:
+			wm.eventLogic(event)
+		case result := <-wm.resultChan:
+			wm.resultLogic(result)
+		case roomID := <-wm.retryChan:
+			wm.sending[roomID] = false
+			wm.dispatch(roomID)
+		case <-wm.closeChan:
+			// 其他管理器先停，已经发来的事件落盘，重启后再投递
+			for {
+				select {
+				case event := <-wm.eventChan:
+					wm.enqueue(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (wm *WebhookManage) eventLogic(event *WebhookEvent) {
+	wm.enqueue(event)
+	wm.dispatch(event.RoomID)
+}
+
+func (wm *WebhookManage) enqueue(event *WebhookEvent) {
+	wm.lastID++
+	event.ID = wm.lastID
+	delivery := &webhookDelivery{
+		ID:     event.ID,
+		RoomID: event.RoomID,
+		Event:  event,
+	}
+	// 先落盘再投递，写失败也照样投递，只是重启会丢
+	if err := wm.queue.add(delivery); err != nil {
+		log.Printf("webhook queue add %d err %s", delivery.ID, err.Error())
+	}
+	wm.pending[event.RoomID] = append(wm.pending[event.RoomID], delivery)
+}
+
+func (wm *WebhookManage) resultLogic(result *webhookResult) {
+	queue := wm.pending[result.RoomID]
+	if len(queue) == 0 {
+		wm.sending[result.RoomID] = false
+		return
+	}
+	delivery := queue[0]
+
+	if result.Err != nil {
+		delivery.Attempts++
+		if delivery.Attempts < wm.s.Config.WebhookMaxAttempts {
+			delay := wm.backoff(delivery.Attempts)
+			log.Printf("webhook room %d delivery %d attempt %d err %s, retry in %s",
+				delivery.RoomID, delivery.ID, delivery.Attempts, result.Err.Error(), delay)
+			time.AfterFunc(delay, func() {
+				select {
+				case wm.retryChan <- result.RoomID:
+				case <-wm.closeChan:
+				}
+			})
+			return
+		}
+		log.Printf("webhook room %d delivery %d dropped after %d attempts",
+			delivery.RoomID, delivery.ID, delivery.Attempts)
+	}
+
+	wm.finish(result.RoomID)
+	wm.sending[result.RoomID] = false
+	wm.dispatch(result.RoomID)
+}
+
+// finish 队首的投递完成，移出队列。完成的多了就压缩队列文件
+func (wm *WebhookManage) finish(roomID int) {
+	delivery := wm.pending[roomID][0]
+	wm.pending[roomID] = wm.pending[roomID][1:]
+	if err := wm.queue.done(delivery.ID); err != nil {
+		log.Printf("webhook queue done %d err %s", delivery.ID, err.Error())
+	}
+	if wm.queue.path == "" || wm.queue.doneNum < wm.s.Config.WebhookQueueCompact {
+		return
+	}
+
+	pending := make([]*webhookDelivery, 0)
+	for _, roomPending := range wm.pending {
+		pending = append(pending, roomPending...)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID < pending[j].ID
+	})
+	if err := wm.queue.compact(wm.lastID, pending); err != nil {
+		log.Printf("webhook queue compact err %s", err.Error())
+	}
+}
+
+// dispatch 房间空闲时发出队首的事件
+func (wm *WebhookManage) dispatch(roomID int) {
+	if wm.sending[roomID] {
+		return
+	}
+	for len(wm.pending[roomID]) > 0 {
+		delivery := wm.pending[roomID][0]
+		config := wm.s.Config.Webhooks[roomID]
+		if config != nil {
+			wm.sending[roomID] = true
+			wm.wg.Add(1)
+			go wm.deliver(config, delivery)
+			return
+		}
+		// 重启后房间的配置去掉了
+		wm.finish(roomID)
+	}
+	delete(wm.pending, roomID)
+}
+
+// deliver 在单独的协程里发请求，结果交回管理协程
+func (wm *WebhookManage) deliver(config *WebhookConfig, delivery *webhookDelivery) {
+	defer wm.wg.Done()
+	err := wm.post(config, delivery)
+	select {
+	case wm.resultChan <- &webhookResult{RoomID: delivery.RoomID, Err: err}:
+	case <-wm.closeChan:
+	}
+}
+
+func (wm *WebhookManage) post(config *WebhookConfig, delivery *webhookDelivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(wm.ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := wm.s.now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEvent, delivery.Event.Type)
+	req.Header.Set(WebhookHeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookHeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	if config.Secret != "" {
+		req.Header.Set(WebhookHeaderSignature, SignWebhook(config.Secret, timestamp, body))
+	}
+
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff 每失败一次等待时间翻倍，不超过上限
+func (wm *WebhookManage) backoff(attempts int) time.Duration {
+	delay := wm.s.Config.WebhookRetryBase
+	for i := 1; i < attempts && delay < wm.s.Config.WebhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > wm.s.Config.WebhookRetryMax {
+		delay = wm.s.Config.WebhookRetryMax
+	}
+	return delay
+}
+
+// SignWebhook 计算签名头的值，接收方用同样的secret算一遍比较
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook 校验一个推送请求的签名，timestamp和signature取自请求头
+func VerifyWebhook(secret string, timestamp string, body []byte, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(SignWebhook(secret, ts, body)), []byte(signature))
+}
@@ -0,0 +1,204 @@
+package logic
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// 队列文件里每行一条记录
+const (
+	webhookOpAdd  = "add"
+	webhookOpDone = "done"
+	webhookOpSeq  = "seq"
+)
+
+type webhookRecord struct {
+	Op       string           `json:"op"`
+	ID       int64            `json:"id,omitempty"`
+	Delivery *webhookDelivery `json:"delivery,omitempty"`
+}
+
+// webhookQueue 追加写的队列文件，投递前先写进去，重启后把没投递完的读回来。
+// 记录先攒在缓冲里，攒够syncBatch条或者管理协程定时调sync时一起刷盘。
+// path为空只在内存里
+type webhookQueue struct {
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	doneNum   int // 上次压缩后完成的投递数
+	unsynced  int // 还没刷盘的记录数
+	syncBatch int // 为0每条都刷盘
+}
+
+// openWebhookQueue 读出没完成的投递，按入队顺序，再把文件压缩成只剩这些
+func openWebhookQueue(path string) (*webhookQueue, []*webhookDelivery, int64, error) {
+	wq := &webhookQueue{path: path}
+	if path == "" {
+		return wq, nil, 0, nil
+	}
+
+	pending, lastID, err := readWebhookQueue(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if err := wq.compact(lastID, pending); err != nil {
+		return nil, nil, 0, err
+	}
+	return wq, pending, lastID, nil
+}
+
+// compact 把文件重写成只剩没完成的投递，之后接着往新文件追加。
+// 先写临时文件再替换，中途失败不会丢
+func (wq *webhookQueue) compact(lastID int64, pending []*webhookDelivery) error {
+	if wq.path == "" {
+		return nil
+	}
+	tmpPath := wq.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	if err := writeWebhookRecord(writer, &webhookRecord{Op: webhookOpSeq, ID: lastID}); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	for _, delivery := range pending {
+		if err := writeWebhookRecord(writer, &webhookRecord{Op: webhookOpAdd, Delivery: delivery}); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, wq.path); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if wq.file != nil {
+		wq.file.Close()
+	}
+	// 旧文件缓冲里没刷的记录已经包含在重写的内容里
+	wq.file = tmpFile
+	wq.writer = bufio.NewWriter(tmpFile)
+	wq.doneNum = 0
+	wq.unsynced = 0
+	return nil
+}
+
+func readWebhookQueue(path string) ([]*webhookDelivery, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var lastID int64
+	deliveries := make(map[int64]*webhookDelivery)
+	order := make([]int64, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &webhookRecord{}
+		// 最后一行可能没写完，跳过
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			continue
+		}
+		switch record.Op {
+		case webhookOpSeq:
+			if record.ID > lastID {
+				lastID = record.ID
+			}
+		case webhookOpAdd:
+			if record.Delivery == nil {
+				continue
+			}
+			deliveries[record.Delivery.ID] = record.Delivery
+			order = append(order, record.Delivery.ID)
+			if record.Delivery.ID > lastID {
+				lastID = record.Delivery.ID
+			}
+		case webhookOpDone:
+			delete(deliveries, record.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	pending := make([]*webhookDelivery, 0, len(deliveries))
+	for _, id := range order {
+		if delivery, ok := deliveries[id]; ok {
+			pending = append(pending, delivery)
+			delete(deliveries, id)
+		}
+	}
+	return pending, lastID, nil
+}
+
+func (wq *webhookQueue) add(delivery *webhookDelivery) error {
+	return wq.append(&webhookRecord{Op: webhookOpAdd, Delivery: delivery})
+}
+
+func (wq *webhookQueue) done(id int64) error {
+	wq.doneNum++
+	return wq.append(&webhookRecord{Op: webhookOpDone, ID: id})
+}
+
+// append 写进缓冲，攒够一批再刷盘，没刷盘时进程挂了会丢最近的这批
+func (wq *webhookQueue) append(record *webhookRecord) error {
+	if wq.file == nil {
+		return nil
+	}
+	if err := writeWebhookRecord(wq.writer, record); err != nil {
+		return err
+	}
+	wq.unsynced++
+	if wq.unsynced < wq.syncBatch {
+		return nil
+	}
+	return wq.sync()
+}
+
+// sync 把缓冲里的记录刷到磁盘
+func (wq *webhookQueue) sync() error {
+	if wq.file == nil || wq.unsynced == 0 {
+		return nil
+	}
+	if err := wq.writer.Flush(); err != nil {
+		return err
+	}
+	wq.unsynced = 0
+	return wq.file.Sync()
+}
+
+func writeWebhookRecord(w io.Writer, record *webhookRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func (wq *webhookQueue) close() error {
+	if wq.file == nil {
+		return nil
+	}
+	if err := wq.sync(); err != nil {
+		wq.file.Close()
+		return err
+	}
+	return wq.file.Close()
+}
@@ -0,0 +1,324 @@
+package logic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver 本地的推送接收方，secret不为空时校验签名，前fail个请求返回500
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	lock     sync.Mutex
+	fail     int
+	requests int
+	events   chan *WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string, fail int) (*webhookReceiver, *httptest.Server) {
+	wr := &webhookReceiver{t: t, secret: secret, fail: fail, events: make(chan *WebhookEvent, 64)}
+	server := httptest.NewServer(wr)
+	t.Cleanup(server.Close)
+	return wr, server
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if wr.secret != "" && !VerifyWebhook(wr.secret, r.Header.Get(WebhookHeaderTimestamp), body, r.Header.Get(WebhookHeaderSignature)) {
+		wr.t.Errorf("bad signature %s", r.Header.Get(WebhookHeaderSignature))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	wr.lock.Lock()
+	wr.requests++
+	fail := wr.requests <= wr.fail
+	wr.lock.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	event := &WebhookEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		wr.t.Errorf("decode event err %v", err)
+	}
+	if r.Header.Get(WebhookHeaderEvent) != event.Type {
+		wr.t.Errorf("event header %q, type %q", r.Header.Get(WebhookHeaderEvent), event.Type)
+	}
+	wr.events <- event
+}
+
+func (wr *webhookReceiver) expect(eventType string, action string, userName string) *WebhookEvent {
+	wr.t.Helper()
+	select {
+	case event := <-wr.events:
+		if event.Type != eventType || event.Action != action || event.UserName != userName {
+			wr.t.Fatalf("event = %+v, want %s %s %s", event, eventType, action, userName)
+		}
+		return event
+	case <-time.After(testExpectTimeout):
+		wr.t.Fatalf("timeout waiting for %s %s %s", eventType, action, userName)
+	}
+	return nil
+}
+
+func webhookTestConfig(t *testing.T, url string, secret string) *Config {
+	config := DefaultConfig()
+	config.BadWordsFile = ""
+	config.Webhooks = map[int]*WebhookConfig{2: {URL: url, Secret: secret}}
+	config.WebhookQueueFile = filepath.Join(t.TempDir(), "webhook.queue")
+	config.WebhookRetryBase = 5 * time.Millisecond
+	config.WebhookRetryMax = 20 * time.Millisecond
+	return config
+}
+
+func TestWebhook_sign(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := SignWebhook("secret", 100, body)
+	if !VerifyWebhook("secret", "100", body, signature) {
+		t.Errorf("verify own signature failed")
+	}
+	if VerifyWebhook("secret", "101", body, signature) || VerifyWebhook("other", "100", body, signature) ||
+		VerifyWebhook("secret", "100", []byte(`{"id":2}`), signature) {
+		t.Errorf("verify should fail on changed input")
+	}
+}
+
+func TestWebhookQueue_replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.queue")
+	queue, pending, lastID, err := openWebhookQueue(path)
+	if err != nil || len(pending) != 0 || lastID != 0 {
+		t.Fatalf("open empty = %v %d %v", pending, lastID, err)
+	}
+	for id := int64(1); id <= 3; id++ {
+		queue.add(&webhookDelivery{ID: id, RoomID: 2, Event: &WebhookEvent{ID: id, Type: WebhookEventMessage}})
+	}
+	queue.done(2)
+	queue.close()
+
+	queue, pending, lastID, err = openWebhookQueue(path)
+	if err != nil || lastID != 3 || len(pending) != 2 || pending[0].ID != 1 || pending[1].ID != 3 {
+		t.Fatalf("replay = %v %d %v", pending, lastID, err)
+	}
+	queue.done(1)
+	queue.done(3)
+	queue.close()
+
+	// 全部完成后ID也不能重头开始
+	queue, pending, lastID, err = openWebhookQueue(path)
+	if err != nil || lastID != 3 || len(pending) != 0 {
+		t.Fatalf("replay done = %v %d %v", pending, lastID, err)
+	}
+	queue.close()
+}
+
+func TestWebhookQueue_syncBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.queue")
+	queue, _, _, err := openWebhookQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.syncBatch = 3
+	add := func(id int64) {
+		queue.add(&webhookDelivery{ID: id, RoomID: 2, Event: &WebhookEvent{ID: id, Type: WebhookEventMessage}})
+	}
+
+	// 不够一批还在缓冲里，文件里只有序号
+	add(1)
+	add(2)
+	if records := readWebhookRecords(t, path); len(records) != 1 {
+		t.Fatalf("records before batch = %+v", records)
+	}
+	add(3)
+	if records := readWebhookRecords(t, path); len(records) != 4 {
+		t.Fatalf("records after batch = %+v", records)
+	}
+
+	// 定时刷盘和关闭时刷掉剩下的
+	add(4)
+	if err := queue.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if records := readWebhookRecords(t, path); len(records) != 5 {
+		t.Fatalf("records after sync = %+v", records)
+	}
+	add(5)
+	queue.close()
+	_, pending, lastID, err := openWebhookQueue(path)
+	if err != nil || lastID != 5 || len(pending) != 5 {
+		t.Fatalf("replay = %v %d %v", pending, lastID, err)
+	}
+}
+
+func TestWebhook_emitFull(t *testing.T) {
+	config := webhookTestConfig(t, "http://127.0.0.1:1", "")
+	s := &Service{Config: config}
+	wm := &WebhookManage{}
+	wm.init(s)
+	s.webhookManage = wm
+
+	// 管理协程没在读，通道满了emit也不能卡住
+	for i := 0; i < cap(wm.eventChan); i++ {
+		wm.emit(&WebhookEvent{Type: WebhookEventMessage, RoomID: 2})
+	}
+	done := make(chan bool)
+	go func() {
+		wm.emit(&WebhookEvent{Type: WebhookEventMessage, RoomID: 2})
+		wm.emit(&WebhookEvent{Type: WebhookEventJoin, RoomID: 2})
+		// 没配置的房间不算丢
+		wm.emit(&WebhookEvent{Type: WebhookEventMessage, RoomID: 3})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testExpectTimeout):
+		t.Fatal("emit blocked on full event chan")
+	}
+	if wm.Dropped() != 2 {
+		t.Errorf("dropped = %d, want 2", wm.Dropped())
+	}
+
+	am := &AdminManage{s: s}
+	recorder := httptest.NewRecorder()
+	am.webhooksHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil))
+	resp := &adminWebhooksResp{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil || resp.Dropped != 2 {
+		t.Errorf("webhooks resp = %s %v", recorder.Body.String(), err)
+	}
+}
+
+func TestHarness_webhook(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "s3cret", 2)
+	config := webhookTestConfig(t, server.URL, "s3cret")
+	h := newTestHarness(t, config)
+
+	// 前两次失败，重试后按顺序送达
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	receiver.expect(WebhookEventJoin, "", "alice")
+	chatMsg := alice.say("hello https://go.dev")
+	event := receiver.expect(WebhookEventMessage, "", "alice")
+	if event.MsgID != chatMsg.MsgID || event.Content != "hello https://go.dev" || event.Annotations[AnnotationLinks] != "go.dev" {
+		t.Errorf("message event = %+v", event)
+	}
+
+	// 编辑和删除也推送
+	alice.send(fmt.Sprintf("%s %d hello again", Edit, chatMsg.MsgID))
+	if event = receiver.expect(WebhookEventEdit, "", "alice"); event.MsgID != chatMsg.MsgID || event.Content != "hello again" {
+		t.Errorf("edit event = %+v", event)
+	}
+	alice.send(fmt.Sprintf("%s %d", Delete, chatMsg.MsgID))
+	if event = receiver.expect(WebhookEventDelete, "", "alice"); event.MsgID != chatMsg.MsgID || event.Content != "" {
+		t.Errorf("delete event = %+v", event)
+	}
+
+	// 没配置的房间不推送
+	bob := h.login("bob")
+	bob.joinRoom(3)
+	bob.say("quiet")
+	bob.joinRoom(2)
+	receiver.expect(WebhookEventJoin, "", "bob")
+	bob.joinRoom(3)
+	receiver.expect(WebhookEventLeave, "", "bob")
+
+	reply := make(chan bool, 1)
+	h.s.roomShard(2).roomOpChan <- &RoomOpMsg{RoomID: 2, Name: "bob", Op: true, Reply: reply}
+	<-reply
+	receiver.expect(WebhookEventModeration, WebhookActionOp, "bob")
+	h.s.userShard("alice").userBanChan <- &UserBanMsg{RoomID: 2, Name: "alice", Ban: true, Reply: reply}
+	<-reply
+	receiver.expect(WebhookEventModeration, WebhookActionBan, "alice")
+	receiver.expect(WebhookEventLeave, "", "alice")
+}
+
+func TestHarness_webhookCompact(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "", 0)
+	config := webhookTestConfig(t, server.URL, "")
+	config.WebhookQueueCompact = 2
+	h := newTestHarness(t, config)
+
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	receiver.expect(WebhookEventJoin, "", "alice")
+	for _, content := range []string{"one", "two", "three"} {
+		alice.say(content)
+		receiver.expect(WebhookEventMessage, "", "alice")
+	}
+
+	// 四条都完成，第二条和第四条完成后各压缩一次，只剩序号
+	deadline := time.Now().Add(testExpectTimeout)
+	for {
+		records := readWebhookRecords(t, config.WebhookQueueFile)
+		if len(records) == 1 && records[0].Op == webhookOpSeq && records[0].ID == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue records = %+v", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readWebhookRecords(t *testing.T, path string) []*webhookRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records := make([]*webhookRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 可能读到正在写的一行
+		record := &webhookRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestHarness_webhookDurable(t *testing.T) {
+	// 接收方一直失败，事件留在队列里
+	receiver, server := newWebhookReceiver(t, "", 1000)
+	config := webhookTestConfig(t, server.URL, "")
+	config.WebhookRetryBase = time.Hour
+	config.WebhookRetryMax = time.Hour
+	config.ListenAddr = "127.0.0.1:0"
+	config.AdminAddr = ""
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC))
+	h := &testHarness{t: t, s: &Service{Config: config, Clock: clock}, clock: clock}
+	h.s.Start()
+	alice := h.login("alice")
+	alice.joinRoom(2)
+	alice.say("one")
+	alice.say("two")
+	h.s.Stop()
+
+	// 同一个队列文件重启，接收方恢复后依次补发
+	receiver.lock.Lock()
+	receiver.fail = 0
+	receiver.lock.Unlock()
+	config.WebhookRetryBase = 5 * time.Millisecond
+	s := &Service{Config: config, Clock: clock}
+	s.Start()
+	defer s.Stop()
+
+	receiver.expect(WebhookEventJoin, "", "alice")
+	first := receiver.expect(WebhookEventMessage, "", "alice")
+	second := receiver.expect(WebhookEventMessage, "", "alice")
+	if first.Content != "one" || second.Content != "two" || second.ID <= first.ID {
+		t.Errorf("replayed = %+v %+v", first, second)
+	}
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"simpleChat/server/logic"
+	"strings"
 	"syscall"
 )
 
 func main() {
 	log.Printf("service begin")
+	// 读配置
+	config := logic.DefaultConfig()
+	flag.StringVar(&config.ListenAddr, "addr", config.ListenAddr, "chat listen address")
+	flag.StringVar(&config.AdminAddr, "admin", config.AdminAddr, "admin api listen address")
+	redisAddr := flag.String("redis", "", "redis address for sharing rooms between nodes, empty runs a single node")
+	flag.IntVar(&config.NodeID, "node", config.NodeID, "node id, unique among nodes sharing the same redis")
+	flag.IntVar(&config.RoomShards, "room-shards", config.RoomShards, "room worker goroutines, 1 runs all rooms in one loop")
+	flag.IntVar(&config.UserShards, "user-shards", config.UserShards, "user worker goroutines, 1 runs all users in one loop")
+	flag.Parse()
+	// token不放在命令行里，避免被ps看到
+	config.AdminToken = os.Getenv("CHAT_ADMIN_TOKEN")
+	config.IntegrationTokens = parseIntegrationTokens(os.Getenv("CHAT_INTEGRATION_TOKENS"))
+
 	// 初始化
-	service := &logic.Service{}
+	service := &logic.Service{Config: config}
+	if *redisAddr != "" {
+		backplane, err := logic.DialRedisBackplane(*redisAddr)
+		if err != nil {
+			log.Fatalf("dial redis %s err %s", *redisAddr, err.Error())
+		}
+		defer backplane.Close()
+		service.Backplane = backplane
+	}
 	service.Start()
 	log.Printf("service start ok")
 
@@ -31,3 +54,16 @@ func signalKill() {
 		log.Printf("rev kill signal %v ...", sig)
 	}
 }
+
+// parseIntegrationTokens 格式为name=token，多个用逗号分隔
+func parseIntegrationTokens(value string) map[string]string {
+	tokens := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		pair := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		tokens[pair[1]] = pair[0]
+	}
+	return tokens
+}